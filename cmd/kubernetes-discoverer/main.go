@@ -19,24 +19,32 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/projectcontour/gimbal/pkg/buildinfo"
 
+	"github.com/projectcontour/gimbal/pkg/health"
 	"github.com/projectcontour/gimbal/pkg/k8s"
+	"github.com/projectcontour/gimbal/pkg/leader"
 	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
 	"github.com/projectcontour/gimbal/pkg/signals"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/translator"
 	"github.com/projectcontour/gimbal/pkg/util"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	_ "k8s.io/api/core/v1"
-	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
 )
 
 var (
 	printVersion          bool
 	gimbalKubeCfgFile     string
 	discovererKubeCfgFile string
+	discovererKubeCfgDir  string
+	kubeCfgDirSyncPeriod  time.Duration
+	kubeCfgSyncPeriod     time.Duration
 	numProcessThreads     int
 	backendName           string
 	resyncInterval        time.Duration
@@ -45,19 +53,81 @@ var (
 	discovererMetrics     localmetrics.DiscovererMetrics
 	gimbalKubeClientQPS   float64
 	gimbalKubeClientBurst int
+	namespaceInclude      string
+	namespaceExclude      string
+	namespaceSelector     string
+	discoveryMode         string
+	namespaceMap          string
+	namespacePrefix       string
+	namespaceSuffix       string
+	namespaceTemplate     string
+	reconciliationPeriod  time.Duration
+	endpointsMode         string
+	addressMode           string
+	backendAddressModes   string
+	externalNameMode      string
+	annotationAllow       string
+	annotationDeny        string
+	annotationRewrites    string
+	leaderElect           bool
+	leaderElectNamespace  string
+	leaderElectLease      time.Duration
+	leaderElectRenew      time.Duration
+	leaderElectRetry      time.Duration
+	readyMaxEventAge      time.Duration
+	readyMaxQueueLength   int
+	debounceWindow        time.Duration
+	debounceMaxDelay      time.Duration
+	topology              bool
+	backendWeight         string
+	backendWeights        string
 )
 
+// healthCheckTimeout is the time after which a health check fails
+const healthCheckTimeout = 5 * time.Second
+
 func init() {
 	flag.BoolVar(&printVersion, "version", false, "Show version and quit")
 	flag.IntVar(&numProcessThreads, "num-threads", 2, "Specify number of threads to use when processing queue items.")
 	flag.StringVar(&gimbalKubeCfgFile, "gimbal-kubecfg-file", "", "Location of kubecfg file for access to gimbal system kubernetes api, defaults to service account tokens")
 	flag.StringVar(&discovererKubeCfgFile, "discover-kubecfg-file", "", "Location of kubecfg file for access to remote discover system kubernetes api")
+	flag.StringVar(&discovererKubeCfgDir, "discover-kubecfg-dir", "", "Location of a directory of kubecfg files, one per remote discover system kubernetes api. The backend name of each file is its name without extension")
+	flag.DurationVar(&kubeCfgDirSyncPeriod, "discover-kubecfg-dir-sync-period", 30*time.Second, "The interval of time between scans of the discover-kubecfg-dir for added, removed or changed kubecfg files")
+	flag.DurationVar(&kubeCfgSyncPeriod, "discover-kubecfg-sync-period", 30*time.Second, "The interval of time between checks of the discover-kubecfg-file for changes. If zero, the file is only read on startup")
 	flag.StringVar(&backendName, "backend-name", "", "Name of backend (must be unique)")
 	flag.DurationVar(&resyncInterval, "resync-interval", time.Minute*30, "Default resync period for watcher to refresh")
 	flag.BoolVar(&debug, "debug", false, "Enable debug logging.")
 	flag.IntVar(&prometheusListenPort, "prometheus-listen-address", 8080, "The address to listen on for Prometheus HTTP requests")
 	flag.Float64Var(&gimbalKubeClientQPS, "gimbal-client-qps", 5, "The maximum queries per second (QPS) that can be performed on the Gimbal Kubernetes API server")
 	flag.IntVar(&gimbalKubeClientBurst, "gimbal-client-burst", 10, "The maximum number of queries that can be performed on the Gimbal Kubernetes API server during a burst")
+	flag.StringVar(&namespaceInclude, "namespace-include", "", "Comma-separated list of remote namespaces to discover, as globs or /regular expressions/. If empty, all namespaces are discovered")
+	flag.StringVar(&namespaceExclude, "namespace-exclude", "kube-system", "Comma-separated list of remote namespaces not to discover, as globs or /regular expressions/")
+	flag.StringVar(&namespaceSelector, "namespace-selector", "", "Label selector of the remote namespaces to discover. If empty, namespaces are not filtered by label")
+	flag.StringVar(&discoveryMode, "discovery-mode", string(k8s.DiscoveryOptOut), "Whether remote services are discovered unless annotated with gimbal.projectcontour.io/discover=false (opt-out), or only when annotated with gimbal.projectcontour.io/discover=true (opt-in)")
+	flag.StringVar(&namespaceMap, "namespace-map", "", "Comma-separated list of remote=gimbal namespace mappings. Takes precedence over the other namespace mapping flags")
+	flag.StringVar(&namespacePrefix, "namespace-prefix", "", "Prefix added to remote namespace names to build Gimbal namespace names")
+	flag.StringVar(&namespaceSuffix, "namespace-suffix", "", "Suffix added to remote namespace names to build Gimbal namespace names")
+	flag.StringVar(&namespaceTemplate, "namespace-template", "", "Template of Gimbal namespace names, where {{backend}} is replaced by the backend name and {{namespace}} by the remote namespace name. Mutually exclusive with namespace-prefix and namespace-suffix")
+	flag.DurationVar(&reconciliationPeriod, "reconciliation-period", 5*time.Minute, "The interval of time between full reconciliations of the replicated services and endpoints with the remote clusters. If zero, reconciliation only runs on startup")
+	flag.StringVar(&endpointsMode, "endpoints-mode", string(k8s.EndpointsModeEndpoints), "Whether remote endpoints are read and written to Gimbal as Endpoints (endpoints), EndpointSlices (endpointslices) or both (both)")
+	flag.StringVar(&addressMode, "address-mode", string(k8s.AddressModePod), "Whether endpoints are replicated with the remote pod addresses (pod), the remote node addresses and service node ports (nodeport), or the service load balancer addresses (loadbalancer)")
+	flag.StringVar(&backendAddressModes, "backend-address-modes", "", "Comma-separated list of backend=mode address modes, overriding address-mode for the given backends")
+	flag.StringVar(&externalNameMode, "external-name-mode", string(k8s.ExternalNameModeService), "Whether ExternalName services are replicated as ExternalName services (externalname), or as headless services with endpoints resolved from their external name (resolve)")
+	flag.StringVar(&annotationAllow, "annotation-allow", "", "Comma-separated list of globs of the annotation keys that are replicated. If empty, all annotations are replicated")
+	flag.StringVar(&annotationDeny, "annotation-deny", translator.LastAppliedConfigAnnotation, "Comma-separated list of globs of the annotation keys that are not replicated")
+	flag.StringVar(&annotationRewrites, "annotation-rewrites", "", "Comma-separated list of prefix=replacement annotation key prefix rewrites, where {{backend}} is replaced by the backend name")
+	flag.BoolVar(&leaderElect, "leader-elect", false, "Elect a leader among the replicas of the discoverer for each backend, so that only the leader writes to Gimbal")
+	flag.StringVar(&leaderElectNamespace, "leader-elect-namespace", leader.DefaultNamespace(), "Namespace of the leader election leases in the Gimbal cluster, defaults to the namespace of the pod")
+	flag.DurationVar(&leaderElectLease, "leader-elect-lease-duration", leader.DefaultLeaseDuration, "The duration that standby replicas wait before taking over a lease that is not renewed")
+	flag.DurationVar(&leaderElectRenew, "leader-elect-renew-deadline", leader.DefaultRenewDeadline, "The duration that the leader retries renewing its lease before giving up leadership")
+	flag.DurationVar(&leaderElectRetry, "leader-elect-retry-period", leader.DefaultRetryPeriod, "The duration between attempts to acquire or renew a lease")
+	flag.DurationVar(&readyMaxEventAge, "readiness-max-event-age", 0, "The maximum time since the last event received from a remote cluster for the discoverer to be ready. Should be longer than resync-interval. If zero, the time is not checked")
+	flag.IntVar(&readyMaxQueueLength, "readiness-max-queue-length", 0, "The maximum number of actions waiting in the queue for the discoverer to be ready. If zero, the length is not checked")
+	flag.DurationVar(&debounceWindow, "endpoints-debounce-window", 0, "The window during which further updates of the same remote endpoints or endpoint slice are coalesced into the latest one before it is synced. If zero, updates are synced at once")
+	flag.DurationVar(&debounceMaxDelay, "endpoints-debounce-max-delay", 2*time.Second, "The maximum time an update of endpoints or endpoint slices is delayed by further updates. Raised to endpoints-debounce-window if shorter")
+	flag.BoolVar(&topology, "topology", false, "Record the zones and regions of the endpoints of services, read from the topology labels of the remote nodes, in the labels and annotations of the Gimbal services")
+	flag.StringVar(&backendWeight, "backend-weight", "", "Default weight of the services, recorded in their gimbal.projectcontour.io/weight annotation unless the remote service has one. If empty, services have no default weight")
+	flag.StringVar(&backendWeights, "backend-weights", "", "Comma-separated list of backend=weight default weights, overriding backend-weight for the given backends")
 	flag.Parse()
 }
 
@@ -78,8 +148,18 @@ func main() {
 	log.Infof("Backend name: %s", backendName)
 	log.Infof("Number of queue worker threads: %d", numProcessThreads)
 	log.Infof("Resync interval: %v", resyncInterval)
+	log.Infof("Reconciliation period: %v", reconciliationPeriod)
 	log.Infof("Gimbal kubernetes client QPS: %v", gimbalKubeClientQPS)
 	log.Infof("Gimbal kubernetes client burst: %d", gimbalKubeClientBurst)
+	log.Infof("Namespace include: %q, exclude: %q, selector: %q", namespaceInclude, namespaceExclude, namespaceSelector)
+	log.Infof("Discovery mode: %s", discoveryMode)
+	log.Infof("Endpoints mode: %s", endpointsMode)
+	log.Infof("Address mode: %s, backend address modes: %q", addressMode, backendAddressModes)
+	log.Infof("External name mode: %s", externalNameMode)
+	log.Infof("Endpoints debounce window: %v, max delay: %v", debounceWindow, debounceMaxDelay)
+	log.Infof("Topology: %v", topology)
+	log.Infof("Backend weight: %q, backend weights: %q", backendWeight, backendWeights)
+	log.Infof("Namespace map: %q, prefix: %q, suffix: %q, template: %q", namespaceMap, namespacePrefix, namespaceSuffix, namespaceTemplate)
 
 	// Init prometheus metrics
 	discovererMetrics = localmetrics.NewMetrics("kubernetes", backendName)
@@ -92,15 +172,20 @@ func main() {
 		log.Level = logrus.DebugLevel
 	}
 
-	// Verify cluster name is passed
-	if util.IsInvalidBackendName(backendName) {
-		log.Fatalf("The Kubernetes cluster name must be provided using the `--backend-name` flag or the one passed is invalid")
+	// Exactly one of the discovered cluster file or directory must be passed
+	if discovererKubeCfgFile == "" && discovererKubeCfgDir == "" {
+		log.Fatalf("`discover-kubecfg-file` or `discover-kubecfg-dir` arg is required!")
+	}
+	if discovererKubeCfgFile != "" && discovererKubeCfgDir != "" {
+		log.Fatalf("`discover-kubecfg-file` and `discover-kubecfg-dir` args are mutually exclusive!")
 	}
-	log.Infof("BackendName is: %s", backendName)
 
-	// Discovered cluster is passed
-	if discovererKubeCfgFile == "" {
-		log.Fatalf("`discover-kubecfg-file` arg is required!")
+	// Verify cluster name is passed when discovering a single cluster
+	if discovererKubeCfgFile != "" {
+		if util.IsInvalidBackendName(backendName) {
+			log.Fatalf("The Kubernetes cluster name must be provided using the `--backend-name` flag or the one passed is invalid")
+		}
+		log.Infof("BackendName is: %s", backendName)
 	}
 
 	// Init
@@ -109,30 +194,142 @@ func main() {
 		log.Fatal("Could not init k8sclient! ", err)
 	}
 
-	k8sDiscovererClient, err := k8s.NewClient(discovererKubeCfgFile, log)
+	namespaceFilter, err := k8s.NewNamespaceFilter(splitList(namespaceInclude), splitList(namespaceExclude), namespaceSelector)
+	if err != nil {
+		log.Fatal("Could not init namespace filter! ", err)
+	}
+
+	mode, err := k8s.ParseDiscoveryMode(discoveryMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	epMode, err := k8s.ParseEndpointsMode(endpointsMode)
 	if err != nil {
-		log.Fatal("Could not init k8s discoverer client! ", err)
+		log.Fatal(err)
 	}
 
-	log.Info("Starting shared informer, resync interval is: ", resyncInterval)
+	defaultAddressMode, err := k8s.ParseAddressMode(addressMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	backendModes, err := parseMappings(backendAddressModes)
+	if err != nil {
+		log.Fatal("Could not parse backend address modes! ", err)
+	}
+	addressModes := map[string]k8s.AddressMode{}
+	podAddressesOnly := defaultAddressMode == k8s.AddressModePod
+	for backend, m := range backendModes {
+		if addressModes[backend], err = k8s.ParseAddressMode(m); err != nil {
+			log.Fatal(err)
+		}
+		podAddressesOnly = podAddressesOnly && addressModes[backend] == k8s.AddressModePod
+	}
+	// Endpoints built from nodes or load balancers cannot be split into the
+	// endpoint slices of the remote cluster
+	if !podAddressesOnly && epMode != k8s.EndpointsModeEndpoints {
+		log.Fatalf("`address-mode` and `backend-address-modes` other than %q require `endpoints-mode` %q", k8s.AddressModePod, k8s.EndpointsModeEndpoints)
+	}
 
-	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(k8sDiscovererClient, resyncInterval)
+	nameMode, err := k8s.ParseExternalNameMode(externalNameMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if nameMode == k8s.ExternalNameModeResolve && epMode == k8s.EndpointsModeEndpointSlices {
+		log.Fatalf("`external-name-mode` %q requires `endpoints-mode` %q or %q", nameMode, k8s.EndpointsModeEndpoints, k8s.EndpointsModeBoth)
+	}
 
-	c := k8s.NewController(log, gimbalKubeClient, kubeInformerFactory, backendName, numProcessThreads, discovererMetrics)
+	if namespaceTemplate != "" && (namespacePrefix != "" || namespaceSuffix != "") {
+		log.Fatalf("`namespace-template` and `namespace-prefix`/`namespace-suffix` args are mutually exclusive!")
+	}
+	if namespaceTemplate == "" {
+		namespaceTemplate = namespacePrefix + k8s.DefaultNamespaceTemplate + namespaceSuffix
+	}
+	namespaceMappings, err := parseMappings(namespaceMap)
+	if err != nil {
+		log.Fatal("Could not parse namespace map! ", err)
+	}
+	namespaceMapper, err := k8s.NewNamespaceMapper(namespaceMappings, namespaceTemplate)
 	if err != nil {
-		log.Fatal("Could not init Controller! ", err)
+		log.Fatal("Could not init namespace mapper! ", err)
 	}
 
+	rewrites, err := parseMappings(annotationRewrites)
+	if err != nil {
+		log.Fatal("Could not parse annotation rewrites! ", err)
+	}
+	policy, err := translator.NewPolicy(splitList(annotationAllow), splitList(annotationDeny), rewrites)
+	if err != nil {
+		log.Fatal("Could not init annotation policy! ", err)
+	}
+
+	if backendWeight != "" {
+		if _, err := translator.ParseWeight(backendWeight); err != nil {
+			log.Fatal(err)
+		}
+	}
+	weights, err := parseMappings(backendWeights)
+	if err != nil {
+		log.Fatal("Could not parse backend weights! ", err)
+	}
+	for backend, w := range weights {
+		if _, err := translator.ParseWeight(w); err != nil {
+			log.Fatalf("Invalid weight of backend %s: %v", backend, err)
+		}
+	}
+
+	options := k8s.Options{
+		NamespaceFilter:     namespaceFilter,
+		DiscoveryMode:       mode,
+		NamespaceMapper:     namespaceMapper,
+		ReconcilePeriod:     reconciliationPeriod,
+		EndpointsMode:       epMode,
+		AddressMode:         defaultAddressMode,
+		BackendAddressModes: addressModes,
+		ExternalNameMode:    nameMode,
+		Policy:              policy,
+		Topology:            topology,
+		Weight:              backendWeight,
+		BackendWeights:      weights,
+
+		EndpointsDebounce:         debounceWindow,
+		EndpointsDebounceMaxDelay: debounceMaxDelay,
+	}
+	if leaderElect {
+		options.LeaderElection = leaderElectionConfig(gimbalKubeClient, log)
+	}
+
+	syncqueue := sync.NewQueue(log, gimbalKubeClient, numProcessThreads, discovererMetrics)
+	manager := k8s.NewBackendManager(log, syncqueue, resyncInterval, options, discovererMetrics)
+
 	// set up signals so we handle the first shutdown signal gracefully
 	stopCh := signals.SetupSignalHandler()
 
-	go kubeInformerFactory.Start(stopCh)
+	if discovererKubeCfgDir != "" {
+		log.Infof("Watching kubecfg directory %s, sync period is: %v", discovererKubeCfgDir, kubeCfgDirSyncPeriod)
+		go manager.WatchDir(discovererKubeCfgDir, kubeCfgDirSyncPeriod, stopCh)
+	} else if err := manager.Start(backendName, discovererKubeCfgFile); err != nil {
+		log.Fatal(err)
+	} else if kubeCfgSyncPeriod > 0 {
+		log.Infof("Watching kubecfg file %s, sync period is: %v", discovererKubeCfgFile, kubeCfgSyncPeriod)
+		go manager.WatchFile(backendName, discovererKubeCfgFile, kubeCfgSyncPeriod, stopCh)
+	}
 
 	go func() {
-		// Expose the registered metrics via HTTP.
+		// Expose the registered metrics and health checks via HTTP.
 		http.Handle("/metrics", promhttp.HandlerFor(discovererMetrics.Registry, promhttp.HandlerOpts{}))
+		http.Handle("/healthz", health.Handler(func() []health.Check {
+			return []health.Check{syncqueue.HealthCheck(0)}
+		}, healthCheckTimeout))
+		http.Handle("/readyz", health.Handler(func() []health.Check {
+			checks := []health.Check{
+				syncqueue.HealthCheck(readyMaxQueueLength),
+				health.APIServerCheck("gimbal/api", gimbalKubeClient),
+			}
+			return append(checks, manager.HealthChecks(readyMaxEventAge)...)
+		}, healthCheckTimeout))
 		srv := &http.Server{Addr: fmt.Sprintf(":%d", prometheusListenPort)}
-		log.Info("Listening for Prometheus metrics on port: ", prometheusListenPort)
+		log.Info("Listening for Prometheus metrics and health checks on port: ", prometheusListenPort)
 		if err := srv.ListenAndServe(); err != nil {
 			log.Fatal(err)
 		}
@@ -146,7 +343,46 @@ func main() {
 	}()
 
 	// Kick it off
-	if err = c.Run(stopCh); err != nil {
-		log.Fatalf("Error running controller: %s", err.Error())
+	syncqueue.Run(stopCh)
+}
+
+// leaderElectionConfig returns the validated leader election configuration
+func leaderElectionConfig(client kubernetes.Interface, log *logrus.Logger) *leader.Config {
+	identity, err := leader.DefaultIdentity()
+	if err != nil {
+		log.Fatal("Could not build leader election identity! ", err)
+	}
+	config := &leader.Config{
+		Client:        client,
+		Namespace:     leaderElectNamespace,
+		Identity:      identity,
+		LeaseDuration: leaderElectLease,
+		RenewDeadline: leaderElectRenew,
+		RetryPeriod:   leaderElectRetry,
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatal("Invalid leader election configuration! ", err)
+	}
+	log.Infof("Leader election enabled in namespace %s as %s", config.Namespace, config.Identity)
+	return config
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// parseMappings parses a comma-separated list of key=value pairs
+func parseMappings(list string) (map[string]string, error) {
+	mappings := map[string]string{}
+	for _, m := range splitList(list) {
+		kv := strings.SplitN(m, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid mapping %q, must be of the form key=value", m)
+		}
+		mappings[kv[0]] = kv[1]
 	}
+	return mappings, nil
 }
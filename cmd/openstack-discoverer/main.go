@@ -28,11 +28,12 @@ import (
 	"github.com/projectcontour/gimbal/pkg/buildinfo"
 	"github.com/projectcontour/gimbal/pkg/openstack"
 
-	"github.com/gophercloud/gophercloud"
 	gopheropenstack "github.com/gophercloud/gophercloud/openstack"
 	"github.com/projectcontour/gimbal/pkg/k8s"
+	"github.com/projectcontour/gimbal/pkg/leader"
 	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
 	"github.com/projectcontour/gimbal/pkg/signals"
+	"github.com/projectcontour/gimbal/pkg/translator"
 	"github.com/projectcontour/gimbal/pkg/util"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
@@ -53,6 +54,21 @@ var (
 	gimbalKubeClientQPS               float64
 	gimbalKubeClientBurst             int
 	openstackProjectWatchlist         string
+	openstackProjectExclude           string
+	openstackProjectWatchlistFile     string
+	credentialsSyncPeriod             time.Duration
+	leaderElect                       bool
+	leaderElectNamespace              string
+	leaderElectLease                  time.Duration
+	leaderElectRenew                  time.Duration
+	leaderElectRetry                  time.Duration
+	topology                          bool
+	backendWeight                     string
+	loadBalancerAPI                   string
+	projectWorkers                    int
+	projectTimeout                    time.Duration
+	openstackCloud                    string
+	unhealthyMembers                  string
 )
 
 var reconciler openstack.Reconciler
@@ -74,7 +90,22 @@ func init() {
 	flag.IntVar(&prometheusListenPort, "prometheus-listen-address", 8080, "The address to listen on for Prometheus HTTP requests")
 	flag.Float64Var(&gimbalKubeClientQPS, "gimbal-client-qps", 5, "The maximum queries per second (QPS) that can be performed on the Gimbal Kubernetes API server")
 	flag.IntVar(&gimbalKubeClientBurst, "gimbal-client-burst", 10, "The maximum number of queries that can be performed on the Gimbal Kubernetes API server during a burst")
-	flag.StringVar(&openstackProjectWatchlist, "openstack-project-watchlist", "", "List of projects to be watched for reconciliation. If empty, load balancers across all projects will be reconciled.")
+	flag.StringVar(&openstackProjectWatchlist, "openstack-project-watchlist", "", "Comma-separated list of selectors of the projects to be watched for reconciliation, by name or with an id:, name:, regex:, tag: or domain: prefix. If empty, load balancers across all projects will be reconciled.")
+	flag.StringVar(&openstackProjectExclude, "openstack-project-exclude", "", "Comma-separated list of selectors of the projects that are not reconciled, even if they match the watchlist")
+	flag.StringVar(&openstackProjectWatchlistFile, "openstack-project-watchlist-file", "", "YAML file with the watchlist and exclude selectors, read again when it changes. Cannot be used with --openstack-project-watchlist or --openstack-project-exclude")
+	flag.DurationVar(&credentialsSyncPeriod, "credentials-sync-period", 30*time.Second, "The interval of time between checks of the OS_USERNAME_FILE and OS_PASSWORD_FILE files for changes. If zero, the files are only read on startup")
+	flag.BoolVar(&leaderElect, "leader-elect", false, "Elect a leader among the replicas of the discoverer, so that only the leader writes to Gimbal")
+	flag.StringVar(&leaderElectNamespace, "leader-elect-namespace", leader.DefaultNamespace(), "Namespace of the leader election lease in the Gimbal cluster, defaults to the namespace of the pod")
+	flag.DurationVar(&leaderElectLease, "leader-elect-lease-duration", leader.DefaultLeaseDuration, "The duration that standby replicas wait before taking over a lease that is not renewed")
+	flag.DurationVar(&leaderElectRenew, "leader-elect-renew-deadline", leader.DefaultRenewDeadline, "The duration that the leader retries renewing its lease before giving up leadership")
+	flag.DurationVar(&leaderElectRetry, "leader-elect-retry-period", leader.DefaultRetryPeriod, "The duration between attempts to acquire or renew a lease")
+	flag.BoolVar(&topology, "topology", false, "Record the availability zones of the servers of load balancer members, and the OS_REGION_NAME region, in the labels and annotations of the Gimbal services. Requires listing the servers of all projects")
+	flag.StringVar(&backendWeight, "backend-weight", "", "Weight of the services of the backend, recorded in their gimbal.projectcontour.io/weight annotation. If empty, services have no weight")
+	flag.StringVar(&loadBalancerAPI, "openstack-load-balancer-api", string(openstack.LoadBalancerAPIAuto), "Whether load balancers are listed from the Octavia load-balancer API (octavia), the LBaaS v2 extension of the Neutron network API (neutron), or from Octavia if the service catalog has a load-balancer endpoint and Neutron otherwise (auto)")
+	flag.IntVar(&projectWorkers, "project-workers", 4, "The number of projects that are reconciled in parallel")
+	flag.DurationVar(&projectTimeout, "project-timeout", time.Minute, "The maximum time spent reconciling a project. If zero, projects do not time out")
+	flag.StringVar(&unhealthyMembers, "unhealthy-members", string(openstack.UnhealthyMemberNotReady), "Whether the addresses of disabled or unhealthy load balancer members are written to the not ready addresses of the endpoints (not-ready), or left out of the endpoints (drop)")
+	flag.StringVar(&openstackCloud, "openstack-cloud", "", "Name of the cloud of the clouds.yaml file to authenticate with, defaults to OS_CLOUD. If empty, authentication is configured with OS_* environment variables")
 	flag.Parse()
 }
 
@@ -98,8 +129,11 @@ func main() {
 	log.Infof("Backend name: %s", backendName)
 	log.Infof("Number of queue worker threads: %d", numProcessThreads)
 	log.Infof("Reconciliation period: %v", reconciliationPeriod)
+	log.Infof("Project workers: %d, timeout: %v", projectWorkers, projectTimeout)
 	log.Infof("Gimbal kubernetes client QPS: %v", gimbalKubeClientQPS)
 	log.Infof("Gimbal kubernetes client burst: %d", gimbalKubeClientBurst)
+	log.Infof("Backend weight: %q", backendWeight)
+	log.Infof("Unhealthy members: %s", unhealthyMembers)
 
 	// Init prometheus metrics
 	discovererMetrics = localmetrics.NewMetrics("openstack", backendName)
@@ -123,30 +157,51 @@ func main() {
 		log.Fatal("Failed to create kubernetes client", err)
 	}
 
-	username := os.Getenv("OS_USERNAME")
-	if username == "" {
-		log.Fatal("The OpenStack username must be provided using the OS_USERNAME environment variable.")
+	if openstackCloud == "" {
+		openstackCloud = os.Getenv("OS_CLOUD")
 	}
-	password := os.Getenv("OS_PASSWORD")
-	if password == "" {
-		log.Fatal("The OpenStack password must be provided using the OS_PASSWORD environment variable.")
+	var authConfig openstack.AuthConfig
+	if openstackCloud != "" {
+		cloudsFile, err := openstack.FindCloudsFile(os.Getenv)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Reading OpenStack cloud %q from %s", openstackCloud, cloudsFile)
+		authConfig, err = openstack.AuthConfigFromCloudsFile(cloudsFile, openstackCloud)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		authConfig, err = openstack.AuthConfigFromEnv(os.Getenv)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	identityEndpoint := os.Getenv("OS_AUTH_URL")
-	if identityEndpoint == "" {
-		log.Fatal("The OpenStack Authentication URL must be provided using the OS_AUTH_URL environment variable.")
+	log.Infof("OpenStack authentication method: %s", authConfig.Method)
+
+	credentialsFiles := openstack.CredentialsFiles{UsernameFile: os.Getenv("OS_USERNAME_FILE"), PasswordFile: os.Getenv("OS_PASSWORD_FILE")}
+	watchCredentials := credentialsFiles.UsernameFile != "" || credentialsFiles.PasswordFile != ""
+	if watchCredentials {
+		if authConfig.Method != openstack.AuthMethodPassword {
+			log.Fatalf("The OS_USERNAME_FILE and OS_PASSWORD_FILE environment variables are only supported with password authentication, not %s authentication.", authConfig.Method)
+		}
+		if credentialsFiles.UsernameFile == "" || credentialsFiles.PasswordFile == "" {
+			log.Fatal("The OS_USERNAME_FILE and OS_PASSWORD_FILE environment variables must be set together.")
+		}
+		if authConfig.Credentials, err = credentialsFiles.Read(); err != nil {
+			log.Fatalf("Failed to read OpenStack credentials: %v", err)
+		}
 	}
-	tenantName := os.Getenv("OS_TENANT_NAME")
-	if tenantName == "" {
-		log.Fatal("The OpenStack tenant name must be provided using the OS_TENANT_NAME environment variable")
+	if authConfig.Method == openstack.AuthMethodPassword && authConfig.UserDomainID == "" && authConfig.UserDomainName == "" {
+		log.Warnf("The OpenStack user domain was not set. Using %q as the OpenStack user domain name.", defaultUserDomainName)
+		authConfig.UserDomainName = defaultUserDomainName
 	}
-	userDomainName := os.Getenv("OS_USER_DOMAIN_NAME")
-	if userDomainName == "" {
-		log.Warnf("The OS_USER_DOMAIN_NAME environment variable was not set. Using %q as the OpenStack user domain name.", defaultUserDomainName)
-		userDomainName = defaultUserDomainName
+	if err := authConfig.Validate(); err != nil {
+		log.Fatalf("Invalid OpenStack authentication configuration: %v", err)
 	}
 
 	// Create and configure client
-	osClient, err := gopheropenstack.NewClient(identityEndpoint)
+	osClient, err := gopheropenstack.NewClient(authConfig.AuthURL)
 	if err != nil {
 		log.Fatalf("Failed to create OpenStack client: %v", err)
 	}
@@ -158,29 +213,37 @@ func main() {
 		Metrics:      &discovererMetrics,
 	}
 
+	if openstackCertificateAuthorityFile == "" {
+		openstackCertificateAuthorityFile = authConfig.CACertFile
+	}
 	if openstackCertificateAuthorityFile != "" {
 		transport.RoundTripper = httpTransportWithCA(log, openstackCertificateAuthorityFile)
 	}
 
-	if openstackProjectWatchlist == "" {
+	var watchlist openstack.ProjectWatchlist
+	if openstackProjectWatchlistFile != "" {
+		if openstackProjectWatchlist != "" || openstackProjectExclude != "" {
+			log.Fatal("The --openstack-project-watchlist-file flag cannot be used with --openstack-project-watchlist or --openstack-project-exclude")
+		}
+		watchlist, err = openstack.ReadProjectWatchlistFile(openstackProjectWatchlistFile)
+	} else {
+		watchlist, err = openstack.ParseProjectWatchlist(openstackProjectWatchlist, openstackProjectExclude)
+	}
+	if err != nil {
+		log.Fatalf("Invalid OpenStack project watchlist: %v", err)
+	}
+	if len(watchlist.Watchlist) == 0 && openstackProjectWatchlistFile == "" {
 		log.Infof("The OpenStack Watchlist is empty. Syncing all load balancers on the OpenStack cluster.")
 	}
+	log.Infof("OpenStack project watchlist: %s", watchlist)
 
 	osClient.HTTPClient = http.Client{
 		Transport: transport,
 		Timeout:   httpClientTimeout,
 	}
 
-	osAuthOptions := gophercloud.AuthOptions{
-		IdentityEndpoint: identityEndpoint,
-		Username:         username,
-		Password:         password,
-		DomainName:       userDomainName,
-		TenantName:       tenantName,
-		AllowReauth:      true,
-	}
-
-	if err := gopheropenstack.Authenticate(osClient, osAuthOptions); err != nil {
+	authenticator := openstack.NewAuthenticator(osClient, authConfig.AuthOptions())
+	if err := authenticator.Authenticate(authConfig.Credentials); err != nil {
 		log.Fatalf("Failed to authenticate with OpenStack: %v", err)
 	}
 
@@ -189,24 +252,73 @@ func main() {
 		log.Fatalf("Failed to create Identity V3 API client: %v", err)
 	}
 
-	lbv2, err := openstack.NewLoadBalancerV2(osClient)
+	lbAPI, err := openstack.ParseLoadBalancerAPI(loadBalancerAPI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	lbLister, lbAPI, err := openstack.NewLoadBalancerLister(osClient, lbAPI)
 	if err != nil {
-		log.Fatalf("Failed to create Network V2 API client: %v", err)
+		log.Fatal(err)
 	}
+	log.Infof("Load balancer API: %s", lbAPI)
 
 	reconciler = openstack.NewReconciler(
 		backendName,
-		openstackProjectWatchlist,
+		watchlist,
 		gimbalKubeClient,
 		reconciliationPeriod,
-		lbv2,
+		lbLister,
 		identity,
 		log,
 		numProcessThreads,
 		discovererMetrics,
 	)
+	reconciler.WatchlistFile = openstackProjectWatchlistFile
+	if reconciler.UnhealthyMembers, err = openstack.ParseUnhealthyMemberPolicy(unhealthyMembers); err != nil {
+		log.Fatal(err)
+	}
+	reconciler.Workers = projectWorkers
+	reconciler.ProjectTimeout = projectTimeout
+	if backendWeight != "" {
+		if _, err := translator.ParseWeight(backendWeight); err != nil {
+			log.Fatal(err)
+		}
+		reconciler.Weight = backendWeight
+	}
+	if topology {
+		compute, err := openstack.NewComputeV2(osClient)
+		if err != nil {
+			log.Fatalf("Failed to create Compute V2 API client: %v", err)
+		}
+		reconciler.ServerLister = compute
+		reconciler.Region = authConfig.RegionName
+	}
+	if leaderElect {
+		identity, err := leader.DefaultIdentity()
+		if err != nil {
+			log.Fatalf("Failed to build leader election identity: %v", err)
+		}
+		config := leader.Config{
+			Client:        gimbalKubeClient,
+			Namespace:     leaderElectNamespace,
+			Identity:      identity,
+			LeaseDuration: leaderElectLease,
+			RenewDeadline: leaderElectRenew,
+			RetryPeriod:   leaderElectRetry,
+		}
+		if err := config.Validate(); err != nil {
+			log.Fatalf("Invalid leader election configuration: %v", err)
+		}
+		log.Infof("Leader election enabled in namespace %s as %s", config.Namespace, config.Identity)
+		reconciler.Elector = leader.NewElector(config, backendName, log, discovererMetrics)
+	}
 	stopCh := signals.SetupSignalHandler()
 
+	if watchCredentials && credentialsSyncPeriod > 0 {
+		log.Infof("Watching OpenStack credentials files, sync period is: %v", credentialsSyncPeriod)
+		go openstack.WatchCredentials(authenticator, credentialsFiles, credentialsSyncPeriod, log, discovererMetrics, stopCh)
+	}
+
 	go func() {
 		// Expose the registered metrics via HTTP.
 		http.Handle("/metrics", promhttp.HandlerFor(discovererMetrics.Registry, promhttp.HandlerOpts{}))
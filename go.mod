@@ -18,4 +18,5 @@ require (
 	k8s.io/apimachinery v0.18.2
 	k8s.io/client-go v0.18.2
 	mvdan.cc/unparam v0.0.0-20200501210554-b37ab49443f7 // indirect
+	sigs.k8s.io/yaml v1.2.0
 )
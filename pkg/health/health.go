@@ -0,0 +1,115 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package health reports the health of the discoverers over HTTP
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	statusOK     = "ok"
+	statusFailed = "failed"
+)
+
+// Check checks the health of one part of a discoverer. Run returns a human
+// readable detail of the state of the part, and an error if it is unhealthy.
+type Check struct {
+	Name string
+	Run  func() (string, error)
+}
+
+// Result is the result of a Check
+type Result struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the result of a set of checks. Its status is failed if any of
+// the checks failed.
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+// Run runs the checks concurrently and reports their results, in the order of
+// the checks. A check that does not return within the timeout fails.
+func Run(checks []Check, timeout time.Duration) Report {
+	report := Report{Status: statusOK, Checks: make([]Result, len(checks))}
+	done := make([]chan Result, len(checks))
+	for i, check := range checks {
+		done[i] = make(chan Result, 1)
+		go func(check Check, done chan<- Result) {
+			detail, err := check.Run()
+			result := Result{Name: check.Name, Status: statusOK, Detail: detail}
+			if err != nil {
+				result.Status = statusFailed
+				result.Error = err.Error()
+			}
+			done <- result
+		}(check, done[i])
+	}
+
+	deadline := time.After(timeout)
+	for i, check := range checks {
+		select {
+		case report.Checks[i] = <-done[i]:
+		case <-deadline:
+			report.Checks[i] = Result{Name: check.Name, Status: statusFailed, Error: fmt.Sprintf("timed out after %v", timeout)}
+		}
+		if report.Checks[i].Status != statusOK {
+			report.Status = statusFailed
+		}
+	}
+	return report
+}
+
+// Handler returns a handler that runs the checks on every request, and
+// responds with the JSON report of their results. The response status is 200
+// if all checks pass, and 503 otherwise. The checks are built on every request
+// so that they can follow the parts of the discoverer that come and go.
+func Handler(checks func() []Check, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := Run(checks(), timeout)
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != statusOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// APIServerCheck returns a check that the Kubernetes API server of the given
+// client is reachable.
+func APIServerCheck(name string, client kubernetes.Interface) Check {
+	return Check{
+		Name: name,
+		Run: func() (string, error) {
+			version, err := client.Discovery().ServerVersion()
+			if err != nil {
+				return "", fmt.Errorf("API server is unreachable: %v", err)
+			}
+			return "server version " + version.GitVersion, nil
+		},
+	}
+}
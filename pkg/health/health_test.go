@@ -0,0 +1,117 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func okCheck(name string) Check {
+	return Check{Name: name, Run: func() (string, error) { return name + " is fine", nil }}
+}
+
+func failedCheck(name string) Check {
+	return Check{Name: name, Run: func() (string, error) { return "", fmt.Errorf("%s is broken", name) }}
+}
+
+func TestRun(t *testing.T) {
+	blocked := make(chan struct{})
+	defer close(blocked)
+
+	tests := []struct {
+		name     string
+		checks   []Check
+		expected Report
+	}{
+		{
+			name:     "no checks",
+			expected: Report{Status: "ok", Checks: []Result{}},
+		},
+		{
+			name:   "all ok",
+			checks: []Check{okCheck("a"), okCheck("b")},
+			expected: Report{Status: "ok", Checks: []Result{
+				{Name: "a", Status: "ok", Detail: "a is fine"},
+				{Name: "b", Status: "ok", Detail: "b is fine"},
+			}},
+		},
+		{
+			name:   "one failed",
+			checks: []Check{okCheck("a"), failedCheck("b")},
+			expected: Report{Status: "failed", Checks: []Result{
+				{Name: "a", Status: "ok", Detail: "a is fine"},
+				{Name: "b", Status: "failed", Error: "b is broken"},
+			}},
+		},
+		{
+			name: "timed out",
+			checks: []Check{
+				{Name: "a", Run: func() (string, error) { <-blocked; return "", nil }},
+				okCheck("b"),
+			},
+			expected: Report{Status: "failed", Checks: []Result{
+				{Name: "a", Status: "failed", Error: "timed out after 50ms"},
+				{Name: "b", Status: "ok", Detail: "b is fine"},
+			}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, Run(tc.checks, 50*time.Millisecond))
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		checks     []Check
+		statusCode int
+		status     string
+	}{
+		{name: "ok", checks: []Check{okCheck("a")}, statusCode: http.StatusOK, status: "ok"},
+		{name: "failed", checks: []Check{okCheck("a"), failedCheck("b")}, statusCode: http.StatusServiceUnavailable, status: "failed"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			Handler(func() []Check { return tc.checks }, time.Second).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+			assert.Equal(t, tc.statusCode, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			var report Report
+			if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tc.status, report.Status)
+			assert.Len(t, report.Checks, len(tc.checks))
+		})
+	}
+}
+
+func TestAPIServerCheck(t *testing.T) {
+	detail, err := APIServerCheck("gimbal/api", fake.NewSimpleClientset()).Run()
+	assert.NoError(t, err)
+	assert.Contains(t, detail, "server version")
+}
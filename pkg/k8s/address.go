@@ -0,0 +1,271 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/projectcontour/gimbal/pkg/sync"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// AddressMode determines the addresses of the endpoints replicated to Gimbal.
+type AddressMode string
+
+const (
+	// AddressModePod replicates the pod addresses of the remote endpoints,
+	// which requires the Gimbal Envoys to route to the remote pod network.
+	AddressModePod AddressMode = "pod"
+	// AddressModeNodePort builds the endpoints of a service from the
+	// addresses of the remote nodes and the node ports of the service.
+	AddressModeNodePort AddressMode = "nodeport"
+	// AddressModeLoadBalancer builds the endpoints of a service from the
+	// ingress addresses of its load balancer and the ports of the service.
+	AddressModeLoadBalancer AddressMode = "loadbalancer"
+)
+
+// ParseAddressMode returns the AddressMode with the given name.
+func ParseAddressMode(mode string) (AddressMode, error) {
+	switch AddressMode(mode) {
+	case AddressModePod, AddressModeNodePort, AddressModeLoadBalancer:
+		return AddressMode(mode), nil
+	}
+	return "", fmt.Errorf("invalid address mode %q, must be one of %q, %q or %q", mode,
+		AddressModePod, AddressModeNodePort, AddressModeLoadBalancer)
+}
+
+// pod returns true if pod addresses are replicated. This is the default.
+func (m AddressMode) pod() bool {
+	return m == AddressModePod || m == ""
+}
+
+// addressMode returns the address mode of the backend with the given name.
+func (o Options) addressMode(backendName string) AddressMode {
+	if mode, ok := o.BackendAddressModes[backendName]; ok {
+		return mode
+	}
+	if o.AddressMode == "" {
+		return AddressModePod
+	}
+	return o.AddressMode
+}
+
+// serviceSubsets returns the subsets of the Gimbal endpoints of the remote
+// endpoints, according to the address mode. Unless pod addresses are
+// replicated, they are built from the service of the endpoints, and are empty
+// if the service is not in the cache, or if the remote endpoints have no ready
+// address, so that Gimbal does not route to a service without backends. The
+// endpoints of selector-less services are always replicated as they are,
+// given that they are managed by hand and usually not pods.
+func (c *Controller) serviceSubsets(endpoints *v1.Endpoints) []v1.EndpointSubset {
+	if c.addressMode.pod() {
+		return endpoints.Subsets
+	}
+	svc, err := c.serviceLister.Services(endpoints.GetNamespace()).Get(endpoints.GetName())
+	if err != nil {
+		return nil
+	}
+	if isSelectorless(svc) {
+		return endpoints.Subsets
+	}
+	if !hasReadyAddresses(endpoints) {
+		return nil
+	}
+	if c.addressMode == AddressModeLoadBalancer {
+		return loadBalancerSubsets(svc)
+	}
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		c.Logger.Errorf("Could not list nodes of backend %s: %v", c.backendName, err)
+		return nil
+	}
+	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+		nodes = endpointsNodes(nodes, endpoints)
+	}
+	return nodePortSubsets(svc, nodes)
+}
+
+// hasReadyAddresses returns true if the endpoints have at least one ready
+// address.
+func hasReadyAddresses(endpoints *v1.Endpoints) bool {
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// nodePortSubsets returns the subsets that reach the service through its node
+// ports on the given nodes. Nodes that are not ready are left out.
+func nodePortSubsets(svc *v1.Service, nodes []*v1.Node) []v1.EndpointSubset {
+	var ports []v1.EndpointPort
+	for _, p := range svc.Spec.Ports {
+		if p.NodePort != 0 {
+			ports = append(ports, v1.EndpointPort{Name: p.Name, Port: p.NodePort, Protocol: p.Protocol})
+		}
+	}
+	var addresses []v1.EndpointAddress
+	for _, node := range nodes {
+		ip := nodeAddress(node)
+		if ip == "" || !nodeReady(node) {
+			continue
+		}
+		nodeName := node.GetName()
+		addresses = append(addresses, v1.EndpointAddress{IP: ip, NodeName: &nodeName})
+	}
+	return buildSubsets(addresses, ports)
+}
+
+// loadBalancerSubsets returns the subsets that reach the service through the
+// ingress IPs of its load balancer. Ingress points that only have a hostname
+// are left out, endpoints must be IP addresses.
+func loadBalancerSubsets(svc *v1.Service) []v1.EndpointSubset {
+	var ports []v1.EndpointPort
+	for _, p := range svc.Spec.Ports {
+		ports = append(ports, v1.EndpointPort{Name: p.Name, Port: p.Port, Protocol: p.Protocol})
+	}
+	var addresses []v1.EndpointAddress
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			addresses = append(addresses, v1.EndpointAddress{IP: ingress.IP})
+		}
+	}
+	return buildSubsets(addresses, ports)
+}
+
+// buildSubsets returns a single subset of the addresses and ports. Addresses
+// are sorted so that the subset does not change with the order of the nodes
+// in the cache.
+func buildSubsets(addresses []v1.EndpointAddress, ports []v1.EndpointPort) []v1.EndpointSubset {
+	if len(addresses) == 0 || len(ports) == 0 {
+		return nil
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i].IP < addresses[j].IP })
+	return []v1.EndpointSubset{{Addresses: addresses, Ports: ports}}
+}
+
+// endpointsNodes returns the nodes that host a ready address of the endpoints.
+// Services with a Local external traffic policy are only reachable through
+// the node ports of these nodes.
+func endpointsNodes(nodes []*v1.Node, endpoints *v1.Endpoints) []*v1.Node {
+	names := map[string]bool{}
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			if address.NodeName != nil {
+				names[*address.NodeName] = true
+			}
+		}
+	}
+	var local []*v1.Node
+	for _, node := range nodes {
+		if names[node.GetName()] {
+			local = append(local, node)
+		}
+	}
+	return local
+}
+
+// nodeAddress returns the internal IP of the node, or its external IP if it
+// has no internal one.
+func nodeAddress(node *v1.Node) string {
+	var external string
+	for _, address := range node.Status.Addresses {
+		switch address.Type {
+		case v1.NodeInternalIP:
+			return address.Address
+		case v1.NodeExternalIP:
+			if external == "" {
+				external = address.Address
+			}
+		}
+	}
+	return external
+}
+
+func nodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// nodeChanged returns true if a node update changes the endpoints built from
+// it. Nodes are updated on every heartbeat, which must not resync every
+// service.
+func nodeChanged(old, new *v1.Node) bool {
+	return nodeAddress(old) != nodeAddress(new) || nodeReady(old) != nodeReady(new)
+}
+
+// servicePortTarget returns the target port of the Gimbal service port of the
+// remote service port, which is the port its endpoints listen on. Pod
+// addresses listen on the target port of the remote service, which may be the
+// name of a container port.
+func servicePortTarget(port v1.ServicePort, mode AddressMode) intstr.IntOrString {
+	switch mode {
+	case AddressModeNodePort:
+		return intstr.FromInt(int(port.NodePort))
+	case AddressModeLoadBalancer:
+		return intstr.FromInt(int(port.Port))
+	}
+	return port.TargetPort
+}
+
+// refreshNodePortServices updates the endpoints of all the services that are
+// reached through node ports, when the nodes change. Node events received
+// while the caches sync are ignored, the endpoints are built once the caches
+// are synced.
+func (c *Controller) refreshNodePortServices() {
+	if !c.nodesSynced() || !c.servicesSynced() {
+		return
+	}
+	services, err := c.serviceLister.List(labels.Everything())
+	if err != nil {
+		c.Logger.Errorf("Could not list services of backend %s: %v", c.backendName, err)
+		return
+	}
+	for _, svc := range services {
+		if hasNodePorts(svc) && !isSelectorless(svc) && !c.skipProcessing(svc.GetName(), svc.GetNamespace(), svc.ObjectMeta.Labels) &&
+			c.discoverService(svc.GetAnnotations(), c.endpointsAnnotations(svc.GetNamespace(), svc.GetName())) {
+			c.refreshServiceEndpoints(svc.GetNamespace(), svc.GetName())
+		}
+	}
+}
+
+// refreshServiceEndpoints updates the endpoints of a service when they are
+// built from the service rather than copied from the remote endpoints.
+func (c *Controller) refreshServiceEndpoints(namespace, name string) {
+	if c.addressMode.pod() || c.endpointsLister == nil {
+		return
+	}
+	endpoints, err := c.endpointsLister.Endpoints(namespace).Get(name)
+	if err != nil {
+		return
+	}
+	c.enqueue(sync.UpdateEndpointsAction(c.gimbalEndpoints(endpoints), endpoints.GetName()))
+}
+
+func hasNodePorts(svc *v1.Service) bool {
+	for _, p := range svc.Spec.Ports {
+		if p.NodePort != 0 {
+			return true
+		}
+	}
+	return false
+}
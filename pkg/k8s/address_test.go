@@ -0,0 +1,215 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"testing"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testNode(name, ip string, ready bool) *v1.Node {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeExternalIP, Address: "203.0.113.1"}, {Type: v1.NodeInternalIP, Address: ip}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}},
+		},
+	}
+}
+
+func TestNodePortSubsets(t *testing.T) {
+	node1, node2, node3 := "node1", "node2", "node3"
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeNodePort,
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP},
+				{Name: "https", Port: 443, NodePort: 30443, Protocol: v1.ProtocolTCP},
+			},
+		},
+	}
+	nodes := []*v1.Node{
+		testNode(node2, "10.0.0.2", true),
+		testNode(node1, "10.0.0.1", true),
+		testNode(node3, "10.0.0.3", false),
+	}
+
+	expected := []v1.EndpointSubset{{
+		Addresses: []v1.EndpointAddress{{IP: "10.0.0.1", NodeName: &node1}, {IP: "10.0.0.2", NodeName: &node2}},
+		Ports: []v1.EndpointPort{
+			{Name: "http", Port: 30080, Protocol: v1.ProtocolTCP},
+			{Name: "https", Port: 30443, Protocol: v1.ProtocolTCP},
+		},
+	}}
+	assert.Equal(t, expected, nodePortSubsets(svc, nodes))
+
+	// Services with a local traffic policy are only reached through the nodes of their pods
+	endpoints := &v1.Endpoints{Subsets: []v1.EndpointSubset{{Addresses: []v1.EndpointAddress{{IP: "192.168.0.1", NodeName: &node2}}}}}
+	expected[0].Addresses = []v1.EndpointAddress{{IP: "10.0.0.2", NodeName: &node2}}
+	assert.Equal(t, expected, nodePortSubsets(svc, endpointsNodes(nodes, endpoints)))
+
+	// Services without node ports have no endpoints
+	assert.Nil(t, nodePortSubsets(&v1.Service{Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}}}, nodes))
+}
+
+func TestLoadBalancerSubsets(t *testing.T) {
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Name: "http", Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP}},
+		},
+		Status: v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{
+			Ingress: []v1.LoadBalancerIngress{{IP: "198.51.100.2"}, {Hostname: "lb.example.com"}, {IP: "198.51.100.1"}},
+		}},
+	}
+	expected := []v1.EndpointSubset{{
+		Addresses: []v1.EndpointAddress{{IP: "198.51.100.1"}, {IP: "198.51.100.2"}},
+		Ports:     []v1.EndpointPort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+	}}
+	assert.Equal(t, expected, loadBalancerSubsets(svc))
+
+	// Load balancers that are not provisioned yet have no endpoints
+	svc.Status = v1.ServiceStatus{}
+	assert.Nil(t, loadBalancerSubsets(svc))
+}
+
+func TestNodeChanged(t *testing.T) {
+	node := testNode("node1", "10.0.0.1", true)
+	heartbeat := node.DeepCopy()
+	heartbeat.Status.Conditions[0].LastHeartbeatTime = metav1.Now()
+	assert.False(t, nodeChanged(node, heartbeat))
+	assert.True(t, nodeChanged(node, testNode("node1", "10.0.0.1", false)))
+	assert.True(t, nodeChanged(node, testNode("node1", "10.0.0.2", true)))
+}
+
+func TestOptionsAddressMode(t *testing.T) {
+	options := Options{BackendAddressModes: map[string]AddressMode{"cluster2": AddressModeLoadBalancer}}
+	assert.Equal(t, AddressModePod, options.addressMode("cluster1"))
+	assert.Equal(t, AddressModeLoadBalancer, options.addressMode("cluster2"))
+
+	options.AddressMode = AddressModeNodePort
+	assert.Equal(t, AddressModeNodePort, options.addressMode("cluster1"))
+	assert.Equal(t, AddressModeLoadBalancer, options.addressMode("cluster2"))
+}
+
+func TestNodePortAddressMode(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceTypeNodePort,
+			Ports:    []v1.ServicePort{{Name: "http", Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP}},
+			Selector: map[string]string{"app": "test"},
+		},
+	}
+	ep := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "192.168.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+		}},
+	}
+	node := testNode("node1", "10.0.0.1", true)
+
+	metrics := localmetrics.NewMetrics("backendtype", "backend")
+	client := fake.NewSimpleClientset()
+	informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+	c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "backend", metrics,
+		Options{AddressMode: AddressModeNodePort})
+	if err := informer.Core().V1().Services().Informer().GetIndexer().Add(svc); err != nil {
+		t.Fatal(err)
+	}
+	if err := informer.Core().V1().Nodes().Informer().GetIndexer().Add(node); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []v1.EndpointPort{{Name: "http", Port: 30080, Protocol: v1.ProtocolTCP}}, c.gimbalEndpoints(ep).Subsets[0].Ports)
+	assert.Equal(t, "10.0.0.1", c.gimbalEndpoints(ep).Subsets[0].Addresses[0].IP)
+	assert.Equal(t, intstr.FromInt(30080), c.gimbalService(svc).Spec.Ports[0].TargetPort)
+
+	// Adding the service refreshes its endpoints, which are built from it
+	if err := informer.Core().V1().Endpoints().Informer().GetIndexer().Add(ep); err != nil {
+		t.Fatal(err)
+	}
+	c.addService(svc)
+	assert.Equal(t, []string{"add", "update"}, queuedActions(c))
+}
+
+func TestScaledToZeroService(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceTypeLoadBalancer,
+			Ports:    []v1.ServicePort{{Name: "http", Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP}},
+			Selector: map[string]string{"app": "test"},
+		},
+		Status: v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "198.51.100.1"}}}},
+	}
+	node := testNode("node1", "10.0.0.1", true)
+
+	tests := []struct {
+		name      string
+		endpoints *v1.Endpoints
+	}{
+		{
+			name:      "no subsets",
+			endpoints: &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}},
+		},
+		{
+			name: "not ready addresses",
+			endpoints: &v1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"},
+				Subsets: []v1.EndpointSubset{{
+					NotReadyAddresses: []v1.EndpointAddress{{IP: "192.168.0.1"}},
+					Ports:             []v1.EndpointPort{{Name: "http", Port: 8080}},
+				}},
+			},
+		},
+	}
+
+	for _, mode := range []AddressMode{AddressModeNodePort, AddressModeLoadBalancer} {
+		for _, tc := range tests {
+			t.Run(string(mode)+" "+tc.name, func(t *testing.T) {
+				metrics := localmetrics.NewMetrics("backendtype", "backend")
+				client := fake.NewSimpleClientset()
+				informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+				c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "backend", metrics,
+					Options{AddressMode: mode})
+				if err := informer.Core().V1().Services().Informer().GetIndexer().Add(svc); err != nil {
+					t.Fatal(err)
+				}
+				if err := informer.Core().V1().Nodes().Informer().GetIndexer().Add(node); err != nil {
+					t.Fatal(err)
+				}
+
+				// The nodes and the load balancer are not published while the
+				// service has no backends
+				assert.Nil(t, c.gimbalEndpoints(tc.endpoints).Subsets)
+			})
+		}
+	}
+}
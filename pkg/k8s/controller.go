@@ -14,27 +14,34 @@
 package k8s
 
 import (
+	"context"
 	"fmt"
+	"net"
+	gosync "sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/projectcontour/gimbal/pkg/translator"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/projectcontour/gimbal/pkg/leader"
 	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
 	"github.com/projectcontour/gimbal/pkg/sync"
 	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	kubeinformers "k8s.io/client-go/informers"
-	"k8s.io/client-go/kubernetes"
 	listers "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1beta1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
 const (
-	kubesystemNamespace = "kube-system"
-	kubesystemService   = "kubernetes"
-	clusterType         = "kubernetes"
+	kubesystemService = "kubernetes"
+	clusterType       = "kubernetes"
 )
 
 // Controller receives notifications from the Kubernetes API and translates those
@@ -48,26 +55,198 @@ type Controller struct {
 	endpointsLister listers.EndpointsLister
 	metrics         localmetrics.DiscovererMetrics
 
+	// The endpoints and endpoint slice listers are only set when they are
+	// replicated, according to the endpoints mode
+	endpointsMode        EndpointsMode
+	endpointSlicesSynced cache.InformerSynced
+	endpointSliceLister  discoverylisters.EndpointSliceLister
+
+	// nodeLister is only set when endpoints are built from node ports, or when
+	// the topology of endpoints is recorded
+	addressMode AddressMode
+	nodesSynced cache.InformerSynced
+	nodeLister  listers.NodeLister
+
+	externalNameMode ExternalNameMode
+	// resolver looks up the addresses of external names. If nil, the system
+	// resolver is used.
+	resolver func(ctx context.Context, host string) ([]net.IPAddr, error)
+	// externalNames queues the keys of the ExternalName services whose
+	// external name must be resolved by the external name workers
+	externalNames workqueue.Interface
+	// resolved holds the endpoints last resolved from the external names,
+	// by key of their remote service
+	resolvedMu gosync.Mutex
+	resolved   map[string]*v1.Endpoints
+
+	// namespaceLister is only set when namespaces are selected by label
+	namespacesSynced cache.InformerSynced
+	namespaceLister  listers.NamespaceLister
+	namespaceFilter  *NamespaceFilter
+	discoveryMode    DiscoveryMode
+	namespaceMapper  *NamespaceMapper
+	policy           *translator.Policy
+	reconcilePeriod  time.Duration
+	// shadowed records the remote namespaces that were reported as shadowed,
+	// so that each is only reported once
+	shadowed gosync.Map
+	// topology records the zones and regions of the endpoints of services.
+	// It requires the nodes of the remote cluster.
+	topology bool
+	// weight is the default weight of the services of the backend. If
+	// empty, services only have the weight of their remote annotation.
+	weight string
+	// elector is nil unless leader election is enabled, in which case only
+	// the leader writes to Gimbal
+	elector *leader.Elector
+	// debouncer delays the updates of endpoints and endpoint slices. It is
+	// nil if updates are not debounced.
+	debouncer *debouncer
+	// lastEvent is the time of the last event received from the remote
+	// cluster, in Unix nanoseconds
+	lastEvent int64
+
 	backendName string
 }
 
-// NewController returns a new NewController
-func NewController(log *logrus.Logger, gimbalKubeClient kubernetes.Interface, kubeInformerFactory kubeinformers.SharedInformerFactory,
-	backendName string, threadiness int, metrics localmetrics.DiscovererMetrics) *Controller {
+// Options configure how a Controller discovers its backend.
+type Options struct {
+	// NamespaceFilter selects the remote namespaces that are discovered. A nil
+	// filter discovers all namespaces.
+	NamespaceFilter *NamespaceFilter
+	// DiscoveryMode determines if services are discovered unless they opt
+	// out, or only if they opt in. Defaults to DiscoveryOptOut.
+	DiscoveryMode DiscoveryMode
+	// NamespaceMapper maps remote namespaces to Gimbal namespaces. A nil
+	// mapper keeps the remote namespace.
+	NamespaceMapper *NamespaceMapper
+	// ReconcilePeriod is the interval between full reconciliations of the
+	// objects replicated in Gimbal with the remote cluster. A full
+	// reconciliation always runs once the caches are synced. If zero, it
+	// does not run again.
+	ReconcilePeriod time.Duration
+	// EndpointsMode determines if Endpoints, EndpointSlices or both are
+	// replicated. Defaults to EndpointsModeEndpoints.
+	EndpointsMode EndpointsMode
+	// AddressMode determines the addresses of the replicated endpoints.
+	// Defaults to AddressModePod. Other modes only apply to Endpoints, and
+	// must not be combined with EndpointSlices.
+	AddressMode AddressMode
+	// BackendAddressModes overrides AddressMode for the backends with the
+	// given names.
+	BackendAddressModes map[string]AddressMode
+	// ExternalNameMode determines if ExternalName services are replicated
+	// as such, or with endpoints resolved from their external name. Defaults
+	// to ExternalNameModeService.
+	ExternalNameMode ExternalNameMode
+	// Policy filters and rewrites the annotations of the replicated objects.
+	// A nil policy replicates all the annotations.
+	Policy *translator.Policy
+	// LeaderElection elects the replica that writes the objects of each
+	// backend to Gimbal. Standby replicas keep their caches synced, so that
+	// they can take over at once. If nil, leader election is disabled.
+	LeaderElection *leader.Config
+	// Topology records the zones and regions of the endpoints of services in
+	// the labels and annotations of their Gimbal service. Zones and regions
+	// are read from the topology labels of the remote nodes.
+	Topology bool
+	// Weight is the default weight of the Gimbal services, unless their
+	// remote service has a weight annotation. If empty, services have no
+	// default weight.
+	Weight string
+	// BackendWeights overrides Weight for the backends with the given names.
+	BackendWeights map[string]string
+	// EndpointsDebounce is the window during which further updates of the
+	// same endpoints or endpoint slice are coalesced into the latest one
+	// before it is synced. If zero, updates are synced at once.
+	EndpointsDebounce time.Duration
+	// EndpointsDebounceMaxDelay bounds the time an update is delayed by
+	// further updates. It is raised to EndpointsDebounce if shorter.
+	EndpointsDebounceMaxDelay time.Duration
+}
+
+// weight returns the default weight of the services of the given backend
+func (o Options) weight(backendName string) string {
+	if weight, ok := o.BackendWeights[backendName]; ok {
+		return weight
+	}
+	return o.Weight
+}
+
+// NewController returns a new NewController. Actions are written to the given
+// sync queue, which may be shared with the controllers of other backends. The
+// caller is responsible for running the queue.
+func NewController(log *logrus.Logger, syncqueue sync.Queue, kubeInformerFactory kubeinformers.SharedInformerFactory,
+	backendName string, metrics localmetrics.DiscovererMetrics, options Options) *Controller {
 
 	// obtain references to shared index informers for the services types.
 	serviceInformer := kubeInformerFactory.Core().V1().Services()
-	endpointsInformer := kubeInformerFactory.Core().V1().Endpoints()
 
 	c := &Controller{
-		Logger:          log,
-		syncqueue:       sync.NewQueue(log, gimbalKubeClient, threadiness, metrics),
-		servicesSynced:  serviceInformer.Informer().HasSynced,
-		endpointsSynced: endpointsInformer.Informer().HasSynced,
-		backendName:     backendName,
-		serviceLister:   serviceInformer.Lister(),
-		endpointsLister: endpointsInformer.Lister(),
-		metrics:         metrics,
+		Logger:           log,
+		syncqueue:        syncqueue,
+		servicesSynced:   serviceInformer.Informer().HasSynced,
+		backendName:      backendName,
+		serviceLister:    serviceInformer.Lister(),
+		metrics:          metrics,
+		endpointsMode:    options.EndpointsMode,
+		addressMode:      options.addressMode(backendName),
+		externalNameMode: options.ExternalNameMode,
+		policy:           options.Policy,
+		namespaceFilter:  options.NamespaceFilter,
+		discoveryMode:    options.DiscoveryMode,
+		namespaceMapper:  options.NamespaceMapper,
+		reconcilePeriod:  options.ReconcilePeriod,
+		topology:         options.Topology,
+		weight:           options.weight(backendName),
+		externalNames:    workqueue.New(),
+		resolved:         map[string]*v1.Endpoints{},
+	}
+	if options.LeaderElection != nil {
+		c.elector = leader.NewElector(*options.LeaderElection, backendName, log, metrics)
+	}
+	c.debouncer = newDebouncer(options.EndpointsDebounce, options.EndpointsDebounceMaxDelay, c.enqueueDue, c.metrics.CoalescedUpdateMetric)
+
+	// Only watch namespaces when they must be selected by label, so that
+	// reading them is not required otherwise.
+	if c.namespaceFilter.HasSelector() {
+		namespaceInformer := kubeInformerFactory.Core().V1().Namespaces()
+		c.namespacesSynced = namespaceInformer.Informer().HasSynced
+		c.namespaceLister = namespaceInformer.Lister()
+
+		// Set up an event handler for when Namespace resources change.
+		namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				c.addNamespace(obj.(*v1.Namespace))
+			},
+			UpdateFunc: func(old, new interface{}) {
+				c.updateNamespace(old.(*v1.Namespace), new.(*v1.Namespace))
+			},
+		})
+	}
+
+	// Only watch nodes when endpoints are built from their addresses, or
+	// when the topology of endpoints is recorded.
+	if c.addressMode == AddressModeNodePort || c.topology {
+		nodeInformer := kubeInformerFactory.Core().V1().Nodes()
+		c.nodesSynced = nodeInformer.Informer().HasSynced
+		c.nodeLister = nodeInformer.Lister()
+	}
+	if c.addressMode == AddressModeNodePort {
+		// Set up an event handler for when Node resources change.
+		kubeInformerFactory.Core().V1().Nodes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				c.refreshNodePortServices()
+			},
+			UpdateFunc: func(old, new interface{}) {
+				if nodeChanged(old.(*v1.Node), new.(*v1.Node)) {
+					c.refreshNodePortServices()
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				c.refreshNodePortServices()
+			},
+		})
 	}
 
 	// Set up an event handler for when Service resources change.
@@ -76,100 +255,483 @@ func NewController(log *logrus.Logger, gimbalKubeClient kubernetes.Interface, ku
 			c.addService(obj.(*v1.Service))
 		},
 		UpdateFunc: func(old, new interface{}) {
-			c.updateService(new.(*v1.Service))
-		},
-		DeleteFunc: func(obj interface{}) {
-			c.deleteService(obj.(*v1.Service))
+			c.updateService(old.(*v1.Service), new.(*v1.Service))
 		},
+		DeleteFunc: c.onDeleteService,
 	})
+	c.observeEvents(serviceInformer.Informer())
 
-	// Set up an event handler for when Endpoint resources change.
-	endpointsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			c.addEndpoints(obj.(*v1.Endpoints))
-		},
-		UpdateFunc: func(old, new interface{}) {
-			c.updateEndpoints(new.(*v1.Endpoints))
-		},
-		DeleteFunc: func(obj interface{}) {
-			c.deleteEndpoints(obj.(*v1.Endpoints))
-		},
-	})
+	if c.endpointsMode.endpoints() {
+		endpointsInformer := kubeInformerFactory.Core().V1().Endpoints()
+		c.endpointsSynced = endpointsInformer.Informer().HasSynced
+		c.endpointsLister = endpointsInformer.Lister()
+
+		// Set up an event handler for when Endpoint resources change.
+		endpointsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				c.addEndpoints(obj.(*v1.Endpoints))
+			},
+			UpdateFunc: func(old, new interface{}) {
+				c.updateEndpoints(old.(*v1.Endpoints), new.(*v1.Endpoints))
+			},
+			DeleteFunc: c.onDeleteEndpoints,
+		})
+		c.observeEvents(endpointsInformer.Informer())
+	}
+
+	if c.endpointsMode.endpointSlices() {
+		endpointSliceInformer := kubeInformerFactory.Discovery().V1beta1().EndpointSlices()
+		c.endpointSlicesSynced = endpointSliceInformer.Informer().HasSynced
+		c.endpointSliceLister = endpointSliceInformer.Lister()
+
+		// Set up an event handler for when EndpointSlice resources change.
+		endpointSliceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				c.addEndpointSlice(obj.(*discovery.EndpointSlice))
+			},
+			UpdateFunc: func(old, new interface{}) {
+				c.updateEndpointSlice(old.(*discovery.EndpointSlice), new.(*discovery.EndpointSlice))
+			},
+			DeleteFunc: c.onDeleteEndpointSlice,
+		})
+		c.observeEvents(endpointSliceInformer.Informer())
+	}
 
 	return c
 }
 
 func (c *Controller) addService(service *v1.Service) {
-	if !skipProcessing(service.GetName(), service.GetNamespace(), service.ObjectMeta.Labels) {
-		svc := translateService(service, c.backendName)
-		c.syncqueue.Enqueue(sync.AddServiceAction(svc))
+	if !c.skipProcessing(service.GetName(), service.GetNamespace(), service.ObjectMeta.Labels) &&
+		c.discoverService(service.GetAnnotations(), c.endpointsAnnotations(service.GetNamespace(), service.GetName())) {
+		svc := c.gimbalService(service)
+		c.enqueue(sync.AddServiceAction(svc))
 		c.writeServiceMetrics(service)
+		c.refreshServiceEndpoints(service.GetNamespace(), service.GetName())
+		c.addExternalNameEndpoints(service)
 	}
 }
 
-func (c *Controller) updateService(service *v1.Service) {
-	if !skipProcessing(service.GetName(), service.GetNamespace(), service.ObjectMeta.Labels) {
-		svc := translateService(service, c.backendName)
-		c.syncqueue.Enqueue(sync.UpdateServiceAction(svc))
+func (c *Controller) updateService(old, service *v1.Service) {
+	if c.skipProcessing(service.GetName(), service.GetNamespace(), service.ObjectMeta.Labels) {
+		return
+	}
+	endpointsAnnotations := c.endpointsAnnotations(service.GetNamespace(), service.GetName())
+	wasDiscovered := c.discoverService(old.GetAnnotations(), endpointsAnnotations)
+	isDiscovered := c.discoverService(service.GetAnnotations(), endpointsAnnotations)
+	switch {
+	case isDiscovered:
+		svc := c.gimbalService(service)
+		c.enqueue(sync.UpdateServiceAction(svc))
 		c.writeServiceMetrics(service)
+		// The endpoints resolved from the external name are replaced by the
+		// ones of the service when it stops being an ExternalName service
+		if c.resolvesExternalName(old) && !c.resolvesExternalName(service) {
+			c.removeExternalNameEndpoints(old)
+		}
+		c.addExternalNameEndpoints(service)
+		if wasDiscovered {
+			c.refreshServiceEndpoints(service.GetNamespace(), service.GetName())
+		} else {
+			c.addServiceEndpoints(service.GetNamespace(), service.GetName())
+		}
+	case wasDiscovered:
+		c.removeService(service)
 	}
 }
 
-func (c *Controller) deleteService(service *v1.Service) {
-	if !skipProcessing(service.GetName(), service.GetNamespace(), service.ObjectMeta.Labels) {
-		svc := translateService(service, c.backendName)
-		c.syncqueue.Enqueue(sync.DeleteServiceAction(svc))
+func (c *Controller) deleteService(service *v1.Service, tombstone bool) {
+	// The discover annotations are not taken into account, so that the
+	// service is removed even if it was discovered through its endpoints'
+	// annotations, and these are already gone.
+	if !c.skipDelete(service.GetName(), service.GetNamespace(), service.ObjectMeta.Labels) {
+		svc := c.gimbalService(service)
+		c.enqueue(c.deleteAction(kindService, sync.DeleteServiceAction(svc), tombstone))
 		c.writeServiceMetrics(service)
+		c.removeExternalNameEndpoints(service)
 	}
 }
 
 func (c *Controller) addEndpoints(endpoints *v1.Endpoints) {
-	if !skipProcessing(endpoints.GetName(), endpoints.GetNamespace(), endpoints.ObjectMeta.Labels) {
-		ep := translateEndpoints(endpoints, c.backendName)
-		c.syncqueue.Enqueue(sync.AddEndpointsAction(ep, endpoints.GetName()))
+	if !c.skipProcessing(endpoints.GetName(), endpoints.GetNamespace(), endpoints.ObjectMeta.Labels) &&
+		c.discoverService(c.serviceAnnotations(endpoints.GetNamespace(), endpoints.GetName()), endpoints.GetAnnotations()) {
+		ep := c.gimbalEndpoints(endpoints)
+		c.enqueue(sync.AddEndpointsAction(ep, endpoints.GetName()))
 		c.writeEndpointsMetrics(endpoints)
+		if c.topology {
+			c.refreshServiceTopology(endpoints.GetNamespace(), endpoints.GetName(), translator.Topology{}, c.endpointsTopology(endpoints))
+		}
 	}
 }
 
-func (c *Controller) updateEndpoints(endpoints *v1.Endpoints) {
-	if !skipProcessing(endpoints.GetName(), endpoints.GetNamespace(), endpoints.ObjectMeta.Labels) {
-		ep := translateEndpoints(endpoints, c.backendName)
-		c.syncqueue.Enqueue(sync.UpdateEndpointsAction(ep, endpoints.GetName()))
+func (c *Controller) updateEndpoints(old, endpoints *v1.Endpoints) {
+	if c.skipProcessing(endpoints.GetName(), endpoints.GetNamespace(), endpoints.ObjectMeta.Labels) {
+		return
+	}
+	serviceAnnotations := c.serviceAnnotations(endpoints.GetNamespace(), endpoints.GetName())
+	wasDiscovered := c.discoverService(serviceAnnotations, old.GetAnnotations())
+	isDiscovered := c.discoverService(serviceAnnotations, endpoints.GetAnnotations())
+	switch {
+	case isDiscovered:
+		ep := c.gimbalEndpoints(endpoints)
+		c.enqueueUpdate(kindEndpoints, sync.UpdateEndpointsAction(ep, endpoints.GetName()))
 		c.writeEndpointsMetrics(endpoints)
+		if !wasDiscovered {
+			if svc, err := c.serviceLister.Services(endpoints.GetNamespace()).Get(endpoints.GetName()); err == nil {
+				c.enqueue(sync.AddServiceAction(c.gimbalService(svc)))
+				c.writeServiceMetrics(svc)
+			}
+			c.addServiceEndpointSlices(endpoints.GetNamespace(), endpoints.GetName())
+		} else if c.topology {
+			c.refreshServiceTopology(endpoints.GetNamespace(), endpoints.GetName(), c.endpointsTopology(old), c.endpointsTopology(endpoints))
+		}
+	case wasDiscovered:
+		if svc, err := c.serviceLister.Services(endpoints.GetNamespace()).Get(endpoints.GetName()); err == nil {
+			c.removeService(svc)
+		} else {
+			c.removeEndpoints(endpoints)
+			c.removeServiceEndpointSlices(endpoints.GetNamespace(), endpoints.GetName())
+		}
 	}
 }
 
-func (c *Controller) deleteEndpoints(endpoints *v1.Endpoints) {
-	if !skipProcessing(endpoints.GetName(), endpoints.GetNamespace(), endpoints.ObjectMeta.Labels) {
-		ep := translateEndpoints(endpoints, c.backendName)
-		c.syncqueue.Enqueue(sync.DeleteEndpointsAction(ep, endpoints.GetName()))
+func (c *Controller) deleteEndpoints(endpoints *v1.Endpoints, tombstone bool) {
+	if !c.skipDelete(endpoints.GetName(), endpoints.GetNamespace(), endpoints.ObjectMeta.Labels) {
+		ep := c.gimbalEndpoints(endpoints)
+		c.enqueue(c.deleteAction(kindEndpoints, sync.DeleteEndpointsAction(ep, endpoints.GetName()), tombstone))
 		c.writeEndpointsMetrics(endpoints)
 	}
 }
 
+// addServiceEndpoints adds the endpoints and endpoint slices of a service that
+// starts being discovered, if they are in the cache.
+func (c *Controller) addServiceEndpoints(namespace, name string) {
+	c.addServiceEndpointSlices(namespace, name)
+	if c.endpointsLister == nil {
+		return
+	}
+	endpoints, err := c.endpointsLister.Endpoints(namespace).Get(name)
+	if err != nil {
+		return
+	}
+	c.enqueue(sync.AddEndpointsAction(c.gimbalEndpoints(endpoints), endpoints.GetName()))
+	c.writeEndpointsMetrics(endpoints)
+}
+
+// removeService removes a service that stops being discovered, along with its
+// endpoints and endpoint slices, from Gimbal.
+func (c *Controller) removeService(service *v1.Service) {
+	c.enqueue(sync.DeleteServiceAction(c.gimbalService(service)))
+	c.writeServiceMetrics(service)
+	c.removeExternalNameEndpoints(service)
+	c.removeServiceEndpointSlices(service.GetNamespace(), service.GetName())
+	if c.endpointsLister == nil {
+		return
+	}
+	if endpoints, err := c.endpointsLister.Endpoints(service.GetNamespace()).Get(service.GetName()); err == nil {
+		c.removeEndpoints(endpoints)
+	}
+}
+
+// removeEndpoints removes endpoints that stop being discovered from Gimbal.
+func (c *Controller) removeEndpoints(endpoints *v1.Endpoints) {
+	c.enqueue(sync.DeleteEndpointsAction(c.gimbalEndpoints(endpoints), endpoints.GetName()))
+	c.metrics.DiscovererUpstreamEndpointsMetric(c.gimbalNamespace(endpoints.GetNamespace()), endpoints.GetName(), 0)
+}
+
+// gimbalNamespace returns the Gimbal namespace of the remote namespace
+func (c *Controller) gimbalNamespace(namespace string) string {
+	return c.namespaceMapper.Map(c.backendName, namespace)
+}
+
+// gimbalService returns the Gimbal service of the remote service, with its
+// weight, and the topology of its endpoints if it is recorded.
+func (c *Controller) gimbalService(service *v1.Service) *v1.Service {
+	svc := translateService(service, c.backendName, c.gimbalNamespace(service.GetNamespace()), c.policy, c.addressMode, c.externalNameMode)
+	if c.topology {
+		translator.AddTopology(&svc.ObjectMeta, c.serviceTopology(service.GetNamespace(), service.GetName()))
+	}
+	if err := translator.AddWeight(&svc.ObjectMeta, c.weight, service.GetAnnotations()); err != nil {
+		c.Logger.Warnf("Ignoring weight annotation: %v", err)
+	}
+	return svc
+}
+
+// gimbalEndpoints returns the Gimbal endpoints of the remote endpoints, with
+// the addresses of the address mode. When endpoint slices are replicated as
+// well, the endpoints are not mirrored into endpoint slices by the Gimbal
+// cluster, which would duplicate them.
+func (c *Controller) gimbalEndpoints(endpoints *v1.Endpoints) *v1.Endpoints {
+	ep := translateEndpoints(endpoints, c.backendName, c.gimbalNamespace(endpoints.GetNamespace()), c.policy)
+	ep.Subsets = c.serviceSubsets(endpoints)
+	if c.endpointsMode.endpointSlices() {
+		ep.Labels[endpointSliceSkipMirrorLabel] = "true"
+	}
+	return ep
+}
+
+// serviceAnnotations returns the annotations of the service in the cache, or
+// nil if it is not there.
+func (c *Controller) serviceAnnotations(namespace, name string) map[string]string {
+	svc, err := c.serviceLister.Services(namespace).Get(name)
+	if err != nil {
+		return nil
+	}
+	return svc.GetAnnotations()
+}
+
+// endpointsAnnotations returns the annotations of the endpoints in the cache,
+// or nil if they are not there or endpoints are not replicated.
+func (c *Controller) endpointsAnnotations(namespace, name string) map[string]string {
+	if c.endpointsLister == nil {
+		return nil
+	}
+	ep, err := c.endpointsLister.Endpoints(namespace).Get(name)
+	if err != nil {
+		return nil
+	}
+	return ep.GetAnnotations()
+}
+
+// enqueue adds the action to the sync queue, recording its metrics against
+// this controller's backend, unless the replica is a standby. The leader
+// reconciles the changes a standby missed when it is elected. The action
+// supersedes the pending update of the same object, which is dropped.
+func (c *Controller) enqueue(action sync.Action) {
+	c.debouncer.cancel(action)
+	c.enqueueDue(action)
+}
+
+// enqueueDue adds a debounced update to the sync queue once it is due. Unlike
+// enqueue, it keeps the pending update of the same object, which was received
+// after it.
+func (c *Controller) enqueueDue(action sync.Action) {
+	if !c.elector.IsLeader() {
+		return
+	}
+	c.syncqueue.Enqueue(sync.WithMetrics(action, &c.metrics))
+}
+
+// enqueueUpdate queues an update of an object of the given kind, once the
+// updates that follow it within the debounce window are coalesced.
+func (c *Controller) enqueueUpdate(kind string, action sync.Action) {
+	if c.debouncer == nil {
+		c.enqueue(action)
+		return
+	}
+	if c.elector.IsLeader() {
+		c.debouncer.update(kind, action)
+	}
+}
+
+// addNamespace adds the services and endpoints of a namespace that was not
+// in the cache when they were first seen.
+func (c *Controller) addNamespace(namespace *v1.Namespace) {
+	if c.namespaceFilter.Matches(namespace.GetName(), namespace.GetLabels()) {
+		c.addNamespaceObjects(namespace.GetName())
+	}
+}
+
+// updateNamespace adds or removes the services and endpoints of a namespace
+// when its labels start or stop matching the namespace selector.
+func (c *Controller) updateNamespace(old, new *v1.Namespace) {
+	wasDiscovered := c.namespaceFilter.Matches(old.GetName(), old.GetLabels())
+	isDiscovered := c.namespaceFilter.Matches(new.GetName(), new.GetLabels())
+	switch {
+	case isDiscovered && !wasDiscovered:
+		c.addNamespaceObjects(new.GetName())
+	case wasDiscovered && !isDiscovered:
+		c.deleteNamespaceObjects(new.GetName())
+	}
+}
+
+func (c *Controller) addNamespaceObjects(namespace string) {
+	services, err := c.serviceLister.Services(namespace).List(labels.Everything())
+	if err != nil {
+		c.Logger.Errorf("Could not list services in namespace %s: %v", namespace, err)
+		return
+	}
+	for _, svc := range services {
+		c.addService(svc)
+	}
+
+	if c.endpointsLister != nil {
+		endpoints, err := c.endpointsLister.Endpoints(namespace).List(labels.Everything())
+		if err != nil {
+			c.Logger.Errorf("Could not list endpoints in namespace %s: %v", namespace, err)
+			return
+		}
+		for _, ep := range endpoints {
+			c.addEndpoints(ep)
+		}
+	}
+
+	if c.endpointSliceLister != nil {
+		slices, err := c.endpointSliceLister.EndpointSlices(namespace).List(labels.Everything())
+		if err != nil {
+			c.Logger.Errorf("Could not list endpoint slices in namespace %s: %v", namespace, err)
+			return
+		}
+		for _, slice := range slices {
+			c.addEndpointSlice(slice)
+		}
+	}
+}
+
+func (c *Controller) deleteNamespaceObjects(namespace string) {
+	services, err := c.serviceLister.Services(namespace).List(labels.Everything())
+	if err != nil {
+		c.Logger.Errorf("Could not list services in namespace %s: %v", namespace, err)
+		return
+	}
+	for _, svc := range services {
+		if !skipObject(svc.GetName(), svc.GetNamespace(), svc.ObjectMeta.Labels) {
+			c.enqueue(sync.DeleteServiceAction(c.gimbalService(svc)))
+		}
+	}
+	c.writeNamespaceServicesMetric(namespace)
+
+	if c.endpointsLister != nil {
+		endpoints, err := c.endpointsLister.Endpoints(namespace).List(labels.Everything())
+		if err != nil {
+			c.Logger.Errorf("Could not list endpoints in namespace %s: %v", namespace, err)
+			return
+		}
+		for _, ep := range endpoints {
+			if !skipObject(ep.GetName(), ep.GetNamespace(), ep.ObjectMeta.Labels) {
+				c.enqueue(sync.DeleteEndpointsAction(c.gimbalEndpoints(ep), ep.GetName()))
+				c.metrics.DiscovererUpstreamEndpointsMetric(c.gimbalNamespace(namespace), ep.GetName(), 0)
+			}
+		}
+	}
+
+	if c.endpointSliceLister != nil {
+		slices, err := c.endpointSliceLister.EndpointSlices(namespace).List(labels.Everything())
+		if err != nil {
+			c.Logger.Errorf("Could not list endpoint slices in namespace %s: %v", namespace, err)
+			return
+		}
+		for _, slice := range slices {
+			serviceName, ok := slice.Labels[discovery.LabelServiceName]
+			if ok && !skipObject(serviceName, slice.GetNamespace(), slice.ObjectMeta.Labels) {
+				c.enqueue(sync.DeleteEndpointSliceAction(c.gimbalEndpointSlice(slice), serviceName))
+				c.metrics.DiscovererUpstreamEndpointsMetric(c.gimbalNamespace(namespace), serviceName, 0)
+			}
+		}
+	}
+}
+
 // skipProcessing determines if this should be processed or not
-func skipProcessing(name, namespace string, labels map[string]string) bool {
+func (c *Controller) skipProcessing(name, namespace string, labels map[string]string) bool {
+	return skipObject(name, namespace, labels) || !c.discoverNamespace(namespace) || c.shadowedNamespace(namespace)
+}
+
+// skipDelete determines if the deletion of an object should be processed or
+// not. The namespace selector is not taken into account, given that the
+// namespace might already be gone from the cache when its objects are deleted.
+func (c *Controller) skipDelete(name, namespace string, labels map[string]string) bool {
+	return skipObject(name, namespace, labels) || !c.namespaceFilter.MatchesName(namespace) || c.shadowedNamespace(namespace)
+}
+
+// shadowedNamespace returns true if the Gimbal namespace of the remote
+// namespace is the one another remote namespace is explicitly mapped to. A
+// warning is logged the first time a namespace is found to be shadowed.
+func (c *Controller) shadowedNamespace(namespace string) bool {
+	remote, ok := c.namespaceMapper.shadowedBy(c.backendName, namespace)
+	if !ok {
+		return false
+	}
+	if _, reported := c.shadowed.LoadOrStore(namespace, true); !reported {
+		c.Logger.Warnf("Skipping namespace %s: its Gimbal namespace %s is the one namespace %s is mapped to",
+			namespace, c.gimbalNamespace(namespace), remote)
+	}
+	return true
+}
+
+// skipObject determines if the object must never be processed, regardless of
+// the namespace it lives in
+func skipObject(name, namespace string, labels map[string]string) bool {
 	_, gimbalLabel := labels[translator.GimbalLabelBackend]
-	return gimbalLabel || namespace == kubesystemNamespace || (name == kubesystemService && namespace == "default")
+	return gimbalLabel || (name == kubesystemService && namespace == "default")
+}
+
+// discoverNamespace determines if the objects in the namespace are discovered
+func (c *Controller) discoverNamespace(namespace string) bool {
+	if !c.namespaceFilter.HasSelector() {
+		return c.namespaceFilter.MatchesName(namespace)
+	}
+	ns, err := c.namespaceLister.Get(namespace)
+	if err != nil {
+		// The namespace is not in the cache yet. Its objects are processed
+		// once it is added.
+		return false
+	}
+	return c.namespaceFilter.Matches(ns.GetName(), ns.GetLabels())
 }
 
 func (c *Controller) writeServiceMetrics(svc *v1.Service) {
-	upstreamServices, err := c.serviceLister.Services(svc.GetNamespace()).List(labels.Everything())
+	c.writeNamespaceServicesMetric(svc.GetNamespace())
+}
+
+// writeNamespaceServicesMetric records the number of upstream services that
+// are replicated into the Gimbal namespace of the remote namespace. Metrics
+// are labelled with the Gimbal namespace.
+func (c *Controller) writeNamespaceServicesMetric(namespace string) {
+	gimbalNamespace := c.gimbalNamespace(namespace)
+
+	// Each Gimbal namespace is the target of a single remote namespace
+	upstreamServices, err := c.serviceLister.Services(namespace).List(labels.Everything())
 	if err != nil {
 		c.Logger.Error("Could not get service metrics: ", err)
 		return
 	}
-	upstreamServicesCount := len(upstreamServices)
-	// The discoverer does not replicate the kubernetes service in the default namespace.
-	// Thus, don't count it as a service that is a "candidate" for replication.
-	if svc.GetNamespace() == "default" && containsService("kubernetes", upstreamServices) {
-		upstreamServicesCount--
+	// Only count the services that are "candidates" for replication. For
+	// example, the discoverer does not replicate the kubernetes service in
+	// the default namespace.
+	upstreamServicesCount := 0
+	for _, s := range upstreamServices {
+		if !c.skipProcessing(s.GetName(), s.GetNamespace(), s.ObjectMeta.Labels) &&
+			c.discoverService(s.GetAnnotations(), c.endpointsAnnotations(s.GetNamespace(), s.GetName())) {
+			upstreamServicesCount++
+		}
 	}
-	c.metrics.DiscovererUpstreamServicesMetric(svc.GetNamespace(), upstreamServicesCount)
+	c.metrics.DiscovererUpstreamServicesMetric(gimbalNamespace, upstreamServicesCount)
 }
 
 func (c *Controller) writeEndpointsMetrics(ep *v1.Endpoints) {
-	c.metrics.DiscovererUpstreamEndpointsMetric(ep.GetNamespace(), ep.GetName(), sync.SumEndpoints(ep))
+	c.metrics.DiscovererUpstreamEndpointsMetric(c.gimbalNamespace(ep.GetNamespace()), ep.GetName(), sync.SumEndpoints(ep))
+}
+
+// observeEvents records the time of the events of the informer, including
+// the periodic resyncs, to tell how fresh the watches of the remote cluster are.
+func (c *Controller) observeEvents(informer cache.SharedIndexInformer) {
+	observe := func() { atomic.StoreInt64(&c.lastEvent, time.Now().UnixNano()) }
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { observe() },
+		UpdateFunc: func(old, new interface{}) { observe() },
+		DeleteFunc: func(obj interface{}) { observe() },
+	})
+}
+
+// LastEvent returns the time of the last event received from the remote
+// cluster, or the zero time if none was received yet.
+func (c *Controller) LastEvent() time.Time {
+	nanos := atomic.LoadInt64(&c.lastEvent)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// HasSynced returns true once the caches of all the informers of the
+// controller are synced.
+func (c *Controller) HasSynced() bool {
+	for _, synced := range []cache.InformerSynced{c.servicesSynced, c.endpointsSynced, c.endpointSlicesSynced,
+		c.nodesSynced, c.namespacesSynced} {
+		if synced != nil && !synced() {
+			return false
+		}
+	}
+	return true
 }
 
 // Run gets the party started
@@ -184,26 +746,66 @@ func (c *Controller) Run(stopCh <-chan struct{}) error {
 	if ok := cache.WaitForCacheSync(stopCh, c.servicesSynced); !ok {
 		return fmt.Errorf("failed to wait for backend service caches to sync")
 	}
-	c.Logger.Infof("Waiting for backend endpoints informer caches to sync")
-	if ok := cache.WaitForCacheSync(stopCh, c.endpointsSynced); !ok {
-		return fmt.Errorf("failed to wait for backend endpoints caches to sync")
+	if c.endpointsSynced != nil {
+		c.Logger.Infof("Waiting for backend endpoints informer caches to sync")
+		if ok := cache.WaitForCacheSync(stopCh, c.endpointsSynced); !ok {
+			return fmt.Errorf("failed to wait for backend endpoints caches to sync")
+		}
+	}
+	if c.endpointSlicesSynced != nil {
+		c.Logger.Infof("Waiting for backend endpoint slices informer caches to sync")
+		if ok := cache.WaitForCacheSync(stopCh, c.endpointSlicesSynced); !ok {
+			return fmt.Errorf("failed to wait for backend endpoint slices caches to sync")
+		}
+	}
+	if c.nodesSynced != nil {
+		c.Logger.Infof("Waiting for backend nodes informer caches to sync")
+		if ok := cache.WaitForCacheSync(stopCh, c.nodesSynced); !ok {
+			return fmt.Errorf("failed to wait for backend nodes caches to sync")
+		}
+	}
+	if c.namespacesSynced != nil {
+		c.Logger.Infof("Waiting for backend namespaces informer caches to sync")
+		if ok := cache.WaitForCacheSync(stopCh, c.namespacesSynced); !ok {
+			return fmt.Errorf("failed to wait for backend namespaces caches to sync")
+		}
 	}
 
-	// Start the sync queue
-	go c.syncqueue.Run(stopCh)
+	go c.runExternalNameWorkers(stopCh)
 
-	c.Logger.Infof("Started workers")
-	<-stopCh
-	c.Logger.Infof("Shutting down workers")
+	// Reconcile the state of Gimbal with the synced caches, then keep
+	// reconciling on every period. With leader election, the replica
+	// reconciles every time it is elected instead.
+	elected := make(chan struct{}, 1)
+	if c.elector != nil {
+		go c.elector.Run(stopCh, func() {
+			select {
+			case elected <- struct{}{}:
+			default:
+			}
+		})
+	} else {
+		c.reconcile()
+	}
 
-	return nil
-}
+	var tick <-chan time.Time
+	if c.reconcilePeriod > 0 {
+		ticker := time.NewTicker(c.reconcilePeriod)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 
-func containsService(name string, services []*v1.Service) bool {
-	for _, s := range services {
-		if s.Name == name {
-			return true
+	c.Logger.Infof("Started k8s controller for backend %s", c.backendName)
+	for {
+		select {
+		case <-tick:
+			c.reconcile()
+		case <-elected:
+			c.reconcile()
+		case <-stopCh:
+			c.debouncer.stop()
+			c.Logger.Infof("Shutting down k8s controller for backend %s", c.backendName)
+			return nil
 		}
 	}
-	return false
 }
@@ -18,10 +18,13 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/projectcontour/gimbal/pkg/leader"
 	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
 	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/translator"
 	"github.com/prometheus/client_golang/prometheus"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -68,7 +71,7 @@ var serviceTests = []struct {
 			},
 		},
 		expected:              0,
-		expectedServicesCount: 1,
+		expectedServicesCount: 0,
 	},
 	{
 		name: "kubernetes service",
@@ -212,7 +215,7 @@ func TestUpdateServiceQueue(t *testing.T) {
 	for _, tc := range serviceTests {
 		t.Run(tc.name, func(t *testing.T) {
 			c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
-			c.updateService(tc.service)
+			c.updateService(tc.service, tc.service)
 			time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
 			got := c.syncqueue.Workqueue.Len()
 			assert.Equal(t, tc.expected, got)
@@ -223,7 +226,7 @@ func TestDeleteServiceQueue(t *testing.T) {
 	for _, tc := range serviceTests {
 		t.Run(tc.name, func(t *testing.T) {
 			c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
-			c.deleteService(tc.service)
+			c.deleteService(tc.service, false)
 			time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
 			got := c.syncqueue.Workqueue.Len()
 			assert.Equal(t, tc.expected, got)
@@ -245,7 +248,7 @@ func TestUpdateEndpointsQueue(t *testing.T) {
 	for _, tc := range endpointTests {
 		t.Run(tc.name, func(t *testing.T) {
 			c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
-			c.updateEndpoints(tc.endpoint)
+			c.updateEndpoints(tc.endpoint, tc.endpoint)
 			time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
 			got := c.syncqueue.Workqueue.Len()
 			assert.Equal(t, tc.expected, got)
@@ -256,7 +259,7 @@ func TestDeleteEndpointsQueue(t *testing.T) {
 	for _, tc := range endpointTests {
 		t.Run(tc.name, func(t *testing.T) {
 			c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
-			c.deleteEndpoints(tc.endpoint)
+			c.deleteEndpoints(tc.endpoint, false)
 			time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
 			got := c.syncqueue.Workqueue.Len()
 			assert.Equal(t, tc.expected, got)
@@ -317,6 +320,7 @@ func TestServicesMetrics(t *testing.T) {
 				serviceLister:   informer.Core().V1().Services().Lister(),
 				endpointsLister: informer.Core().V1().Endpoints().Lister(),
 				metrics:         metrics,
+				namespaceFilter: defaultNamespaceFilter(),
 			}
 
 			// Call informer before starting!
@@ -364,5 +368,371 @@ func getDefaultController(metrics localmetrics.DiscovererMetrics) *Controller {
 		serviceLister:   informer.Core().V1().Services().Lister(),
 		endpointsLister: informer.Core().V1().Endpoints().Lister(),
 		metrics:         metrics,
+		namespaceFilter: defaultNamespaceFilter(),
+	}
+}
+
+func defaultNamespaceFilter() *NamespaceFilter {
+	f, _ := NewNamespaceFilter(nil, []string{"kube-system"}, "")
+	return f
+}
+
+func TestNamespaceSelector(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+	ep := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+	unlabelled := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team1"}}
+	labelled := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team1", Labels: map[string]string{"gimbal": "enabled"}}}
+
+	tests := []struct {
+		name            string
+		namespace       *v1.Namespace
+		update          func(c *Controller)
+		expectedActions []string
+	}{
+		{
+			name:      "service in unlabelled namespace",
+			namespace: unlabelled,
+			update:    func(c *Controller) { c.addService(svc) },
+		},
+		{
+			name:            "service in labelled namespace",
+			namespace:       labelled,
+			update:          func(c *Controller) { c.addService(svc) },
+			expectedActions: []string{"add"},
+		},
+		{
+			name:            "namespace starts matching",
+			namespace:       labelled,
+			update:          func(c *Controller) { c.updateNamespace(unlabelled, labelled) },
+			expectedActions: []string{"add", "add"},
+		},
+		{
+			name:            "namespace stops matching",
+			namespace:       unlabelled,
+			update:          func(c *Controller) { c.updateNamespace(labelled, unlabelled) },
+			expectedActions: []string{"delete", "delete"},
+		},
+		{
+			name:      "namespace labels unchanged",
+			namespace: labelled,
+			update:    func(c *Controller) { c.updateNamespace(labelled, labelled) },
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := localmetrics.NewMetrics("backendtype", "backend")
+			filter, err := NewNamespaceFilter(nil, nil, "gimbal=enabled")
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := fake.NewSimpleClientset(tc.namespace, svc, ep)
+			informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+			c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "backend", metrics,
+				Options{NamespaceFilter: filter})
+
+			// Populate the caches without running the event handlers
+			for _, obj := range []interface{}{tc.namespace, svc, ep} {
+				var err error
+				switch o := obj.(type) {
+				case *v1.Namespace:
+					err = informer.Core().V1().Namespaces().Informer().GetIndexer().Add(o)
+				case *v1.Service:
+					err = informer.Core().V1().Services().Informer().GetIndexer().Add(o)
+				case *v1.Endpoints:
+					err = informer.Core().V1().Endpoints().Informer().GetIndexer().Add(o)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tc.update(c)
+			assert.Equal(t, tc.expectedActions, queuedActions(c))
+		})
+	}
+}
+
+func TestDiscoverAnnotation(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+	optedOut := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1",
+		Annotations: map[string]string{DiscoverAnnotation: "false"}}}
+	optedIn := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1",
+		Annotations: map[string]string{DiscoverAnnotation: "true"}}}
+	ep := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+	epOptedOut := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1",
+		Annotations: map[string]string{DiscoverAnnotation: "false"}}}
+
+	tests := []struct {
+		name            string
+		mode            DiscoveryMode
+		service         *v1.Service
+		endpoints       *v1.Endpoints
+		update          func(c *Controller)
+		expectedActions []string
+	}{
+		{
+			name:            "opt-out mode, no annotation",
+			service:         svc,
+			endpoints:       ep,
+			update:          func(c *Controller) { c.addService(svc) },
+			expectedActions: []string{"add"},
+		},
+		{
+			name:      "opt-out mode, service opted out",
+			service:   optedOut,
+			endpoints: ep,
+			update:    func(c *Controller) { c.addService(optedOut) },
+		},
+		{
+			name:      "opt-out mode, endpoints opted out",
+			service:   svc,
+			endpoints: epOptedOut,
+			update:    func(c *Controller) { c.addService(svc) },
+		},
+		{
+			name:      "opt-in mode, no annotation",
+			mode:      DiscoveryOptIn,
+			service:   svc,
+			endpoints: ep,
+			update:    func(c *Controller) { c.addService(svc); c.addEndpoints(ep) },
+		},
+		{
+			name:            "opt-in mode, service opted in",
+			mode:            DiscoveryOptIn,
+			service:         optedIn,
+			endpoints:       ep,
+			update:          func(c *Controller) { c.addService(optedIn); c.addEndpoints(ep) },
+			expectedActions: []string{"add", "add"},
+		},
+		{
+			name:            "service opts out",
+			service:         optedOut,
+			endpoints:       ep,
+			update:          func(c *Controller) { c.updateService(svc, optedOut) },
+			expectedActions: []string{"delete", "delete"},
+		},
+		{
+			name:            "service opts in",
+			mode:            DiscoveryOptIn,
+			service:         optedIn,
+			endpoints:       ep,
+			update:          func(c *Controller) { c.updateService(svc, optedIn) },
+			expectedActions: []string{"update", "add"},
+		},
+		{
+			name:            "endpoints opt out",
+			service:         svc,
+			endpoints:       epOptedOut,
+			update:          func(c *Controller) { c.updateEndpoints(ep, epOptedOut) },
+			expectedActions: []string{"delete", "delete"},
+		},
+		{
+			name:      "opted out service updated",
+			service:   optedOut,
+			endpoints: ep,
+			update:    func(c *Controller) { c.updateService(optedOut, optedOut) },
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := localmetrics.NewMetrics("backendtype", "backend")
+			client := fake.NewSimpleClientset()
+			informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+			c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "backend", metrics,
+				Options{DiscoveryMode: tc.mode})
+
+			// Populate the caches without running the event handlers
+			if err := informer.Core().V1().Services().Informer().GetIndexer().Add(tc.service); err != nil {
+				t.Fatal(err)
+			}
+			if err := informer.Core().V1().Endpoints().Informer().GetIndexer().Add(tc.endpoints); err != nil {
+				t.Fatal(err)
+			}
+
+			tc.update(c)
+			assert.Equal(t, tc.expectedActions, queuedActions(c))
+		})
+	}
+}
+
+// queuedActions returns the types of the actions in the controller's queue
+func queuedActions(c *Controller) []string {
+	time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+
+	var got []string
+	for c.syncqueue.Workqueue.Len() > 0 {
+		item, _ := c.syncqueue.Workqueue.Get()
+		got = append(got, item.(sync.Action).GetActionType())
+		c.syncqueue.Workqueue.Done(item)
+	}
+	return got
+}
+
+func TestNamespaceMapping(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+	other := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "team1-prod"}}
+
+	metrics := localmetrics.NewMetrics("backendtype", "backend")
+	metrics.RegisterPrometheus(false)
+	mapper, err := NewNamespaceMapper(map[string]string{"team1-prod": "team1-cluster1"}, "{{namespace}}-{{backend}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset()
+	informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+	logger, hook := logrustest.NewNullLogger()
+	c := NewController(logger, sync.NewQueue(logrus.New(), client, 1, metrics), informer, "cluster1", metrics,
+		Options{NamespaceMapper: mapper})
+	for _, s := range []*v1.Service{svc, other} {
+		if err := informer.Core().V1().Services().Informer().GetIndexer().Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.addService(other)
+	time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+	item, _ := c.syncqueue.Workqueue.Get()
+	assert.Equal(t, "team1-cluster1", item.(sync.Action).ObjectMeta().GetNamespace())
+	c.syncqueue.Workqueue.Done(item)
+
+	// team1 maps to the namespace team1-prod is explicitly mapped to, so its
+	// services are not replicated, and do not overwrite the ones of team1-prod
+	c.addService(svc)
+	c.updateService(svc, svc)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, c.syncqueue.Workqueue.Len())
+
+	// The shadowed namespace is only reported once
+	var warnings int
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.WarnLevel {
+			warnings++
+		}
+	}
+	assert.Equal(t, 1, warnings)
+
+	gathering, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamServices := map[string]float64{}
+	for _, mf := range gathering {
+		if mf.GetName() == localmetrics.DiscovererUpstreamServicesGauge {
+			for _, m := range mf.Metric {
+				for _, l := range m.Label {
+					if l.GetName() == "namespace" {
+						upstreamServices[l.GetValue()] = m.Gauge.GetValue()
+					}
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{"team1-cluster1": 1}, upstreamServices)
+}
+
+func TestBackendWeight(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     Options
+		annotations map[string]string
+		expected    map[string]string
+	}{
+		{
+			name: "no weight",
+		},
+		{
+			name:     "default weight",
+			options:  Options{Weight: "10"},
+			expected: map[string]string{translator.GimbalAnnotationWeight: "10"},
+		},
+		{
+			name:     "backend weight",
+			options:  Options{Weight: "10", BackendWeights: map[string]string{"cluster1": "20", "cluster2": "30"}},
+			expected: map[string]string{translator.GimbalAnnotationWeight: "20"},
+		},
+		{
+			name:        "remote weight",
+			options:     Options{Weight: "10"},
+			annotations: map[string]string{translator.GimbalAnnotationWeight: "50"},
+			expected:    map[string]string{translator.GimbalAnnotationWeight: "50"},
+		},
+		{
+			name:        "invalid remote weight",
+			options:     Options{Weight: "10"},
+			annotations: map[string]string{translator.GimbalAnnotationWeight: "-1"},
+			expected:    map[string]string{translator.GimbalAnnotationWeight: "10"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := localmetrics.NewMetrics("backendtype", "backend")
+			client := fake.NewSimpleClientset()
+			informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+			c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "cluster1", metrics, tc.options)
+
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1", Annotations: tc.annotations}}
+			got := c.gimbalService(svc)
+			if len(tc.expected) == 0 {
+				assert.Empty(t, got.Annotations)
+			} else {
+				assert.Equal(t, tc.expected, got.Annotations)
+			}
+		})
+	}
+}
+
+func TestStandbyDoesNotEnqueue(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+
+	metrics := localmetrics.NewMetrics("backendtype", "backend")
+	metrics.RegisterPrometheus(false)
+	client := fake.NewSimpleClientset()
+	informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+	config := &leader.Config{
+		Client:        client,
+		Namespace:     "gimbal-discovery",
+		Identity:      "replica-a",
+		LeaseDuration: leader.DefaultLeaseDuration,
+		RenewDeadline: leader.DefaultRenewDeadline,
+		RetryPeriod:   leader.DefaultRetryPeriod,
+	}
+	c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "cluster1", metrics,
+		Options{LeaderElection: config})
+
+	// The elector is not running, so the controller is a standby
+	c.addService(svc)
+	assert.Empty(t, queuedActions(c))
+}
+
+func TestDebouncedEndpointsUpdates(t *testing.T) {
+	old := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1", ResourceVersion: "1"}}
+
+	metrics := localmetrics.NewMetrics("backendtype", "backend")
+	metrics.RegisterPrometheus(false)
+	client := fake.NewSimpleClientset()
+	informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+	c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "cluster1", metrics,
+		Options{EndpointsDebounce: 50 * time.Millisecond})
+
+	for _, version := range []string{"2", "3", "4"} {
+		endpoints := old.DeepCopy()
+		endpoints.ResourceVersion = version
+		c.updateEndpoints(old, endpoints)
+	}
+	assert.Equal(t, []string{"update"}, queuedActions(c))
+
+	gathering, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var coalesced float64
+	for _, mf := range gathering {
+		if mf.GetName() == localmetrics.DiscovererCoalescedUpdatesCounter {
+			coalesced = mf.Metric[0].Counter.GetValue()
+		}
 	}
+	assert.Equal(t, 2.0, coalesced)
 }
@@ -0,0 +1,135 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	gosync "sync"
+	"time"
+
+	"github.com/projectcontour/gimbal/pkg/sync"
+)
+
+// debouncer delays the updates of objects so that bursts of updates of the
+// same object, such as the endpoints of a service during a rolling deploy, are
+// coalesced into a single update with the latest state. An update is synced
+// once no other update of the object was received for the window, and at most
+// maxDelay after the first update of the burst.
+type debouncer struct {
+	window   time.Duration
+	maxDelay time.Duration
+	// enqueue queues the latest update of an object once it is due
+	enqueue func(action sync.Action)
+	// coalesced is called with the kind of an object when one of its updates
+	// is replaced by a later one
+	coalesced func(kind string)
+
+	mu      gosync.Mutex
+	pending map[string]*pendingUpdate
+}
+
+type pendingUpdate struct {
+	action sync.Action
+	first  time.Time
+	timer  *time.Timer
+}
+
+// newDebouncer returns a debouncer, or nil if the window is zero, in which case
+// updates are queued at once. maxDelay is raised to the window if shorter.
+func newDebouncer(window, maxDelay time.Duration, enqueue func(sync.Action), coalesced func(string)) *debouncer {
+	if window <= 0 {
+		return nil
+	}
+	if maxDelay < window {
+		maxDelay = window
+	}
+	return &debouncer{
+		window:    window,
+		maxDelay:  maxDelay,
+		enqueue:   enqueue,
+		coalesced: coalesced,
+		pending:   map[string]*pendingUpdate{},
+	}
+}
+
+// update delays an update of an object of the given kind, replacing the
+// pending update of the same object if any.
+func (d *debouncer) update(kind string, action sync.Action) {
+	if d == nil {
+		return
+	}
+	key := sync.ObjectKey(action)
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.pending[key]
+	if ok {
+		p.timer.Stop()
+		p.action = action
+		d.coalesced(kind)
+	} else {
+		p = &pendingUpdate{action: action, first: now}
+		d.pending[key] = p
+	}
+	delay := d.window
+	if deadline := p.first.Add(d.maxDelay); now.Add(delay).After(deadline) {
+		delay = deadline.Sub(now)
+	}
+	p.timer = time.AfterFunc(delay, func() { d.flush(key, p) })
+}
+
+// flush queues the pending update of an object, unless it was already
+// flushed or cancelled.
+func (d *debouncer) flush(key string, p *pendingUpdate) {
+	d.mu.Lock()
+	if d.pending[key] != p {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.pending, key)
+	action := p.action
+	d.mu.Unlock()
+
+	d.enqueue(action)
+}
+
+// cancel drops the pending update of the object of the action, which
+// supersedes it.
+func (d *debouncer) cancel(action sync.Action) {
+	if d == nil {
+		return
+	}
+	key := sync.ObjectKey(action)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if p, ok := d.pending[key]; ok {
+		p.timer.Stop()
+		delete(d.pending, key)
+	}
+}
+
+// stop drops all the pending updates. The next reconciliation syncs them.
+func (d *debouncer) stop() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, p := range d.pending {
+		p.timer.Stop()
+		delete(d.pending, key)
+	}
+}
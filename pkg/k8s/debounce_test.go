@@ -0,0 +1,153 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	gosync "sync"
+	"testing"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// recorder records the actions queued by a debouncer
+type recorder struct {
+	mu        gosync.Mutex
+	actions   []sync.Action
+	coalesced int
+}
+
+func (r *recorder) enqueue(action sync.Action) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.actions = append(r.actions, action)
+}
+
+func (r *recorder) coalesce(kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.coalesced++
+}
+
+// versions returns the resource versions of the queued endpoints
+func (r *recorder) versions() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var versions []string
+	for _, action := range r.actions {
+		versions = append(versions, action.ObjectMeta().GetResourceVersion())
+	}
+	return versions
+}
+
+func endpointsUpdate(name, version string) sync.Action {
+	return sync.UpdateEndpointsAction(&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: name, ResourceVersion: version}}, name)
+}
+
+func TestNewDebouncer(t *testing.T) {
+	assert.Nil(t, newDebouncer(0, time.Second, nil, nil))
+	d := newDebouncer(time.Second, time.Millisecond, nil, nil)
+	assert.Equal(t, time.Second, d.maxDelay)
+}
+
+func TestDebouncerCoalescesUpdates(t *testing.T) {
+	r := &recorder{}
+	d := newDebouncer(50*time.Millisecond, time.Second, r.enqueue, r.coalesce)
+
+	d.update(kindEndpoints, endpointsUpdate("a", "1"))
+	d.update(kindEndpoints, endpointsUpdate("a", "2"))
+	d.update(kindEndpoints, endpointsUpdate("b", "1"))
+	d.update(kindEndpoints, endpointsUpdate("a", "3"))
+	assert.Empty(t, r.versions())
+
+	assert.Eventually(t, func() bool { return len(r.versions()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{"3", "1"}, r.versions())
+	assert.Equal(t, 2, r.coalesced)
+}
+
+func TestDebouncerMaxDelay(t *testing.T) {
+	r := &recorder{}
+	d := newDebouncer(100*time.Millisecond, 200*time.Millisecond, r.enqueue, r.coalesce)
+
+	// Updates that keep coming within the window are flushed after the
+	// maximum delay
+	start := time.Now()
+	for i := 0; len(r.versions()) == 0 && time.Since(start) < time.Second; i++ {
+		d.update(kindEndpoints, endpointsUpdate("a", "1"))
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"1"}, r.versions())
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "flushed after %v", time.Since(start))
+}
+
+func TestDebouncerCancel(t *testing.T) {
+	r := &recorder{}
+	d := newDebouncer(50*time.Millisecond, time.Second, r.enqueue, r.coalesce)
+
+	d.update(kindEndpoints, endpointsUpdate("a", "1"))
+	d.update(kindEndpoints, endpointsUpdate("b", "1"))
+	// A deletion supersedes the pending update of the same endpoints, but not
+	// the update of the service of the same name
+	d.cancel(sync.DeleteEndpointsAction(&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "a"}}, "a"))
+	d.cancel(sync.DeleteServiceAction(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "b"}}))
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, []string{"1"}, r.versions())
+	assert.Equal(t, "b", r.actions[0].ObjectMeta().GetName())
+}
+
+func TestDebouncerStop(t *testing.T) {
+	r := &recorder{}
+	d := newDebouncer(50*time.Millisecond, time.Second, r.enqueue, r.coalesce)
+
+	d.update(kindEndpoints, endpointsUpdate("a", "1"))
+	d.stop()
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Empty(t, r.versions())
+}
+
+func TestDebouncerUpdateDuringFlush(t *testing.T) {
+	metrics := localmetrics.NewMetrics("backendtype", "cluster1")
+	client := fake.NewSimpleClientset()
+	informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+	c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "cluster1", metrics,
+		Options{EndpointsDebounce: 20 * time.Millisecond})
+
+	// A later update of the same endpoints arrives while the first one is
+	// being flushed, and is flushed in turn rather than dropped
+	enqueue := c.debouncer.enqueue
+	var once gosync.Once
+	c.debouncer.enqueue = func(action sync.Action) {
+		once.Do(func() { c.enqueueUpdate(kindEndpoints, endpointsUpdate("a", "2")) })
+		enqueue(action)
+	}
+	c.enqueueUpdate(kindEndpoints, endpointsUpdate("a", "1"))
+
+	assert.Eventually(t, func() bool { return c.syncqueue.Workqueue.Len() == 2 }, time.Second, 10*time.Millisecond)
+	var versions []string
+	for c.syncqueue.Workqueue.Len() > 0 {
+		item, _ := c.syncqueue.Workqueue.Get()
+		versions = append(versions, item.(sync.Action).ObjectMeta().GetResourceVersion())
+		c.syncqueue.Workqueue.Done(item)
+	}
+	assert.Equal(t, []string{"1", "2"}, versions)
+}
@@ -0,0 +1,159 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"fmt"
+
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/translator"
+	discovery "k8s.io/api/discovery/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// endpointSliceManagedBy is the value of the managed-by label of the
+	// endpoint slices written to Gimbal
+	endpointSliceManagedBy = "gimbal.projectcontour.io"
+	// endpointSliceSkipMirrorLabel keeps the endpoint slice mirroring
+	// controller of the Gimbal cluster from mirroring the endpoints written
+	// by the discoverer, when it writes endpoint slices as well.
+	endpointSliceSkipMirrorLabel = "endpointslice.kubernetes.io/skip-mirror"
+)
+
+// EndpointsMode determines whether the endpoints of remote services are read
+// from, and written to Gimbal as, Endpoints, EndpointSlices or both.
+type EndpointsMode string
+
+const (
+	// EndpointsModeEndpoints only replicates Endpoints.
+	EndpointsModeEndpoints EndpointsMode = "endpoints"
+	// EndpointsModeEndpointSlices only replicates EndpointSlices.
+	EndpointsModeEndpointSlices EndpointsMode = "endpointslices"
+	// EndpointsModeBoth replicates both Endpoints and EndpointSlices, for
+	// when the remote or Gimbal clusters are migrating from one to the other.
+	EndpointsModeBoth EndpointsMode = "both"
+)
+
+// ParseEndpointsMode returns the EndpointsMode with the given name.
+func ParseEndpointsMode(mode string) (EndpointsMode, error) {
+	switch EndpointsMode(mode) {
+	case EndpointsModeEndpoints, EndpointsModeEndpointSlices, EndpointsModeBoth:
+		return EndpointsMode(mode), nil
+	}
+	return "", fmt.Errorf("invalid endpoints mode %q, must be one of %q, %q or %q", mode,
+		EndpointsModeEndpoints, EndpointsModeEndpointSlices, EndpointsModeBoth)
+}
+
+// endpoints returns true if Endpoints are replicated. This is the default.
+func (m EndpointsMode) endpoints() bool {
+	return m != EndpointsModeEndpointSlices
+}
+
+// endpointSlices returns true if EndpointSlices are replicated.
+func (m EndpointsMode) endpointSlices() bool {
+	return m == EndpointsModeEndpointSlices || m == EndpointsModeBoth
+}
+
+// addEndpointSlice adds the Gimbal endpoint slice of a remote slice. Endpoint
+// slices are discovered along with the service named by their service name
+// label. Slices without that label do not belong to a service, and are skipped.
+func (c *Controller) addEndpointSlice(slice *discovery.EndpointSlice) {
+	serviceName, ok := slice.Labels[discovery.LabelServiceName]
+	if !ok || c.skipProcessing(serviceName, slice.GetNamespace(), slice.ObjectMeta.Labels) ||
+		!c.discoverService(c.serviceAnnotations(slice.GetNamespace(), serviceName), c.endpointsAnnotations(slice.GetNamespace(), serviceName)) {
+		return
+	}
+	c.enqueue(sync.AddEndpointSliceAction(c.gimbalEndpointSlice(slice), serviceName))
+	c.writeEndpointSliceMetrics(slice.GetNamespace(), serviceName)
+	if c.topology && c.endpointsLister == nil {
+		c.refreshServiceTopology(slice.GetNamespace(), serviceName, translator.Topology{}, c.endpointSlicesTopology(slice))
+	}
+}
+
+func (c *Controller) updateEndpointSlice(old, slice *discovery.EndpointSlice) {
+	serviceName, ok := slice.Labels[discovery.LabelServiceName]
+	if !ok || c.skipProcessing(serviceName, slice.GetNamespace(), slice.ObjectMeta.Labels) ||
+		!c.discoverService(c.serviceAnnotations(slice.GetNamespace(), serviceName), c.endpointsAnnotations(slice.GetNamespace(), serviceName)) {
+		return
+	}
+	c.enqueueUpdate(kindEndpointSlice, sync.UpdateEndpointSliceAction(c.gimbalEndpointSlice(slice), serviceName))
+	c.writeEndpointSliceMetrics(slice.GetNamespace(), serviceName)
+	if c.topology && c.endpointsLister == nil {
+		c.refreshServiceTopology(slice.GetNamespace(), serviceName, c.endpointSlicesTopology(old), c.endpointSlicesTopology(slice))
+	}
+}
+
+func (c *Controller) deleteEndpointSlice(slice *discovery.EndpointSlice, tombstone bool) {
+	serviceName, ok := slice.Labels[discovery.LabelServiceName]
+	if !ok || c.skipDelete(serviceName, slice.GetNamespace(), slice.ObjectMeta.Labels) {
+		return
+	}
+	c.enqueue(c.deleteAction(kindEndpointSlice, sync.DeleteEndpointSliceAction(c.gimbalEndpointSlice(slice), serviceName), tombstone))
+	c.writeEndpointSliceMetrics(slice.GetNamespace(), serviceName)
+}
+
+// serviceEndpointSlices returns the endpoint slices of a service in the cache.
+// It returns nil if endpoint slices are not replicated.
+func (c *Controller) serviceEndpointSlices(namespace, serviceName string) []*discovery.EndpointSlice {
+	if c.endpointSliceLister == nil {
+		return nil
+	}
+	selector := labels.SelectorFromSet(labels.Set{discovery.LabelServiceName: serviceName})
+	slices, err := c.endpointSliceLister.EndpointSlices(namespace).List(selector)
+	if err != nil {
+		c.Logger.Errorf("Could not list endpoint slices of service %s/%s: %v", namespace, serviceName, err)
+		return nil
+	}
+	return slices
+}
+
+// addServiceEndpointSlices adds the endpoint slices of a service that starts
+// being discovered.
+func (c *Controller) addServiceEndpointSlices(namespace, serviceName string) {
+	slices := c.serviceEndpointSlices(namespace, serviceName)
+	for _, slice := range slices {
+		c.enqueue(sync.AddEndpointSliceAction(c.gimbalEndpointSlice(slice), serviceName))
+	}
+	if len(slices) > 0 {
+		c.writeEndpointSliceMetrics(namespace, serviceName)
+	}
+}
+
+// removeServiceEndpointSlices removes the endpoint slices of a service that
+// stops being discovered from Gimbal.
+func (c *Controller) removeServiceEndpointSlices(namespace, serviceName string) {
+	slices := c.serviceEndpointSlices(namespace, serviceName)
+	for _, slice := range slices {
+		c.enqueue(sync.DeleteEndpointSliceAction(c.gimbalEndpointSlice(slice), serviceName))
+	}
+	if len(slices) > 0 {
+		c.metrics.DiscovererUpstreamEndpointsMetric(c.gimbalNamespace(namespace), serviceName, 0)
+	}
+}
+
+// gimbalEndpointSlice returns the Gimbal endpoint slice of the remote slice
+func (c *Controller) gimbalEndpointSlice(slice *discovery.EndpointSlice) *discovery.EndpointSlice {
+	return translateEndpointSlice(slice, c.backendName, c.gimbalNamespace(slice.GetNamespace()), c.policy)
+}
+
+// writeEndpointSliceMetrics records the number of upstream endpoints of a
+// service, summed over all of its endpoint slices.
+func (c *Controller) writeEndpointSliceMetrics(namespace, serviceName string) {
+	total := 0
+	for _, slice := range c.serviceEndpointSlices(namespace, serviceName) {
+		total += sync.SumEndpointSlice(slice)
+	}
+	c.metrics.DiscovererUpstreamEndpointsMetric(c.gimbalNamespace(namespace), serviceName, total)
+}
@@ -0,0 +1,145 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseEndpointsMode(t *testing.T) {
+	for _, mode := range []string{"endpoints", "endpointslices", "both"} {
+		got, err := ParseEndpointsMode(mode)
+		assert.NoError(t, err)
+		assert.Equal(t, EndpointsMode(mode), got)
+	}
+	_, err := ParseEndpointsMode("slices")
+	assert.Error(t, err)
+}
+
+func TestEndpointSlices(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+	optedOut := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1",
+		Annotations: map[string]string{DiscoverAnnotation: "false"}}}
+	ep := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+	slice := &discovery.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Name: "test-abcde", Namespace: "team1",
+		Labels: map[string]string{discovery.LabelServiceName: "test"}}}
+	unowned := &discovery.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Name: "custom", Namespace: "team1"}}
+	kubernetes := &discovery.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Name: "kubernetes", Namespace: "default",
+		Labels: map[string]string{discovery.LabelServiceName: "kubernetes"}}}
+
+	tests := []struct {
+		name            string
+		mode            EndpointsMode
+		update          func(c *Controller)
+		expectedActions []string
+	}{
+		{
+			name:            "add slice",
+			mode:            EndpointsModeEndpointSlices,
+			update:          func(c *Controller) { c.addEndpointSlice(slice) },
+			expectedActions: []string{"add endpointslice 'team1/backend-test-abcde'"},
+		},
+		{
+			name:   "add slice without service",
+			mode:   EndpointsModeEndpointSlices,
+			update: func(c *Controller) { c.addEndpointSlice(unowned) },
+		},
+		{
+			name:   "add kubernetes service slice",
+			mode:   EndpointsModeEndpointSlices,
+			update: func(c *Controller) { c.addEndpointSlice(kubernetes) },
+		},
+		{
+			name:            "delete slice",
+			mode:            EndpointsModeEndpointSlices,
+			update:          func(c *Controller) { c.deleteEndpointSlice(slice, false) },
+			expectedActions: []string{"delete endpointslice 'team1/backend-test-abcde'"},
+		},
+		{
+			name: "service opts out",
+			mode: EndpointsModeBoth,
+			update: func(c *Controller) {
+				c.updateService(svc, optedOut)
+			},
+			expectedActions: []string{
+				"delete service 'team1/backend-test'",
+				"delete endpointslice 'team1/backend-test-abcde'",
+				"delete endpoints 'team1/backend-test'",
+			},
+		},
+		{
+			name:   "endpoints only",
+			update: func(c *Controller) { c.addService(svc) },
+			expectedActions: []string{
+				"add service 'team1/backend-test'",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := localmetrics.NewMetrics("backendtype", "backend")
+			client := fake.NewSimpleClientset()
+			informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+			c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "backend", metrics,
+				Options{NamespaceFilter: defaultNamespaceFilter(), EndpointsMode: tc.mode})
+
+			// Populate the caches without running the event handlers
+			if err := informer.Core().V1().Services().Informer().GetIndexer().Add(svc); err != nil {
+				t.Fatal(err)
+			}
+			if err := informer.Core().V1().Endpoints().Informer().GetIndexer().Add(ep); err != nil {
+				t.Fatal(err)
+			}
+			if err := informer.Discovery().V1beta1().EndpointSlices().Informer().GetIndexer().Add(slice); err != nil {
+				t.Fatal(err)
+			}
+
+			tc.update(c)
+
+			var got []string
+			time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+			for c.syncqueue.Workqueue.Len() > 0 {
+				item, _ := c.syncqueue.Workqueue.Get()
+				got = append(got, fmt.Sprint(item))
+				c.syncqueue.Workqueue.Done(item)
+			}
+			assert.Equal(t, tc.expectedActions, got)
+		})
+	}
+}
+
+func TestGimbalEndpointsSkipMirror(t *testing.T) {
+	ep := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+	for mode, expected := range map[EndpointsMode]bool{
+		EndpointsModeEndpoints: false,
+		EndpointsModeBoth:      true,
+	} {
+		c := &Controller{backendName: "backend", endpointsMode: mode}
+		_, ok := c.gimbalEndpoints(ep).Labels[endpointSliceSkipMirrorLabel]
+		assert.Equal(t, expected, ok, "mode %s", mode)
+	}
+}
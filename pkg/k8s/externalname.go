@@ -0,0 +1,227 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/translator"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// externalNameLookupTimeout bounds the DNS lookup of an external name
+	externalNameLookupTimeout = 5 * time.Second
+	// externalNameWorkers bounds the number of external names resolved
+	// concurrently by a controller
+	externalNameWorkers = 4
+)
+
+// ExternalNameMode determines how ExternalName services are replicated.
+type ExternalNameMode string
+
+const (
+	// ExternalNameModeService replicates ExternalName services as
+	// ExternalName services.
+	ExternalNameModeService ExternalNameMode = "externalname"
+	// ExternalNameModeResolve replicates ExternalName services as headless
+	// services, whose endpoints are the addresses the external name resolves
+	// to.
+	ExternalNameModeResolve ExternalNameMode = "resolve"
+)
+
+// ParseExternalNameMode returns the ExternalNameMode with the given name.
+func ParseExternalNameMode(mode string) (ExternalNameMode, error) {
+	switch ExternalNameMode(mode) {
+	case ExternalNameModeService, ExternalNameModeResolve:
+		return ExternalNameMode(mode), nil
+	}
+	return "", fmt.Errorf("invalid external name mode %q, must be one of %q or %q", mode,
+		ExternalNameModeService, ExternalNameModeResolve)
+}
+
+// isExternalName returns true if the service is an ExternalName service
+func isExternalName(svc *v1.Service) bool {
+	return svc.Spec.Type == v1.ServiceTypeExternalName
+}
+
+// isSelectorless returns true if the endpoints of the service are managed by
+// hand rather than by the endpoints controller, typically to front addresses
+// outside of the cluster. ExternalName services do not have endpoints at all.
+func isSelectorless(svc *v1.Service) bool {
+	return len(svc.Spec.Selector) == 0 && !isExternalName(svc)
+}
+
+// resolvesExternalName returns true if the Gimbal endpoints of the service
+// are resolved from its external name.
+func (c *Controller) resolvesExternalName(svc *v1.Service) bool {
+	return isExternalName(svc) && c.externalNameMode == ExternalNameModeResolve
+}
+
+// addExternalNameEndpoints queues the resolution of the external name of the
+// service. The external name workers write the addresses it resolves to as the
+// endpoints of the Gimbal service, so that slow lookups do not hold up the
+// event handlers.
+func (c *Controller) addExternalNameEndpoints(svc *v1.Service) {
+	if !c.resolvesExternalName(svc) || c.endpointsMode == EndpointsModeEndpointSlices {
+		return
+	}
+	c.externalNames.Add(objectKey(&svc.ObjectMeta))
+}
+
+// removeExternalNameEndpoints removes the endpoints resolved from the external
+// name of the service from Gimbal.
+func (c *Controller) removeExternalNameEndpoints(svc *v1.Service) {
+	if !c.resolvesExternalName(svc) || c.endpointsMode == EndpointsModeEndpointSlices {
+		return
+	}
+	c.resolvedMu.Lock()
+	delete(c.resolved, objectKey(&svc.ObjectMeta))
+	c.resolvedMu.Unlock()
+	c.enqueue(sync.DeleteEndpointsAction(c.gimbalExternalNameEndpoints(svc, nil), svc.GetName()))
+	c.metrics.DiscovererUpstreamEndpointsMetric(c.gimbalNamespace(svc.GetNamespace()), svc.GetName(), 0)
+}
+
+// runExternalNameWorkers resolves the queued external names with a bounded
+// number of workers, until the stop channel is closed.
+func (c *Controller) runExternalNameWorkers(stopCh <-chan struct{}) {
+	defer c.externalNames.ShutDown()
+	for i := 0; i < externalNameWorkers; i++ {
+		go wait.Until(c.runExternalNameWorker, time.Second, stopCh)
+	}
+	<-stopCh
+}
+
+// runExternalNameWorker resolves queued external names until the queue is
+// shut down.
+func (c *Controller) runExternalNameWorker() {
+	for c.processNextExternalName() {
+	}
+}
+
+// processNextExternalName resolves the external name of the next queued
+// service. It returns false once the queue is shut down.
+func (c *Controller) processNextExternalName() bool {
+	key, shutdown := c.externalNames.Get()
+	if shutdown {
+		return false
+	}
+	defer c.externalNames.Done(key)
+	c.syncExternalName(key.(string))
+	return true
+}
+
+// syncExternalName resolves the external name of the service with the given
+// key, and writes the endpoints of the Gimbal service if its addresses
+// changed. The endpoints are not written if the lookup fails, so that the
+// previous addresses are kept until it succeeds.
+func (c *Controller) syncExternalName(key string) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return
+	}
+	svc, err := c.serviceLister.Services(namespace).Get(name)
+	if err != nil ||
+		c.skipProcessing(svc.GetName(), svc.GetNamespace(), svc.ObjectMeta.Labels) ||
+		!c.discoverService(svc.GetAnnotations(), c.endpointsAnnotations(svc.GetNamespace(), svc.GetName())) ||
+		!c.resolvesExternalName(svc) {
+		return
+	}
+
+	ep, err := c.externalNameEndpoints(svc)
+	if err != nil {
+		c.metrics.ServiceMetricError(c.gimbalNamespace(svc.GetNamespace()), svc.GetName(), "ResolveExternalName")
+		c.Logger.Errorf("Could not resolve external name of service %s/%s of backend %s: %v", svc.GetNamespace(), svc.GetName(), c.backendName, err)
+		return
+	}
+
+	c.resolvedMu.Lock()
+	previous, ok := c.resolved[key]
+	c.resolved[key] = ep
+	c.resolvedMu.Unlock()
+	if ok && equality.Semantic.DeepEqual(previous, ep) {
+		return
+	}
+	c.enqueue(sync.UpdateEndpointsAction(ep, svc.GetName()))
+	c.metrics.DiscovererUpstreamEndpointsMetric(c.gimbalNamespace(svc.GetNamespace()), svc.GetName(), sync.SumEndpoints(ep))
+}
+
+// resolvedEndpoints returns the endpoints last resolved from the external name
+// of the service with the given key, and queues its resolution again so that
+// DNS changes are picked up. It returns false if the name was not resolved
+// yet.
+func (c *Controller) resolvedEndpoints(key string) (*v1.Endpoints, bool) {
+	c.externalNames.Add(key)
+	c.resolvedMu.Lock()
+	defer c.resolvedMu.Unlock()
+	ep, ok := c.resolved[key]
+	return ep, ok
+}
+
+// externalNameEndpoints returns the Gimbal endpoints of an ExternalName
+// service, with the addresses its external name resolves to.
+func (c *Controller) externalNameEndpoints(svc *v1.Service) (*v1.Endpoints, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), externalNameLookupTimeout)
+	defer cancel()
+	addrs, err := c.lookupIPAddr(ctx, svc.Spec.ExternalName)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP.String())
+	}
+	return c.gimbalExternalNameEndpoints(svc, ips), nil
+}
+
+// gimbalExternalNameEndpoints returns the Gimbal endpoints of an ExternalName
+// service, which listen on the ports of the service. The endpoints are labelled
+// like the service, as the endpoints controller does.
+func (c *Controller) gimbalExternalNameEndpoints(svc *v1.Service, ips []string) *v1.Endpoints {
+	var addresses []v1.EndpointAddress
+	for _, ip := range ips {
+		addresses = append(addresses, v1.EndpointAddress{IP: ip})
+	}
+	var ports []v1.EndpointPort
+	for _, p := range svc.Spec.Ports {
+		ports = append(ports, v1.EndpointPort{Name: p.Name, Port: p.Port, Protocol: p.Protocol})
+	}
+
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: c.gimbalNamespace(svc.GetNamespace()),
+			Name:      translator.BuildDiscoveredName(c.backendName, svc.GetName()),
+			Labels:    translator.AddGimbalLabels(c.backendName, svc.GetName(), svc.GetLabels()),
+		},
+		Subsets: buildSubsets(addresses, ports),
+	}
+}
+
+// lookupIPAddr resolves the host with the resolver of the controller, which
+// defaults to the system resolver.
+func (c *Controller) lookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if c.resolver == nil {
+		return net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+	return c.resolver(ctx, host)
+}
@@ -0,0 +1,291 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestTranslateExternalNameService(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "db"},
+		Spec: v1.ServiceSpec{
+			Type:         v1.ServiceTypeExternalName,
+			ExternalName: "db.example.com",
+			Ports:        []v1.ServicePort{{Name: "pg", Port: 5432}},
+		},
+	}
+
+	got := translateService(svc, "cluster1", "team1", nil, AddressModeNodePort, ExternalNameModeService)
+	assert.Equal(t, v1.ServiceSpec{
+		Type:         v1.ServiceTypeExternalName,
+		ExternalName: "db.example.com",
+		Ports:        []v1.ServicePort{{Name: "pg", Port: 5432}},
+	}, got.Spec)
+
+	got = translateService(svc, "cluster1", "team1", nil, AddressModeNodePort, ExternalNameModeResolve)
+	assert.Equal(t, v1.ServiceSpec{
+		Type:      v1.ServiceTypeClusterIP,
+		ClusterIP: "None",
+		Ports:     []v1.ServicePort{{Name: "pg", Port: 5432}},
+	}, got.Spec)
+}
+
+func TestSelectorlessService(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "db"},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeNodePort,
+			Ports: []v1.ServicePort{{Name: "pg", Port: 5432, NodePort: 30432}},
+		},
+	}
+	ep := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "db"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "203.0.113.10"}},
+			Ports:     []v1.EndpointPort{{Name: "pg", Port: 5432}},
+		}},
+	}
+
+	metrics := localmetrics.NewMetrics("backendtype", "backend")
+	client := fake.NewSimpleClientset()
+	informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+	c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "backend", metrics,
+		Options{AddressMode: AddressModeNodePort})
+	if err := informer.Core().V1().Services().Informer().GetIndexer().Add(svc); err != nil {
+		t.Fatal(err)
+	}
+
+	// The manually managed endpoints are replicated as they are
+	assert.Equal(t, ep.Subsets, c.gimbalEndpoints(ep).Subsets)
+	assert.Equal(t, []v1.ServicePort{{Name: "pg", Port: 5432}}, c.gimbalService(svc).Spec.Ports)
+}
+
+func TestResolveExternalName(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "db", Labels: map[string]string{"app": "db"}},
+		Spec: v1.ServiceSpec{
+			Type:         v1.ServiceTypeExternalName,
+			ExternalName: "db.example.com",
+			Ports:        []v1.ServicePort{{Name: "pg", Port: 5432, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	resolved := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("203.0.113.11")}, {IP: net.ParseIP("203.0.113.10")}}, nil
+	}
+	unresolved := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return nil, fmt.Errorf("no such host")
+	}
+
+	tests := []struct {
+		name            string
+		resolver        func(ctx context.Context, host string) ([]net.IPAddr, error)
+		setup           func(c *Controller)
+		update          func(c *Controller)
+		expectedActions []string
+	}{
+		{
+			name:     "add",
+			resolver: resolved,
+			update:   func(c *Controller) { c.addService(svc) },
+			expectedActions: []string{
+				"add service 'team1/cluster1-db'",
+				"update endpoints 'team1/cluster1-db'",
+			},
+		},
+		{
+			name:     "add unresolved",
+			resolver: unresolved,
+			update:   func(c *Controller) { c.addService(svc) },
+			expectedActions: []string{
+				"add service 'team1/cluster1-db'",
+			},
+		},
+		{
+			name:     "change type",
+			resolver: resolved,
+			setup: func(c *Controller) {
+				c.addService(svc)
+				c.processNextExternalName()
+				queuedActions(c)
+			},
+			update: func(c *Controller) {
+				clusterIP := svc.DeepCopy()
+				clusterIP.Spec = v1.ServiceSpec{Type: v1.ServiceTypeClusterIP, Selector: map[string]string{"app": "db"}}
+				c.updateService(svc, clusterIP)
+				assert.Empty(t, c.resolved)
+			},
+			expectedActions: []string{
+				"delete endpoints 'team1/cluster1-db'",
+				"update service 'team1/cluster1-db'",
+			},
+		},
+		{
+			name:     "delete",
+			resolver: unresolved,
+			update:   func(c *Controller) { c.deleteService(svc, false) },
+			expectedActions: []string{
+				"delete endpoints 'team1/cluster1-db'",
+				"delete service 'team1/cluster1-db'",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := localmetrics.NewMetrics("backendtype", "cluster1")
+			client := fake.NewSimpleClientset()
+			informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+			c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "cluster1", metrics,
+				Options{ExternalNameMode: ExternalNameModeResolve})
+			lookups := 0
+			c.resolver = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+				lookups++
+				return tc.resolver(ctx, host)
+			}
+			if err := informer.Core().V1().Services().Informer().GetIndexer().Add(svc); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.setup != nil {
+				tc.setup(c)
+				lookups = 0
+			}
+			tc.update(c)
+
+			// The event handlers only queue the external name, which is
+			// resolved by the external name workers
+			assert.Equal(t, 0, lookups)
+			for c.externalNames.Len() > 0 {
+				c.processNextExternalName()
+			}
+
+			var got []string
+			time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+			for c.syncqueue.Workqueue.Len() > 0 {
+				item, _ := c.syncqueue.Workqueue.Get()
+				got = append(got, fmt.Sprint(item))
+				c.syncqueue.Workqueue.Done(item)
+			}
+			sort.Strings(got)
+			assert.Equal(t, tc.expectedActions, got)
+		})
+	}
+
+	// The endpoints listen on the ports of the service
+	c := &Controller{backendName: "cluster1", resolver: resolved}
+	ep, err := c.externalNameEndpoints(svc)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"app":                              "db",
+		"gimbal.projectcontour.io/backend": "cluster1",
+		"gimbal.projectcontour.io/service": "db",
+	}, ep.Labels)
+	assert.Equal(t, []v1.EndpointSubset{{
+		Addresses: []v1.EndpointAddress{{IP: "203.0.113.10"}, {IP: "203.0.113.11"}},
+		Ports:     []v1.EndpointPort{{Name: "pg", Port: 5432, Protocol: v1.ProtocolTCP}},
+	}}, ep.Subsets)
+}
+
+func TestReconcileUnresolvedExternalName(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "db"},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "db.example.com"},
+	}
+	labels := map[string]string{
+		"gimbal.projectcontour.io/backend": "cluster1",
+		"gimbal.projectcontour.io/service": "db",
+	}
+	gimbalObjects := []runtime.Object{
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "cluster1-db", Labels: labels},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeClusterIP, ClusterIP: "None"},
+		},
+		&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "cluster1-db", Labels: labels}},
+	}
+
+	metrics := localmetrics.NewMetrics("backendtype", "cluster1")
+	informer := kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(svc), time.Second*0)
+	c := NewController(logrus.New(), sync.NewQueue(logrus.New(), fake.NewSimpleClientset(gimbalObjects...), 1, metrics),
+		informer, "cluster1", metrics, Options{ExternalNameMode: ExternalNameModeResolve})
+	c.resolver = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return nil, fmt.Errorf("no such host")
+	}
+	if err := informer.Core().V1().Services().Informer().GetIndexer().Add(svc); err != nil {
+		t.Fatal(err)
+	}
+
+	c.reconcile()
+
+	// The service is up to date, and its endpoints are kept until the name
+	// resolves again
+	assert.Empty(t, queuedActions(c))
+	assert.Equal(t, 1, c.externalNames.Len())
+	c.processNextExternalName()
+	assert.Empty(t, queuedActions(c))
+}
+
+func TestResolveExternalNameChanges(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "db"},
+		Spec: v1.ServiceSpec{
+			Type:         v1.ServiceTypeExternalName,
+			ExternalName: "db.example.com",
+			Ports:        []v1.ServicePort{{Name: "pg", Port: 5432, Protocol: v1.ProtocolTCP}},
+		},
+	}
+
+	metrics := localmetrics.NewMetrics("backendtype", "cluster1")
+	client := fake.NewSimpleClientset()
+	informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+	c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "cluster1", metrics,
+		Options{ExternalNameMode: ExternalNameModeResolve})
+	if err := informer.Core().V1().Services().Informer().GetIndexer().Add(svc); err != nil {
+		t.Fatal(err)
+	}
+
+	// The endpoints are only written again when the addresses change
+	var addresses []net.IPAddr
+	c.resolver = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return addresses, nil
+	}
+	for _, tc := range []struct {
+		addresses       []net.IPAddr
+		expectedActions []string
+	}{
+		{addresses: []net.IPAddr{{IP: net.ParseIP("203.0.113.10")}}, expectedActions: []string{"update"}},
+		{addresses: []net.IPAddr{{IP: net.ParseIP("203.0.113.10")}}},
+		{addresses: []net.IPAddr{{IP: net.ParseIP("203.0.113.11")}}, expectedActions: []string{"update"}},
+	} {
+		addresses = tc.addresses
+		c.addExternalNameEndpoints(svc)
+		c.processNextExternalName()
+		assert.Equal(t, tc.expectedActions, queuedActions(c))
+	}
+}
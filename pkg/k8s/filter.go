@@ -0,0 +1,176 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// DiscoverAnnotation is the annotation that remote services and
+	// endpoints use to opt in or out of discovery.
+	DiscoverAnnotation = "gimbal.projectcontour.io/discover"
+)
+
+// DiscoveryMode determines whether remote services are discovered by default.
+type DiscoveryMode string
+
+const (
+	// DiscoveryOptOut discovers all services, except the ones that opt out
+	// with a "false" discover annotation.
+	DiscoveryOptOut DiscoveryMode = "opt-out"
+	// DiscoveryOptIn only discovers the services that opt in with a "true"
+	// discover annotation.
+	DiscoveryOptIn DiscoveryMode = "opt-in"
+)
+
+// ParseDiscoveryMode returns the DiscoveryMode with the given name.
+func ParseDiscoveryMode(mode string) (DiscoveryMode, error) {
+	switch DiscoveryMode(mode) {
+	case DiscoveryOptOut, DiscoveryOptIn:
+		return DiscoveryMode(mode), nil
+	}
+	return "", fmt.Errorf("invalid discovery mode %q, must be one of %q or %q", mode, DiscoveryOptOut, DiscoveryOptIn)
+}
+
+// discoverService determines if a service and its endpoints are discovered
+// according to the discover annotations on both. A service opts out if either
+// of them is annotated "false", and opts in if either is annotated "true".
+func (c *Controller) discoverService(serviceAnnotations, endpointsAnnotations map[string]string) bool {
+	svcDiscover, svcSet := discoverAnnotation(serviceAnnotations)
+	epDiscover, epSet := discoverAnnotation(endpointsAnnotations)
+	if (svcSet && !svcDiscover) || (epSet && !epDiscover) {
+		return false
+	}
+	if c.discoveryMode == DiscoveryOptIn {
+		return svcSet || epSet
+	}
+	return true
+}
+
+// discoverAnnotation returns the value of the discover annotation, and whether
+// it is set to a valid boolean.
+func discoverAnnotation(annotations map[string]string) (discover bool, ok bool) {
+	v, ok := annotations[DiscoverAnnotation]
+	if !ok {
+		return false, false
+	}
+	discover, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, false
+	}
+	return discover, true
+}
+
+// NamespaceFilter selects the remote namespaces that are discovered. A
+// namespace is discovered if it matches one of the include patterns (or there
+// are none), does not match any of the exclude patterns, and its labels match
+// the selector.
+type NamespaceFilter struct {
+	include  []namespaceMatcher
+	exclude  []namespaceMatcher
+	selector labels.Selector
+}
+
+type namespaceMatcher func(namespace string) bool
+
+// NewNamespaceFilter returns a NamespaceFilter built from lists of include and
+// exclude patterns, and a label selector. Patterns are shell globs (e.g.
+// "team-*"), or regular expressions when enclosed in slashes (e.g.
+// "/^ci-[0-9]+$/"). An empty selector matches all namespaces.
+func NewNamespaceFilter(include, exclude []string, selector string) (*NamespaceFilter, error) {
+	var err error
+	f := &NamespaceFilter{}
+	if f.include, err = namespaceMatchers(include); err != nil {
+		return nil, fmt.Errorf("invalid namespace include pattern: %v", err)
+	}
+	if f.exclude, err = namespaceMatchers(exclude); err != nil {
+		return nil, fmt.Errorf("invalid namespace exclude pattern: %v", err)
+	}
+	if f.selector, err = labels.Parse(selector); err != nil {
+		return nil, fmt.Errorf("invalid namespace selector: %v", err)
+	}
+	return f, nil
+}
+
+func namespaceMatchers(patterns []string) ([]namespaceMatcher, error) {
+	var matchers []namespaceMatcher
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			re, err := regexp.Compile(p[1 : len(p)-1])
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, re.MatchString)
+			continue
+		}
+		// Validate the glob up front, path.Match only reports a bad pattern
+		// when it gets to the offending part of it.
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("%q: %v", p, err)
+		}
+		glob := p
+		matchers = append(matchers, func(namespace string) bool {
+			ok, _ := path.Match(glob, namespace)
+			return ok
+		})
+	}
+	return matchers, nil
+}
+
+// MatchesName returns true if the namespace name is selected by the include
+// and exclude patterns. The label selector is not taken into account.
+func (f *NamespaceFilter) MatchesName(namespace string) bool {
+	if f == nil {
+		return true
+	}
+	for _, m := range f.exclude {
+		if m(namespace) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, m := range f.include {
+		if m(namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasSelector returns true if the filter selects namespaces by their labels.
+func (f *NamespaceFilter) HasSelector() bool {
+	return f != nil && f.selector != nil && !f.selector.Empty()
+}
+
+// Matches returns true if the namespace with the given name and labels is
+// selected by the filter.
+func (f *NamespaceFilter) Matches(namespace string, nsLabels map[string]string) bool {
+	if !f.MatchesName(namespace) {
+		return false
+	}
+	return !f.HasSelector() || f.selector.Matches(labels.Set(nsLabels))
+}
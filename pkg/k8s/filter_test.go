@@ -0,0 +1,107 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaceFilter(t *testing.T) {
+	tests := []struct {
+		name      string
+		include   []string
+		exclude   []string
+		selector  string
+		namespace string
+		labels    map[string]string
+		expected  bool
+	}{
+		{
+			name:      "no filter",
+			namespace: "team1",
+			expected:  true,
+		},
+		{
+			name:      "excluded namespace",
+			exclude:   []string{"kube-system"},
+			namespace: "kube-system",
+			expected:  false,
+		},
+		{
+			name:      "included by glob",
+			include:   []string{"team-*"},
+			namespace: "team-a",
+			expected:  true,
+		},
+		{
+			name:      "not included by glob",
+			include:   []string{"team-*"},
+			namespace: "monitoring",
+			expected:  false,
+		},
+		{
+			name:      "exclude wins over include",
+			include:   []string{"team-*"},
+			exclude:   []string{"/^team-ci-[0-9]+$/"},
+			namespace: "team-ci-42",
+			expected:  false,
+		},
+		{
+			name:      "included by regex",
+			include:   []string{"/^(prod|stage)-/"},
+			namespace: "stage-payments",
+			expected:  true,
+		},
+		{
+			name:      "blank patterns are ignored",
+			include:   []string{" ", ""},
+			namespace: "team1",
+			expected:  true,
+		},
+		{
+			name:      "selector matches",
+			selector:  "gimbal=enabled",
+			namespace: "team1",
+			labels:    map[string]string{"gimbal": "enabled"},
+			expected:  true,
+		},
+		{
+			name:      "selector does not match",
+			selector:  "gimbal=enabled",
+			namespace: "team1",
+			expected:  false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := NewNamespaceFilter(tc.include, tc.exclude, tc.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tc.expected, f.Matches(tc.namespace, tc.labels))
+		})
+	}
+}
+
+func TestNamespaceFilterInvalid(t *testing.T) {
+	_, err := NewNamespaceFilter([]string{"/team-(/"}, nil, "")
+	assert.Error(t, err)
+	_, err = NewNamespaceFilter(nil, []string{"team-["}, "")
+	assert.Error(t, err)
+	_, err = NewNamespaceFilter(nil, nil, "gimbal in (")
+	assert.Error(t, err)
+}
@@ -0,0 +1,311 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/projectcontour/gimbal/pkg/health"
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/util"
+	"github.com/sirupsen/logrus"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+)
+
+// BackendManager runs a Controller for each remote Kubernetes cluster that
+// must be discovered, starting and stopping controllers as the set of backends
+// changes, and restarting them when their kubeconfig file changes. All
+// controllers share the same sync queue, and thus the same Gimbal client.
+type BackendManager struct {
+	Logger         *logrus.Logger
+	ResyncInterval time.Duration
+	Options        Options
+
+	syncqueue sync.Queue
+	metrics   localmetrics.DiscovererMetrics
+	newClient func(kubeCfgFile string, logger *logrus.Logger) (kubernetes.Interface, error)
+
+	mu       gosync.Mutex
+	backends map[string]*backend
+}
+
+// backend is a running controller for a single remote cluster
+type backend struct {
+	kubeCfgFile string
+	// checksum is the checksum of the contents of the kubeconfig file the
+	// controller was started with
+	checksum   string
+	stopCh     chan struct{}
+	client     kubernetes.Interface
+	controller *Controller
+}
+
+// NewBackendManager returns a BackendManager that writes to the given sync
+// queue. The caller is responsible for running the queue. The options are
+// used for the controllers of all backends.
+func NewBackendManager(log *logrus.Logger, syncqueue sync.Queue, resyncInterval time.Duration, options Options,
+	metrics localmetrics.DiscovererMetrics) *BackendManager {
+	return &BackendManager{
+		Logger:         log,
+		ResyncInterval: resyncInterval,
+		Options:        options,
+		syncqueue:      syncqueue,
+		metrics:        metrics,
+		newClient:      NewClient,
+		backends:       map[string]*backend{},
+	}
+}
+
+// Start starts discovering the backend with the given name using the
+// kubeconfig file. Starting a backend that is already running is a no-op,
+// unless the contents of its kubeconfig file changed, in which case it is
+// restarted with the new credentials. If the new kubeconfig cannot be used,
+// the backend keeps running with the previous one.
+func (m *BackendManager) Start(backendName, kubeCfgFile string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.start(backendName, kubeCfgFile)
+}
+
+func (m *BackendManager) start(backendName, kubeCfgFile string) error {
+	// Failing to read the file is left to the client to report
+	checksum, _ := util.FilesChecksum(kubeCfgFile)
+	running, ok := m.backends[backendName]
+	if ok && running.checksum == checksum {
+		return nil
+	}
+
+	client, err := m.newClient(kubeCfgFile, m.Logger)
+	if err != nil {
+		return fmt.Errorf("could not init k8s discoverer client for backend %s: %v", backendName, err)
+	}
+
+	// The objects replicated from the backend are left in Gimbal, the new
+	// controller reconciles them once its caches are synced.
+	if ok {
+		m.Logger.Infof("Kubeconfig file of backend %s changed, restarting it", backendName)
+		metrics := m.metrics.WithBackendName(backendName)
+		metrics.CredentialsReloadMetric()
+		m.stop(backendName)
+	}
+
+	m.Logger.Infof("Starting backend %s, resync interval is: %v", backendName, m.ResyncInterval)
+	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(client, m.ResyncInterval)
+	c := NewController(m.Logger, m.syncqueue, kubeInformerFactory, backendName, m.metrics.WithBackendName(backendName), m.Options)
+
+	b := &backend{kubeCfgFile: kubeCfgFile, checksum: checksum, stopCh: make(chan struct{}), client: client, controller: c}
+	m.backends[backendName] = b
+
+	go kubeInformerFactory.Start(b.stopCh)
+	go func() {
+		if err := c.Run(b.stopCh); err != nil {
+			m.Logger.Errorf("Error running controller for backend %s: %v", backendName, err)
+		}
+	}()
+	return nil
+}
+
+// Sync makes the set of running backends match the desired set, which maps
+// backend names to kubeconfig files. Backends that are not running are
+// started, running backends that are no longer desired are stopped, and
+// backends whose kubeconfig file changed are restarted.
+func (m *BackendManager) Sync(desired map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name, b := range m.backends {
+		if kubeCfgFile, ok := desired[name]; !ok || kubeCfgFile != b.kubeCfgFile {
+			m.stop(name)
+		}
+	}
+	for name, kubeCfgFile := range desired {
+		if err := m.start(name, kubeCfgFile); err != nil {
+			metrics := m.metrics.WithBackendName(name)
+			metrics.GenericMetricError("StartBackend")
+			m.Logger.Error(err)
+		}
+	}
+}
+
+// Backends returns the names of the running backends.
+func (m *BackendManager) Backends() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var names []string
+	for name := range m.backends {
+		names = append(names, name)
+	}
+	return names
+}
+
+// HealthChecks returns the readiness checks of the running backends: that
+// the caches of their controller are synced, that their API server is
+// reachable, and that they received events from it recently. If maxEventAge is
+// zero, the age of the last event is reported without failing the check.
+func (m *BackendManager) HealthChecks(maxEventAge time.Duration) []health.Check {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var names []string
+	for name := range m.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var checks []health.Check
+	for _, name := range names {
+		b := m.backends[name]
+		checks = append(checks,
+			health.Check{
+				Name: "backend/" + name + "/synced",
+				Run: func() (string, error) {
+					if !b.controller.HasSynced() {
+						return "", fmt.Errorf("caches are not synced")
+					}
+					return "caches are synced", nil
+				},
+			},
+			health.APIServerCheck("backend/"+name+"/api", b.client),
+			health.Check{
+				Name: "backend/" + name + "/events",
+				Run: func() (string, error) {
+					last := b.controller.LastEvent()
+					if last.IsZero() {
+						return "no event received", nil
+					}
+					age := time.Since(last)
+					detail := fmt.Sprintf("last event %v ago", age.Round(time.Second))
+					if maxEventAge > 0 && age > maxEventAge {
+						return detail, fmt.Errorf("no event received for more than %v", maxEventAge)
+					}
+					return detail, nil
+				},
+			},
+		)
+	}
+	return checks
+}
+
+// Stop stops all running backends.
+func (m *BackendManager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name := range m.backends {
+		m.stop(name)
+	}
+}
+
+func (m *BackendManager) stop(backendName string) {
+	m.Logger.Infof("Stopping backend %s", backendName)
+	close(m.backends[backendName].stopCh)
+	delete(m.backends, backendName)
+}
+
+// WatchDir syncs the running backends with the kubeconfig files found in dir
+// every period, until stopCh is closed. See KubeCfgFilesInDir for how files
+// map to backends.
+func (m *BackendManager) WatchDir(dir string, period time.Duration, stopCh <-chan struct{}) {
+	m.watch(func() (map[string]string, error) {
+		desired, err := KubeCfgFilesInDir(dir, m.Logger)
+		if err != nil {
+			m.metrics.GenericMetricError("ReadKubeCfgDir")
+			return nil, fmt.Errorf("error reading kubeconfig directory %s: %v", dir, err)
+		}
+		return desired, nil
+	}, period, stopCh)
+}
+
+// WatchFile runs the backend with the given name using the kubeconfig file,
+// and restarts it when the file changes, checking every period until stopCh is
+// closed.
+func (m *BackendManager) WatchFile(backendName, kubeCfgFile string, period time.Duration, stopCh <-chan struct{}) {
+	m.watch(func() (map[string]string, error) {
+		return map[string]string{backendName: kubeCfgFile}, nil
+	}, period, stopCh)
+}
+
+// watch syncs the running backends with the desired ones every period, until
+// stopCh is closed.
+func (m *BackendManager) watch(desired func() (map[string]string, error), period time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		if backends, err := desired(); err != nil {
+			m.Logger.Error(err)
+		} else {
+			m.Sync(backends)
+		}
+
+		select {
+		case <-stopCh:
+			m.Stop()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// KubeCfgFilesInDir returns the kubeconfig files in dir, keyed by backend
+// name. The backend name is the file name without its extension. Hidden files
+// and directories, such as the "..data" links of mounted secrets, are skipped,
+// as are files whose name is not a valid backend name. Files that have the
+// same backend name, such as cluster1 and cluster1.yaml, are all skipped, as
+// none of them can be picked over the others.
+func KubeCfgFilesInDir(dir string, log *logrus.Logger) (map[string]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := map[string][]string{}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		// Stat the path instead of using f so that symlinks are followed
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		backendName := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		if util.IsInvalidBackendName(backendName) {
+			log.Warnf("Ignoring kubeconfig file %s: %q is not a valid backend name", path, backendName)
+			continue
+		}
+		paths[backendName] = append(paths[backendName], path)
+	}
+
+	kubeCfgFiles := map[string]string{}
+	for backendName, p := range paths {
+		if len(p) > 1 {
+			log.Warnf("Ignoring kubeconfig files %s: they all have the backend name %q", strings.Join(p, ", "), backendName)
+			continue
+		}
+		kubeCfgFiles[backendName] = p[0]
+	}
+	return kubeCfgFiles, nil
+}
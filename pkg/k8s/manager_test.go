@@ -0,0 +1,201 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/projectcontour/gimbal/pkg/health"
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestKubeCfgFilesInDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubecfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// cluster4 and cluster4.yaml have the same backend name, so both are
+	// ignored
+	for _, name := range []string{"cluster1", "cluster2.yaml", ".hidden", "Invalid_Name", "cluster4", "cluster4.yaml"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "..data"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "cluster1"), filepath.Join(dir, "cluster3")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := KubeCfgFilesInDir(dir, logrus.New())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"cluster1": filepath.Join(dir, "cluster1"),
+		"cluster2": filepath.Join(dir, "cluster2.yaml"),
+		"cluster3": filepath.Join(dir, "cluster3"),
+	}, got)
+}
+
+func TestBackendManagerSync(t *testing.T) {
+	tests := []struct {
+		name     string
+		running  map[string]string
+		desired  map[string]string
+		expected []string
+		started  []string
+	}{
+		{
+			name:     "start backends",
+			desired:  map[string]string{"cluster1": "/cfg/cluster1", "cluster2": "/cfg/cluster2"},
+			expected: []string{"cluster1", "cluster2"},
+			started:  []string{"/cfg/cluster1", "/cfg/cluster2"},
+		},
+		{
+			name:     "stop removed backend",
+			running:  map[string]string{"cluster1": "/cfg/cluster1", "cluster2": "/cfg/cluster2"},
+			desired:  map[string]string{"cluster1": "/cfg/cluster1"},
+			expected: []string{"cluster1"},
+		},
+		{
+			name:     "restart backend with new kubeconfig",
+			running:  map[string]string{"cluster1": "/cfg/cluster1"},
+			desired:  map[string]string{"cluster1": "/cfg/cluster1.yaml"},
+			expected: []string{"cluster1"},
+			started:  []string{"/cfg/cluster1.yaml"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := localmetrics.NewMetrics("kubernetes", "")
+			queue := sync.NewQueue(logrus.New(), fake.NewSimpleClientset(), 1, metrics)
+			m := NewBackendManager(logrus.New(), queue, time.Second*0, Options{}, metrics)
+			defer m.Stop()
+
+			var started []string
+			m.newClient = func(kubeCfgFile string, logger *logrus.Logger) (kubernetes.Interface, error) {
+				started = append(started, kubeCfgFile)
+				return fake.NewSimpleClientset(), nil
+			}
+			m.Sync(tc.running)
+			started = nil
+
+			m.Sync(tc.desired)
+
+			got := m.Backends()
+			sort.Strings(got)
+			sort.Strings(started)
+			assert.Equal(t, tc.expected, got)
+			assert.Equal(t, tc.started, started)
+		})
+	}
+}
+
+func TestBackendManagerReloadsKubeCfg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubecfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeCfgFile := filepath.Join(dir, "cluster1")
+	write := func(content string) {
+		if err := ioutil.WriteFile(kubeCfgFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	metrics := localmetrics.NewMetrics("kubernetes", "")
+	queue := sync.NewQueue(logrus.New(), fake.NewSimpleClientset(), 1, metrics)
+	m := NewBackendManager(logrus.New(), queue, time.Second*0, Options{}, metrics)
+	defer m.Stop()
+
+	var started []string
+	m.newClient = func(kubeCfgFile string, logger *logrus.Logger) (kubernetes.Interface, error) {
+		content, _ := ioutil.ReadFile(kubeCfgFile)
+		if string(content) == "invalid" {
+			return nil, fmt.Errorf("invalid kubeconfig")
+		}
+		started = append(started, string(content))
+		return fake.NewSimpleClientset(), nil
+	}
+	desired := map[string]string{"cluster1": kubeCfgFile}
+
+	write("token1")
+	m.Sync(desired)
+	m.Sync(desired)
+	assert.Equal(t, []string{"token1"}, started)
+
+	// Rotated credentials restart the backend
+	write("token2")
+	m.Sync(desired)
+	assert.Equal(t, []string{"token1", "token2"}, started)
+	assert.Equal(t, []string{"cluster1"}, m.Backends())
+
+	// Credentials that cannot be used leave the backend running
+	write("invalid")
+	m.Sync(desired)
+	assert.Equal(t, []string{"token1", "token2"}, started)
+	assert.Equal(t, []string{"cluster1"}, m.Backends())
+
+	// The backend still runs with the previous credentials
+	write("token2")
+	m.Sync(desired)
+	assert.Equal(t, []string{"token1", "token2"}, started)
+}
+
+func TestBackendManagerHealthChecks(t *testing.T) {
+	metrics := localmetrics.NewMetrics("kubernetes", "")
+	queue := sync.NewQueue(logrus.New(), fake.NewSimpleClientset(), 1, metrics)
+	m := NewBackendManager(logrus.New(), queue, time.Second*0, Options{}, metrics)
+	defer m.Stop()
+
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+	m.newClient = func(kubeCfgFile string, logger *logrus.Logger) (kubernetes.Interface, error) {
+		return fake.NewSimpleClientset(svc), nil
+	}
+	m.Sync(map[string]string{"cluster1": "/cfg/cluster1"})
+
+	var report health.Report
+	assert.Eventually(t, func() bool {
+		report = health.Run(m.HealthChecks(time.Minute), time.Second)
+		return report.Status == "ok" && report.Checks[2].Detail != "no event received"
+	}, 5*time.Second, 10*time.Millisecond, "got report %v", report)
+
+	var names []string
+	for _, result := range report.Checks {
+		names = append(names, result.Name)
+	}
+	assert.Equal(t, []string{"backend/cluster1/synced", "backend/cluster1/api", "backend/cluster1/events"}, names)
+	assert.Regexp(t, "last event .* ago", report.Checks[2].Detail)
+
+	// Events older than the maximum age fail the check
+	report = health.Run(m.HealthChecks(time.Nanosecond), time.Second)
+	assert.Equal(t, "failed", report.Checks[2].Status)
+}
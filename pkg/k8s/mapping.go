@@ -0,0 +1,116 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// DefaultNamespaceTemplate maps remote namespaces to the Gimbal namespace
+	// of the same name.
+	DefaultNamespaceTemplate = namespaceTemplateNamespace
+
+	namespaceTemplateBackend   = "{{backend}}"
+	namespaceTemplateNamespace = "{{namespace}}"
+)
+
+// NamespaceMapper maps the namespaces of a remote cluster to the namespaces of
+// the Gimbal cluster. Explicit mappings take precedence over the template.
+// Each Gimbal namespace is the target of at most one remote namespace, so that
+// services of the same name in different remote namespaces do not overwrite
+// each other.
+type NamespaceMapper struct {
+	mappings map[string]string
+	// targets maps the Gimbal namespaces of the explicit mappings to their
+	// remote namespace
+	targets  map[string]string
+	template string
+}
+
+// NewNamespaceMapper returns a NamespaceMapper. mappings maps remote namespace
+// names to Gimbal namespace names. The template builds the Gimbal namespace of
+// the other remote namespaces, replacing {{backend}} with the backend name and
+// {{namespace}} with the remote namespace name. If the template is empty,
+// DefaultNamespaceTemplate is used. The template must contain {{namespace}},
+// and no two mappings may have the same Gimbal namespace.
+func NewNamespaceMapper(mappings map[string]string, template string) (*NamespaceMapper, error) {
+	if template == "" {
+		template = DefaultNamespaceTemplate
+	}
+	if !strings.Contains(template, namespaceTemplateNamespace) {
+		return nil, fmt.Errorf("invalid namespace template %q: must contain %s, otherwise all remote namespaces map to the same Gimbal namespace",
+			template, namespaceTemplateNamespace)
+	}
+	// Render the template with placeholder names to make sure it can only
+	// produce valid namespace names.
+	if errs := validation.IsDNS1123Label(renderNamespaceTemplate(template, "a", "a")); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid namespace template %q: %s", template, strings.Join(errs, ", "))
+	}
+	// Sort the remote namespaces so that errors are reported consistently
+	remotes := make([]string, 0, len(mappings))
+	for remote := range mappings {
+		remotes = append(remotes, remote)
+	}
+	sort.Strings(remotes)
+	targets := make(map[string]string, len(mappings))
+	for _, remote := range remotes {
+		gimbal := mappings[remote]
+		if errs := validation.IsDNS1123Label(gimbal); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid namespace mapping %s=%s: %s", remote, gimbal, strings.Join(errs, ", "))
+		}
+		if other, ok := targets[gimbal]; ok {
+			return nil, fmt.Errorf("invalid namespace mapping %s=%s: namespace %s is already mapped to %s", remote, gimbal, other, gimbal)
+		}
+		targets[gimbal] = remote
+	}
+	return &NamespaceMapper{mappings: mappings, targets: targets, template: template}, nil
+}
+
+// Map returns the Gimbal namespace of the remote namespace of the given
+// backend. If the templated name is longer than the Kubernetes DNS_LABEL
+// maximum character limit, the name is shortened.
+func (m *NamespaceMapper) Map(backendName, namespace string) string {
+	if m == nil {
+		return namespace
+	}
+	if gimbal, ok := m.mappings[namespace]; ok {
+		return gimbal
+	}
+	return translator.ShortenKubernetesLabelValue(renderNamespaceTemplate(m.template, backendName, namespace))
+}
+
+// shadowedBy returns the remote namespace that is explicitly mapped to the
+// Gimbal namespace that the template maps the given remote namespace to. The
+// objects of shadowed namespaces are not replicated, so that they do not
+// overwrite the ones of the explicitly mapped namespace.
+func (m *NamespaceMapper) shadowedBy(backendName, namespace string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	if _, ok := m.mappings[namespace]; ok {
+		return "", false
+	}
+	remote, ok := m.targets[m.Map(backendName, namespace)]
+	return remote, ok
+}
+
+func renderNamespaceTemplate(template, backendName, namespace string) string {
+	return strings.NewReplacer(namespaceTemplateBackend, backendName, namespaceTemplateNamespace, namespace).Replace(template)
+}
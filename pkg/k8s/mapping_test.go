@@ -0,0 +1,105 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaceMapper(t *testing.T) {
+	tests := []struct {
+		name      string
+		mappings  map[string]string
+		template  string
+		namespace string
+		expected  string
+	}{
+		{
+			name:      "default template",
+			namespace: "team1",
+			expected:  "team1",
+		},
+		{
+			name:      "explicit mapping",
+			mappings:  map[string]string{"payments-prod": "payments"},
+			template:  "{{backend}}-{{namespace}}",
+			namespace: "payments-prod",
+			expected:  "payments",
+		},
+		{
+			name:      "backend template",
+			mappings:  map[string]string{"payments-prod": "payments"},
+			template:  "{{backend}}-{{namespace}}",
+			namespace: "team1",
+			expected:  "cluster1-team1",
+		},
+		{
+			name:      "prefix and suffix",
+			template:  "remote-{{namespace}}-apps",
+			namespace: "team1",
+			expected:  "remote-team1-apps",
+		},
+		{
+			name:      "long name is shortened",
+			template:  "{{backend}}-{{namespace}}",
+			namespace: "a-very-long-namespace-name-that-does-not-fit-with-the-backend-name",
+			expected:  "cluster1-a-very-long-namespace-name-that-does-not-fit-witc376de",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := NewNamespaceMapper(tc.mappings, tc.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tc.expected, m.Map("cluster1", tc.namespace))
+		})
+	}
+}
+
+func TestNamespaceMapperInvalid(t *testing.T) {
+	_, err := NewNamespaceMapper(nil, "{{namespace}}-")
+	assert.Error(t, err)
+	_, err = NewNamespaceMapper(nil, "Team_{{namespace}}")
+	assert.Error(t, err)
+	_, err = NewNamespaceMapper(map[string]string{"team1": "Team1"}, "")
+	assert.Error(t, err)
+	// Mappings must be one-to-one
+	_, err = NewNamespaceMapper(nil, "{{backend}}")
+	assert.Error(t, err)
+	_, err = NewNamespaceMapper(map[string]string{"team1": "apps", "team2": "apps"}, "")
+	assert.EqualError(t, err, "invalid namespace mapping team2=apps: namespace team1 is already mapped to apps")
+}
+
+func TestNamespaceMapperShadowed(t *testing.T) {
+	m, err := NewNamespaceMapper(map[string]string{"payments-prod": "payments", "payments": "payments-legacy"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, shadowed := m.shadowedBy("cluster1", "payments")
+	assert.False(t, shadowed, "explicitly mapped namespaces are never shadowed")
+	_, shadowed = m.shadowedBy("cluster1", "team1")
+	assert.False(t, shadowed)
+
+	m, err = NewNamespaceMapper(map[string]string{"payments-prod": "payments"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, shadowed := m.shadowedBy("cluster1", "payments")
+	assert.True(t, shadowed)
+	assert.Equal(t, "payments-prod", remote)
+}
@@ -0,0 +1,345 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/translator"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// reconcile makes the services, endpoints and endpoint slices replicated in
+// the Gimbal cluster match the ones discovered in the remote cluster. This
+// cleans up the objects left behind when deletions were missed, for example
+// while the discoverer was down. Endpoints and endpoint slices are reconciled
+// in every endpoints mode, so that the ones of the previous mode are removed
+// when switching modes, unless the Gimbal cluster does not serve or authorize
+// endpoint slices and they are not replicated.
+func (c *Controller) reconcile() {
+	// Standby replicas must not write to Gimbal
+	if !c.elector.IsLeader() {
+		return
+	}
+
+	// Calculate cycle time
+	start := time.Now()
+
+	log := c.Logger
+	log.Infof("Reconciling backend %s", c.backendName)
+
+	gimbalClient := c.syncqueue.KubeClient.CoreV1()
+	backendSelector := fmt.Sprintf("%s=%s", translator.GimbalLabelBackend, translator.ShortenKubernetesLabelValue(c.backendName))
+
+	currentServices, err := gimbalClient.Services(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{LabelSelector: backendSelector})
+	if err != nil {
+		c.metrics.GenericMetricError("ListGimbalServices")
+		log.Errorf("error listing services of backend %s: %v", c.backendName, err)
+		return
+	}
+	currentEndpoints, err := gimbalClient.Endpoints(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{LabelSelector: backendSelector})
+	if err != nil {
+		c.metrics.GenericMetricError("ListGimbalEndpoints")
+		log.Errorf("error listing endpoints of backend %s: %v", c.backendName, err)
+		return
+	}
+
+	// Only the endpoint slices written by Gimbal are selected, and not the
+	// ones the Gimbal cluster mirrors from the replicated endpoints
+	sliceSelector := fmt.Sprintf("%s,%s=%s", backendSelector, discovery.LabelManagedBy, endpointSliceManagedBy)
+	currentSlices, err := c.syncqueue.KubeClient.DiscoveryV1beta1().EndpointSlices(metav1.NamespaceAll).List(context.TODO(),
+		metav1.ListOptions{LabelSelector: sliceSelector})
+	switch {
+	case err == nil:
+	case !c.endpointsMode.endpointSlices() && (apierrors.IsForbidden(err) || apierrors.IsNotFound(err)):
+		// Endpoint slices are not replicated, and the Gimbal cluster does
+		// not serve or authorize them, so there are none to remove
+		currentSlices = &discovery.EndpointSliceList{}
+	default:
+		c.metrics.GenericMetricError("ListGimbalEndpointSlices")
+		log.Errorf("error listing endpoint slices of backend %s: %v", c.backendName, err)
+		return
+	}
+
+	desired, err := c.desiredState()
+	if err != nil {
+		c.metrics.GenericMetricError("ListUpstream")
+		log.Errorf("error listing upstream objects of backend %s: %v", c.backendName, err)
+		return
+	}
+
+	add, up, del := diffServices(desired.services, currentServices.Items)
+	for _, svc := range add {
+		c.enqueue(sync.AddServiceAction(svc))
+	}
+	for _, svc := range up {
+		c.enqueue(sync.UpdateServiceAction(svc))
+	}
+	for _, svc := range del {
+		c.enqueue(sync.DeleteServiceAction(svc))
+	}
+
+	addEp, upEp, stale := diffEndpoints(desired.endpoints, currentEndpoints.Items)
+	var delEp []*v1.Endpoints
+	for _, ep := range stale {
+		// Keep the endpoints of the external names that could not be
+		// resolved
+		if !desired.unresolved[objectKey(&ep.ObjectMeta)] {
+			delEp = append(delEp, ep)
+		}
+	}
+	for _, ep := range addEp {
+		c.enqueue(sync.AddEndpointsAction(ep, ep.Labels[translator.GimbalLabelService]))
+	}
+	for _, ep := range upEp {
+		c.enqueue(sync.UpdateEndpointsAction(ep, ep.Labels[translator.GimbalLabelService]))
+	}
+	for _, ep := range delEp {
+		c.enqueue(sync.DeleteEndpointsAction(ep, ep.Labels[translator.GimbalLabelService]))
+	}
+
+	addSlice, upSlice, delSlice := diffEndpointSlices(desired.slices, currentSlices.Items)
+	for _, slice := range addSlice {
+		c.enqueue(sync.AddEndpointSliceAction(slice, slice.Labels[translator.GimbalLabelService]))
+	}
+	for _, slice := range upSlice {
+		c.enqueue(sync.UpdateEndpointSliceAction(slice, slice.Labels[translator.GimbalLabelService]))
+	}
+	for _, slice := range delSlice {
+		c.enqueue(sync.DeleteEndpointSliceAction(slice, slice.Labels[translator.GimbalLabelService]))
+	}
+
+	log.Infof("Reconciled backend %s: services %d added, %d updated, %d deleted; endpoints %d added, %d updated, %d deleted; "+
+		"endpoint slices %d added, %d updated, %d deleted",
+		c.backendName, len(add), len(up), len(del), len(addEp), len(upEp), len(delEp), len(addSlice), len(upSlice), len(delSlice))
+
+	// Log to Prometheus the cycle duration
+	c.metrics.CycleDurationMetric(time.Since(start))
+}
+
+// state is the set of Gimbal objects replicated from a backend
+type state struct {
+	services  []*v1.Service
+	endpoints []*v1.Endpoints
+	slices    []*discovery.EndpointSlice
+	// unresolved holds the keys of the endpoints of the ExternalName
+	// services whose external name could not be resolved
+	unresolved map[string]bool
+}
+
+// desiredState returns the Gimbal services, endpoints and endpoint slices of
+// all the remote objects that are discovered. The endpoints of ExternalName
+// services are the ones last resolved, and their names are queued to be
+// resolved again.
+func (c *Controller) desiredState() (*state, error) {
+	services, err := c.serviceLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []*v1.Endpoints
+	if c.endpointsLister != nil {
+		if endpoints, err = c.endpointsLister.List(labels.Everything()); err != nil {
+			return nil, err
+		}
+	}
+	var slices []*discovery.EndpointSlice
+	if c.endpointSliceLister != nil {
+		if slices, err = c.endpointSliceLister.List(labels.Everything()); err != nil {
+			return nil, err
+		}
+	}
+
+	desired := &state{unresolved: map[string]bool{}}
+	for _, svc := range services {
+		if !c.skipProcessing(svc.GetName(), svc.GetNamespace(), svc.ObjectMeta.Labels) &&
+			c.discoverService(svc.GetAnnotations(), c.endpointsAnnotations(svc.GetNamespace(), svc.GetName())) {
+			desired.services = append(desired.services, c.gimbalService(svc))
+			if c.resolvesExternalName(svc) && c.endpointsMode.endpoints() {
+				ep, ok := c.resolvedEndpoints(objectKey(&svc.ObjectMeta))
+				if !ok {
+					desired.unresolved[objectKey(&c.gimbalExternalNameEndpoints(svc, nil).ObjectMeta)] = true
+					continue
+				}
+				desired.endpoints = append(desired.endpoints, ep)
+			}
+		}
+	}
+	for _, ep := range endpoints {
+		if !c.skipProcessing(ep.GetName(), ep.GetNamespace(), ep.ObjectMeta.Labels) &&
+			c.discoverService(c.serviceAnnotations(ep.GetNamespace(), ep.GetName()), ep.GetAnnotations()) {
+			desired.endpoints = append(desired.endpoints, c.gimbalEndpoints(ep))
+		}
+	}
+	for _, slice := range slices {
+		serviceName, ok := slice.Labels[discovery.LabelServiceName]
+		if ok && !c.skipProcessing(serviceName, slice.GetNamespace(), slice.ObjectMeta.Labels) &&
+			c.discoverService(c.serviceAnnotations(slice.GetNamespace(), serviceName), c.endpointsAnnotations(slice.GetNamespace(), serviceName)) {
+			desired.slices = append(desired.slices, c.gimbalEndpointSlice(slice))
+		}
+	}
+	return desired, nil
+}
+
+func diffServices(desired []*v1.Service, current []v1.Service) (add, update, del []*v1.Service) {
+	currentByName := map[string]*v1.Service{}
+	for i := range current {
+		currentByName[objectKey(&current[i].ObjectMeta)] = &current[i]
+	}
+
+	for _, desiredSvc := range desired {
+		key := objectKey(&desiredSvc.ObjectMeta)
+		currentSvc, ok := currentByName[key]
+		if ok {
+			translator.OverrideWeight(&desiredSvc.ObjectMeta, &currentSvc.ObjectMeta)
+		}
+		switch {
+		case !ok:
+			add = append(add, desiredSvc)
+		case !serviceEqualsDetail(desiredSvc, currentSvc):
+			update = append(update, desiredSvc)
+		}
+		delete(currentByName, key)
+	}
+
+	// Services that exist, but are no longer desired should be deleted
+	for _, currentSvc := range currentByName {
+		del = append(del, currentSvc)
+	}
+	return add, update, del
+}
+
+func diffEndpoints(desired []*v1.Endpoints, current []v1.Endpoints) (add, update, del []*v1.Endpoints) {
+	currentByName := map[string]*v1.Endpoints{}
+	for i := range current {
+		currentByName[objectKey(&current[i].ObjectMeta)] = &current[i]
+	}
+
+	for _, desiredEp := range desired {
+		key := objectKey(&desiredEp.ObjectMeta)
+		currentEp, ok := currentByName[key]
+		switch {
+		case !ok:
+			add = append(add, desiredEp)
+		case !endpointsEqualsDetail(desiredEp, currentEp):
+			update = append(update, desiredEp)
+		}
+		delete(currentByName, key)
+	}
+
+	// Endpoints that exist, but are no longer desired should be deleted
+	for _, currentEp := range currentByName {
+		del = append(del, currentEp)
+	}
+	return add, update, del
+}
+
+func diffEndpointSlices(desired []*discovery.EndpointSlice, current []discovery.EndpointSlice) (add, update, del []*discovery.EndpointSlice) {
+	currentByName := map[string]*discovery.EndpointSlice{}
+	for i := range current {
+		currentByName[objectKey(&current[i].ObjectMeta)] = &current[i]
+	}
+
+	for _, desiredSlice := range desired {
+		key := objectKey(&desiredSlice.ObjectMeta)
+		currentSlice, ok := currentByName[key]
+		switch {
+		case !ok:
+			add = append(add, desiredSlice)
+		case !endpointSliceEqualsDetail(desiredSlice, currentSlice):
+			update = append(update, desiredSlice)
+		}
+		delete(currentByName, key)
+	}
+
+	// Endpoint slices that exist, but are no longer desired should be deleted
+	for _, currentSlice := range currentByName {
+		del = append(del, currentSlice)
+	}
+	return add, update, del
+}
+
+func objectKey(meta *metav1.ObjectMeta) string {
+	return meta.Namespace + "/" + meta.Name
+}
+
+// serviceEqualsDetail compares the fields that are set when translating a
+// service. The desired service is defaulted the same way the API server does,
+// so that it is not seen as changed on every cycle.
+func serviceEqualsDetail(desired, current *v1.Service) bool {
+	if len(desired.Spec.Ports) != len(current.Spec.Ports) {
+		return false
+	}
+	ports := make([]v1.ServicePort, len(desired.Spec.Ports))
+	for i, p := range desired.Spec.Ports {
+		if p.Protocol == "" {
+			p.Protocol = v1.ProtocolTCP
+		}
+		if p.TargetPort == (intstr.IntOrString{}) {
+			p.TargetPort = intstr.FromInt(int(p.Port))
+		}
+		// The API server drops the app protocol unless the ServiceAppProtocol
+		// feature gate is enabled, in which case it cannot be replicated.
+		if current.Spec.Ports[i].AppProtocol == nil {
+			p.AppProtocol = nil
+		}
+		ports[i] = p
+	}
+	sessionAffinity, sessionAffinityConfig := defaultSessionAffinity(desired.Spec)
+	currentSessionAffinity, currentSessionAffinityConfig := defaultSessionAffinity(current.Spec)
+	return equality.Semantic.DeepEqual(desired.Labels, current.Labels) &&
+		equality.Semantic.DeepEqual(desired.Annotations, current.Annotations) &&
+		desired.Spec.Type == current.Spec.Type &&
+		desired.Spec.ExternalName == current.Spec.ExternalName &&
+		desired.Spec.PublishNotReadyAddresses == current.Spec.PublishNotReadyAddresses &&
+		sessionAffinity == currentSessionAffinity &&
+		equality.Semantic.DeepEqual(sessionAffinityConfig, currentSessionAffinityConfig) &&
+		equality.Semantic.DeepEqual(ports, current.Spec.Ports)
+}
+
+// defaultSessionAffinity returns the session affinity of a service spec, and
+// its config, defaulted the same way the API server does.
+func defaultSessionAffinity(spec v1.ServiceSpec) (v1.ServiceAffinity, *v1.SessionAffinityConfig) {
+	sessionAffinity, config := spec.SessionAffinity, spec.SessionAffinityConfig
+	if sessionAffinity == "" {
+		sessionAffinity = v1.ServiceAffinityNone
+	}
+	if sessionAffinity == v1.ServiceAffinityClientIP && config == nil {
+		timeout := v1.DefaultClientIPServiceAffinitySeconds
+		config = &v1.SessionAffinityConfig{ClientIP: &v1.ClientIPConfig{TimeoutSeconds: &timeout}}
+	}
+	return sessionAffinity, config
+}
+
+func endpointsEqualsDetail(desired, current *v1.Endpoints) bool {
+	return equality.Semantic.DeepEqual(desired.Labels, current.Labels) &&
+		equality.Semantic.DeepEqual(desired.Annotations, current.Annotations) &&
+		equality.Semantic.DeepEqual(desired.Subsets, current.Subsets)
+}
+
+func endpointSliceEqualsDetail(desired, current *discovery.EndpointSlice) bool {
+	return equality.Semantic.DeepEqual(desired.Labels, current.Labels) &&
+		equality.Semantic.DeepEqual(desired.Annotations, current.Annotations) &&
+		desired.AddressType == current.AddressType &&
+		equality.Semantic.DeepEqual(desired.Endpoints, current.Endpoints) &&
+		equality.Semantic.DeepEqual(desired.Ports, current.Ports)
+}
@@ -0,0 +1,374 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestReconcile(t *testing.T) {
+	remoteService := func(name string, port int32) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team1"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: port}}},
+		}
+	}
+	gimbalService := func(backend, name string, port int32) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      backend + "-" + name,
+				Namespace: "team1",
+				Labels: map[string]string{
+					"gimbal.projectcontour.io/backend": backend,
+					"gimbal.projectcontour.io/service": name,
+				},
+			},
+			Spec: v1.ServiceSpec{
+				ClusterIP: "None",
+				Type:      v1.ServiceTypeClusterIP,
+				Ports:     []v1.ServicePort{{Name: "http", Port: port, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(int(port))}},
+			},
+		}
+	}
+	remoteEndpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "existing", Namespace: "team1"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "192.168.0.1"}},
+			Ports:     []v1.EndpointPort{{Port: 80, Protocol: v1.ProtocolTCP}},
+		}},
+	}
+	orphanEndpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cluster1-orphan",
+			Namespace: "team1",
+			Labels: map[string]string{
+				"gimbal.projectcontour.io/backend": "cluster1",
+				"gimbal.projectcontour.io/service": "orphan",
+			},
+		},
+	}
+
+	remoteClient := fake.NewSimpleClientset(
+		remoteService("existing", 80),
+		remoteService("changed", 8080),
+		remoteService("new", 80),
+		remoteEndpoints,
+	)
+	gimbalClient := fake.NewSimpleClientset(
+		gimbalService("cluster1", "existing", 80),
+		gimbalService("cluster1", "changed", 80),
+		gimbalService("cluster1", "orphan", 80),
+		gimbalService("cluster2", "other", 80),
+		orphanEndpoints,
+	)
+
+	metrics := localmetrics.NewMetrics("backendtype", "cluster1")
+	informer := kubeinformers.NewSharedInformerFactory(remoteClient, time.Second*0)
+	c := NewController(logrus.New(), sync.NewQueue(logrus.New(), gimbalClient, 1, metrics), informer, "cluster1", metrics, Options{})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Start(stopCh)
+	informer.WaitForCacheSync(stopCh)
+	// Drop the actions queued by the informer event handlers
+	queuedActions(c)
+
+	c.reconcile()
+
+	var got []string
+	time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+	for c.syncqueue.Workqueue.Len() > 0 {
+		item, _ := c.syncqueue.Workqueue.Get()
+		got = append(got, fmt.Sprint(item))
+		c.syncqueue.Workqueue.Done(item)
+	}
+	sort.Strings(got)
+	assert.Equal(t, []string{
+		"add endpoints 'team1/cluster1-existing'",
+		"add service 'team1/cluster1-new'",
+		"delete endpoints 'team1/cluster1-orphan'",
+		"delete service 'team1/cluster1-orphan'",
+		"update service 'team1/cluster1-changed'",
+	}, got)
+}
+
+func TestReconcileEndpointSlices(t *testing.T) {
+	backendLabels := func(service string) map[string]string {
+		return map[string]string{
+			"gimbal.projectcontour.io/backend": "cluster1",
+			"gimbal.projectcontour.io/service": service,
+		}
+	}
+	remoteSlice := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Name: "existing-abcde", Namespace: "team1",
+			Labels: map[string]string{discovery.LabelServiceName: "existing"}},
+		AddressType: discovery.AddressTypeIPv4,
+	}
+	orphanLabels := backendLabels("orphan")
+	orphanLabels[discovery.LabelManagedBy] = "gimbal.projectcontour.io"
+	orphanSlice := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster1-orphan-abcde", Namespace: "team1", Labels: orphanLabels},
+	}
+	// Endpoints replicated before switching to endpoint slices
+	staleEndpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster1-existing", Namespace: "team1", Labels: backendLabels("existing")},
+	}
+
+	remoteClient := fake.NewSimpleClientset(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "existing", Namespace: "team1"}},
+		remoteSlice,
+	)
+	gimbalClient := fake.NewSimpleClientset(orphanSlice, staleEndpoints)
+
+	metrics := localmetrics.NewMetrics("backendtype", "cluster1")
+	informer := kubeinformers.NewSharedInformerFactory(remoteClient, time.Second*0)
+	c := NewController(logrus.New(), sync.NewQueue(logrus.New(), gimbalClient, 1, metrics), informer, "cluster1", metrics,
+		Options{EndpointsMode: EndpointsModeEndpointSlices})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Start(stopCh)
+	informer.WaitForCacheSync(stopCh)
+	// Drop the actions queued by the informer event handlers
+	queuedActions(c)
+
+	c.reconcile()
+
+	var got []string
+	time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+	for c.syncqueue.Workqueue.Len() > 0 {
+		item, _ := c.syncqueue.Workqueue.Get()
+		got = append(got, fmt.Sprint(item))
+		c.syncqueue.Workqueue.Done(item)
+	}
+	sort.Strings(got)
+	assert.Equal(t, []string{
+		"add endpointslice 'team1/cluster1-existing-abcde'",
+		"add service 'team1/cluster1-existing'",
+		"delete endpoints 'team1/cluster1-existing'",
+		"delete endpointslice 'team1/cluster1-orphan-abcde'",
+	}, got)
+}
+
+func TestReconcileEndpointSlicesEndpointsMode(t *testing.T) {
+	// Slice replicated before switching back to endpoints
+	staleSlice := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster1-existing-abcde", Namespace: "team1", Labels: map[string]string{
+			"gimbal.projectcontour.io/backend":       "cluster1",
+			"gimbal.projectcontour.io/service":       "existing",
+			"endpointslice.kubernetes.io/managed-by": "gimbal.projectcontour.io",
+		}},
+	}
+	// Slice mirrored by the Gimbal cluster from the replicated endpoints,
+	// which copies their labels
+	mirroredSlice := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster1-existing-fghij", Namespace: "team1", Labels: map[string]string{
+			"gimbal.projectcontour.io/backend":       "cluster1",
+			"gimbal.projectcontour.io/service":       "existing",
+			"endpointslice.kubernetes.io/managed-by": "endpointslicemirroring-controller.k8s.io",
+		}},
+	}
+	remoteClient := fake.NewSimpleClientset(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "existing", Namespace: "team1"}},
+		&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "existing", Namespace: "team1"}},
+	)
+	gimbalClient := fake.NewSimpleClientset(staleSlice, mirroredSlice)
+
+	metrics := localmetrics.NewMetrics("backendtype", "cluster1")
+	informer := kubeinformers.NewSharedInformerFactory(remoteClient, time.Second*0)
+	c := NewController(logrus.New(), sync.NewQueue(logrus.New(), gimbalClient, 1, metrics), informer, "cluster1", metrics,
+		Options{EndpointsMode: EndpointsModeEndpoints})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Start(stopCh)
+	informer.WaitForCacheSync(stopCh)
+	// Drop the actions queued by the informer event handlers
+	queuedActions(c)
+
+	c.reconcile()
+
+	var got []string
+	time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+	for c.syncqueue.Workqueue.Len() > 0 {
+		item, _ := c.syncqueue.Workqueue.Get()
+		got = append(got, fmt.Sprint(item))
+		c.syncqueue.Workqueue.Done(item)
+	}
+	sort.Strings(got)
+	assert.Equal(t, []string{
+		"add endpoints 'team1/cluster1-existing'",
+		"add service 'team1/cluster1-existing'",
+		"delete endpointslice 'team1/cluster1-existing-abcde'",
+	}, got)
+}
+
+func TestReconcileEndpointSlicesForbidden(t *testing.T) {
+	remoteClient := fake.NewSimpleClientset(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "existing", Namespace: "team1"}},
+		&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "existing", Namespace: "team1"}},
+	)
+	// The Gimbal cluster does not authorize endpoint slices
+	gimbalClient := fake.NewSimpleClientset()
+	gimbalClient.PrependReactor("list", "endpointslices", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(discovery.Resource("endpointslices"), "", fmt.Errorf("forbidden"))
+	})
+
+	tests := []struct {
+		name            string
+		mode            EndpointsMode
+		expectedActions []string
+	}{
+		{
+			name: "endpoints",
+			mode: EndpointsModeEndpoints,
+			expectedActions: []string{
+				"add endpoints 'team1/cluster1-existing'",
+				"add service 'team1/cluster1-existing'",
+			},
+		},
+		{
+			name: "endpoint slices",
+			mode: EndpointsModeEndpointSlices,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := localmetrics.NewMetrics("backendtype", "cluster1")
+			informer := kubeinformers.NewSharedInformerFactory(remoteClient, time.Second*0)
+			c := NewController(logrus.New(), sync.NewQueue(logrus.New(), gimbalClient, 1, metrics), informer, "cluster1", metrics,
+				Options{EndpointsMode: tc.mode})
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			informer.Start(stopCh)
+			informer.WaitForCacheSync(stopCh)
+			// Drop the actions queued by the informer event handlers
+			queuedActions(c)
+
+			c.reconcile()
+
+			var got []string
+			time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+			for c.syncqueue.Workqueue.Len() > 0 {
+				item, _ := c.syncqueue.Workqueue.Get()
+				got = append(got, fmt.Sprint(item))
+				c.syncqueue.Workqueue.Done(item)
+			}
+			sort.Strings(got)
+			assert.Equal(t, tc.expectedActions, got)
+		})
+	}
+}
+
+func TestServiceEqualsDetail(t *testing.T) {
+	h2c := "h2c"
+	timeout := v1.DefaultClientIPServiceAffinitySeconds
+	desired := func(update func(*v1.Service)) *v1.Service {
+		svc := &v1.Service{Spec: v1.ServiceSpec{
+			ClusterIP: "None",
+			Type:      v1.ServiceTypeClusterIP,
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, AppProtocol: &h2c}},
+		}}
+		if update != nil {
+			update(svc)
+		}
+		return svc
+	}
+	// current is the desired service, as defaulted by the API server
+	current := func(update func(*v1.Service)) *v1.Service {
+		svc := desired(update)
+		svc.Spec.Ports[0].Protocol = v1.ProtocolTCP
+		svc.Spec.Ports[0].TargetPort = intstr.FromInt(80)
+		if svc.Spec.SessionAffinity == "" {
+			svc.Spec.SessionAffinity = v1.ServiceAffinityNone
+		}
+		return svc
+	}
+
+	tests := []struct {
+		name     string
+		desired  *v1.Service
+		current  *v1.Service
+		expected bool
+	}{
+		{
+			name:     "defaulted",
+			desired:  desired(nil),
+			current:  current(nil),
+			expected: true,
+		},
+		{
+			name:     "protocol",
+			desired:  desired(func(svc *v1.Service) { svc.Spec.Ports[0].Protocol = v1.ProtocolUDP }),
+			current:  current(nil),
+			expected: false,
+		},
+		{
+			name:    "named target port",
+			desired: desired(func(svc *v1.Service) { svc.Spec.Ports[0].TargetPort = intstr.FromString("http") }),
+			current: current(nil),
+		},
+		{
+			name:     "app protocol dropped by the API server",
+			desired:  desired(nil),
+			current:  current(func(svc *v1.Service) { svc.Spec.Ports[0].AppProtocol = nil }),
+			expected: true,
+		},
+		{
+			name:    "app protocol",
+			desired: desired(func(svc *v1.Service) { svc.Spec.Ports[0].AppProtocol = nil }),
+			current: current(nil),
+		},
+		{
+			name:    "session affinity",
+			desired: desired(func(svc *v1.Service) { svc.Spec.SessionAffinity = v1.ServiceAffinityClientIP }),
+			current: current(nil),
+		},
+		{
+			name:    "defaulted session affinity config",
+			desired: desired(func(svc *v1.Service) { svc.Spec.SessionAffinity = v1.ServiceAffinityClientIP }),
+			current: current(func(svc *v1.Service) {
+				svc.Spec.SessionAffinity = v1.ServiceAffinityClientIP
+				svc.Spec.SessionAffinityConfig = &v1.SessionAffinityConfig{ClientIP: &v1.ClientIPConfig{TimeoutSeconds: &timeout}}
+			}),
+			expected: true,
+		},
+		{
+			name:    "publish not ready addresses",
+			desired: desired(func(svc *v1.Service) { svc.Spec.PublishNotReadyAddresses = true }),
+			current: current(nil),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, serviceEqualsDetail(tc.desired, tc.current))
+		})
+	}
+}
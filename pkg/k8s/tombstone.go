@@ -0,0 +1,162 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	kindService       = "service"
+	kindEndpoints     = "endpoints"
+	kindEndpointSlice = "endpointslice"
+)
+
+// onDeleteService handles the deletion of a service, or its tombstone. The
+// deletion of a tombstone is only replicated if the service did not come back
+// in the cache meanwhile, and the tombstone is verified against Gimbal when the
+// deletion is synced.
+func (c *Controller) onDeleteService(obj interface{}) {
+	obj, tombstone := deletedObject(obj)
+	service, ok := obj.(*v1.Service)
+	if !ok {
+		c.unexpectedObject(kindService, obj)
+		return
+	}
+	if tombstone {
+		c.metrics.DiscovererTombstoneMetric(kindService)
+		if _, err := c.serviceLister.Services(service.GetNamespace()).Get(service.GetName()); err == nil {
+			return
+		}
+	}
+	c.deleteService(service, tombstone)
+}
+
+// onDeleteEndpoints handles the deletion of endpoints, or their tombstone,
+// the same way as onDeleteService.
+func (c *Controller) onDeleteEndpoints(obj interface{}) {
+	obj, tombstone := deletedObject(obj)
+	endpoints, ok := obj.(*v1.Endpoints)
+	if !ok {
+		c.unexpectedObject(kindEndpoints, obj)
+		return
+	}
+	if tombstone {
+		c.metrics.DiscovererTombstoneMetric(kindEndpoints)
+		if _, err := c.endpointsLister.Endpoints(endpoints.GetNamespace()).Get(endpoints.GetName()); err == nil {
+			return
+		}
+	}
+	c.deleteEndpoints(endpoints, tombstone)
+}
+
+// onDeleteEndpointSlice handles the deletion of an endpoint slice, or its
+// tombstone, the same way as onDeleteService.
+func (c *Controller) onDeleteEndpointSlice(obj interface{}) {
+	obj, tombstone := deletedObject(obj)
+	slice, ok := obj.(*discovery.EndpointSlice)
+	if !ok {
+		c.unexpectedObject(kindEndpointSlice, obj)
+		return
+	}
+	if tombstone {
+		c.metrics.DiscovererTombstoneMetric(kindEndpointSlice)
+		if _, err := c.endpointSliceLister.EndpointSlices(slice.GetNamespace()).Get(slice.GetName()); err == nil {
+			return
+		}
+	}
+	c.deleteEndpointSlice(slice, tombstone)
+}
+
+// deleteAction returns the deletion of a Gimbal object of the given kind. The
+// deletion of a tombstone is verified against Gimbal by the sync queue, so
+// that the event handlers do not wait on the Gimbal API.
+func (c *Controller) deleteAction(kind string, action sync.Action, tombstone bool) sync.Action {
+	if !tombstone {
+		return action
+	}
+	return sync.WithPrecondition(action, func(kube kubernetes.Interface, _ *logrus.Logger) bool {
+		return c.verifyTombstone(kube, kind, action.ObjectMeta())
+	})
+}
+
+// deletedObject returns the object of a delete notification, and whether it
+// is the last known state of a tombstone.
+func deletedObject(obj interface{}) (interface{}, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj, true
+	}
+	return obj, false
+}
+
+func (c *Controller) unexpectedObject(kind string, obj interface{}) {
+	c.metrics.GenericMetricError("UnexpectedDeletedObject")
+	c.Logger.Errorf("Ignoring deleted %s of backend %s: unexpected object of type %T", kind, c.backendName, obj)
+}
+
+// verifyTombstone returns true if the deletion of a tombstone must be
+// replicated to Gimbal. When the watch of a backend misses a deletion, e.g.
+// after a disconnection, the informer notices it on relist and hands over a
+// tombstone holding the last known state of the object, which might be stale.
+// The deletion is only replicated if the Gimbal object exists and was
+// replicated from this backend. Tombstones are rare enough that the Gimbal API
+// can be queried directly when the deletion is synced. If the Gimbal object
+// cannot be read, the deletion goes ahead, and is retried by the sync queue if
+// the API is down.
+func (c *Controller) verifyTombstone(kube kubernetes.Interface, kind string, gimbal *metav1.ObjectMeta) bool {
+	log := c.Logger.WithField("backend", c.backendName)
+
+	labels, err := gimbalObjectLabels(kube, kind, gimbal.Namespace, gimbal.Name)
+	switch {
+	case errors.IsNotFound(err):
+		log.Infof("Ignoring tombstone for %s %s/%s: already gone from Gimbal", kind, gimbal.Namespace, gimbal.Name)
+		return false
+	case err != nil:
+		c.metrics.GenericMetricError("VerifyTombstone")
+		log.Errorf("Could not verify tombstone for %s %s/%s: %v", kind, gimbal.Namespace, gimbal.Name, err)
+		return true
+	}
+	if labels[translator.GimbalLabelBackend] != gimbal.Labels[translator.GimbalLabelBackend] {
+		log.Warnf("Ignoring tombstone for %s %s/%s: Gimbal object was not replicated from this backend", kind, gimbal.Namespace, gimbal.Name)
+		return false
+	}
+	return true
+}
+
+func gimbalObjectLabels(client kubernetes.Interface, kind, namespace, name string) (map[string]string, error) {
+	var obj metav1.Object
+	var err error
+	switch kind {
+	case kindService:
+		obj, err = client.CoreV1().Services(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	case kindEndpoints:
+		obj, err = client.CoreV1().Endpoints(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	case kindEndpointSlice:
+		obj, err = client.DiscoveryV1beta1().EndpointSlices(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return obj.GetLabels(), nil
+}
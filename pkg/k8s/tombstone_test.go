@@ -0,0 +1,164 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestDeleteServiceTombstone(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+	gimbalService := func(backend string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "cluster1-test", Namespace: "team1",
+			Labels: map[string]string{"gimbal.projectcontour.io/backend": backend}}}
+	}
+	tombstone := cache.DeletedFinalStateUnknown{Key: "team1/test", Obj: svc}
+
+	tests := []struct {
+		name              string
+		obj               interface{}
+		remote            *v1.Service
+		gimbal            []runtime.Object
+		expectedActions   []string
+		expectedGimbal    int
+		expectedTombstone float64
+	}{
+		{
+			name:            "delete",
+			obj:             svc,
+			expectedActions: []string{"delete"},
+		},
+		{
+			name:              "tombstone",
+			obj:               tombstone,
+			gimbal:            []runtime.Object{gimbalService("cluster1")},
+			expectedActions:   []string{"delete"},
+			expectedTombstone: 1,
+		},
+		{
+			name:              "tombstone of service gone from gimbal",
+			obj:               tombstone,
+			expectedActions:   []string{"delete"},
+			expectedTombstone: 1,
+		},
+		{
+			name:              "tombstone of service of another backend",
+			obj:               tombstone,
+			gimbal:            []runtime.Object{gimbalService("cluster2")},
+			expectedActions:   []string{"delete"},
+			expectedGimbal:    1,
+			expectedTombstone: 1,
+		},
+		{
+			name:              "stale tombstone of service back in the cache",
+			obj:               tombstone,
+			remote:            svc,
+			gimbal:            []runtime.Object{gimbalService("cluster1")},
+			expectedGimbal:    1,
+			expectedTombstone: 1,
+		},
+		{
+			name:              "tombstone of unexpected object",
+			obj:               cache.DeletedFinalStateUnknown{Key: "team1/test", Obj: &v1.Pod{}},
+			expectedTombstone: 0,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := localmetrics.NewMetrics("backendtype", "cluster1")
+			metrics.RegisterPrometheus(false)
+			informer := kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(), time.Second*0)
+			queue := sync.NewQueue(logrus.New(), fake.NewSimpleClientset(tc.gimbal...), 1, metrics)
+			c := NewController(logrus.New(), queue, informer, "cluster1", metrics, Options{})
+			if tc.remote != nil {
+				if err := informer.Core().V1().Services().Informer().GetIndexer().Add(tc.remote); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c.onDeleteService(tc.obj)
+
+			// The tombstone is verified against Gimbal when the deletion is
+			// synced, not by the event handler
+			assert.Equal(t, tc.expectedActions, syncActions(c))
+			services, err := queue.KubeClient.CoreV1().Services("team1").List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, services.Items, tc.expectedGimbal)
+			gathering, err := metrics.Registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tombstones := float64(0)
+			for _, mf := range gathering {
+				if mf.GetName() == localmetrics.DiscovererTombstonesTotalCounter {
+					tombstones = mf.Metric[0].Counter.GetValue()
+				}
+			}
+			assert.Equal(t, tc.expectedTombstone, tombstones)
+		})
+	}
+}
+
+func TestDeleteEndpointsTombstone(t *testing.T) {
+	ep := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+	gimbalEndpoints := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "cluster1-test", Namespace: "team1",
+		Labels: map[string]string{"gimbal.projectcontour.io/backend": "cluster1"}}}
+
+	metrics := localmetrics.NewMetrics("backendtype", "cluster1")
+	informer := kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(), time.Second*0)
+	queue := sync.NewQueue(logrus.New(), fake.NewSimpleClientset(gimbalEndpoints), 1, metrics)
+	c := NewController(logrus.New(), queue, informer, "cluster1", metrics, Options{})
+
+	c.onDeleteEndpoints(cache.DeletedFinalStateUnknown{Key: "team1/test", Obj: ep})
+	assert.Equal(t, []string{"delete"}, syncActions(c))
+	endpoints, err := queue.KubeClient.CoreV1().Endpoints("team1").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, endpoints.Items)
+}
+
+// syncActions syncs the queued actions with the Gimbal cluster, and returns
+// their types
+func syncActions(c *Controller) []string {
+	time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+
+	var got []string
+	for c.syncqueue.Workqueue.Len() > 0 {
+		item, _ := c.syncqueue.Workqueue.Get()
+		action := item.(sync.Action)
+		got = append(got, action.GetActionType())
+		if err := action.Sync(c.syncqueue.KubeClient, c.Logger); err != nil {
+			c.Logger.Errorf("Error syncing %s: %v", action, err)
+		}
+		c.syncqueue.Workqueue.Done(item)
+	}
+	return got
+}
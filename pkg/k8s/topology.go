@@ -0,0 +1,121 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/translator"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+)
+
+// hostnameLabel is the topology key of the name of the node of an endpoint in
+// endpoint slices
+const hostnameLabel = "kubernetes.io/hostname"
+
+// locality returns the zone and region in the topology labels, falling back
+// to the deprecated beta labels.
+func locality(labels map[string]string) (zone, region string) {
+	zone, region = labels[v1.LabelZoneFailureDomainStable], labels[v1.LabelZoneRegionStable]
+	if zone == "" {
+		zone = labels[v1.LabelZoneFailureDomain]
+	}
+	if region == "" {
+		region = labels[v1.LabelZoneRegion]
+	}
+	return zone, region
+}
+
+// nodeLocality returns the zone and region of the node with the given name, or
+// empty strings if it is not in the cache.
+func (c *Controller) nodeLocality(nodeName string) (zone, region string) {
+	node, err := c.nodeLister.Get(nodeName)
+	if err != nil {
+		return "", ""
+	}
+	return locality(node.GetLabels())
+}
+
+// subsetsTopology returns the topology of the nodes of the addresses of the
+// subsets. Addresses that are not ready are included, so that the topology of
+// a service does not change with the readiness of its endpoints.
+func (c *Controller) subsetsTopology(subsets []v1.EndpointSubset) translator.Topology {
+	var t translator.Topology
+	for _, subset := range subsets {
+		for _, addresses := range [][]v1.EndpointAddress{subset.Addresses, subset.NotReadyAddresses} {
+			for _, address := range addresses {
+				if address.NodeName != nil {
+					t.Add(c.nodeLocality(*address.NodeName))
+				}
+			}
+		}
+	}
+	return t
+}
+
+// endpointsTopology returns the topology of the Gimbal endpoints of the remote
+// endpoints.
+func (c *Controller) endpointsTopology(endpoints *v1.Endpoints) translator.Topology {
+	return c.subsetsTopology(c.serviceSubsets(endpoints))
+}
+
+// endpointSlicesTopology returns the topology of the endpoints of the slices,
+// from their topology labels, or from their node when these are missing.
+func (c *Controller) endpointSlicesTopology(slices ...*discovery.EndpointSlice) translator.Topology {
+	var t translator.Topology
+	for _, slice := range slices {
+		for _, ep := range slice.Endpoints {
+			zone, region := locality(ep.Topology)
+			if nodeName := ep.Topology[hostnameLabel]; (zone == "" || region == "") && nodeName != "" {
+				nodeZone, nodeRegion := c.nodeLocality(nodeName)
+				if zone == "" {
+					zone = nodeZone
+				}
+				if region == "" {
+					region = nodeRegion
+				}
+			}
+			t.Add(zone, region)
+		}
+	}
+	return t
+}
+
+// serviceTopology returns the topology of the endpoints of a service in the
+// cache, read from the replicated endpoints, or from the endpoint slices when
+// only these are replicated.
+func (c *Controller) serviceTopology(namespace, name string) translator.Topology {
+	if c.endpointsLister != nil {
+		endpoints, err := c.endpointsLister.Endpoints(namespace).Get(name)
+		if err != nil {
+			return translator.Topology{}
+		}
+		return c.endpointsTopology(endpoints)
+	}
+	return c.endpointSlicesTopology(c.serviceEndpointSlices(namespace, name)...)
+}
+
+// refreshServiceTopology updates the Gimbal service of remote endpoints when
+// the topology of the endpoints changes. Callers only compute topologies when
+// they are recorded.
+func (c *Controller) refreshServiceTopology(namespace, name string, old, new translator.Topology) {
+	if old.Equal(new) {
+		return
+	}
+	svc, err := c.serviceLister.Services(namespace).Get(name)
+	if err != nil {
+		return
+	}
+	c.enqueue(sync.UpdateServiceAction(c.gimbalService(svc)))
+}
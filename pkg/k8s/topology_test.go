@@ -0,0 +1,174 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"testing"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func zonedNode(name, zone string, beta bool) *v1.Node {
+	node := testNode(name, "10.0.0.1", true)
+	if beta {
+		node.Labels = map[string]string{v1.LabelZoneFailureDomain: zone, v1.LabelZoneRegion: "us-east-1"}
+	} else {
+		node.Labels = map[string]string{v1.LabelZoneFailureDomainStable: zone, v1.LabelZoneRegionStable: "us-east-1"}
+	}
+	return node
+}
+
+func nodeEndpoints(nodeNames ...string) *v1.Endpoints {
+	ep := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+	subset := v1.EndpointSubset{Ports: []v1.EndpointPort{{Name: "http", Port: 8080}}}
+	for i, name := range nodeNames {
+		nodeName := name
+		address := v1.EndpointAddress{IP: "192.168.0.1", NodeName: &nodeName}
+		if i%2 == 0 {
+			subset.Addresses = append(subset.Addresses, address)
+		} else {
+			subset.NotReadyAddresses = append(subset.NotReadyAddresses, address)
+		}
+	}
+	ep.Subsets = []v1.EndpointSubset{subset}
+	return ep
+}
+
+func TestServiceTopology(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+	tests := []struct {
+		name        string
+		endpoints   *v1.Endpoints
+		labels      map[string]string
+		annotations map[string]string
+	}{
+		{
+			name:      "no endpoints",
+			endpoints: nil,
+		},
+		{
+			name:        "single zone",
+			endpoints:   nodeEndpoints("node-a1", "node-a2"),
+			labels:      map[string]string{translator.GimbalLabelZone: "us-east-1a", translator.GimbalLabelRegion: "us-east-1"},
+			annotations: map[string]string{translator.GimbalAnnotationZones: "us-east-1a"},
+		},
+		{
+			name:        "many zones",
+			endpoints:   nodeEndpoints("node-a1", "node-b"),
+			labels:      map[string]string{translator.GimbalLabelRegion: "us-east-1"},
+			annotations: map[string]string{translator.GimbalAnnotationZones: "us-east-1a,us-east-1b"},
+		},
+		{
+			name:      "unknown node",
+			endpoints: nodeEndpoints("node-c"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := localmetrics.NewMetrics("backendtype", "backend")
+			client := fake.NewSimpleClientset()
+			informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+			c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "cluster1", metrics,
+				Options{Topology: true})
+			for _, node := range []*v1.Node{zonedNode("node-a1", "us-east-1a", false), zonedNode("node-a2", "us-east-1a", true),
+				zonedNode("node-b", "us-east-1b", false)} {
+				if err := informer.Core().V1().Nodes().Informer().GetIndexer().Add(node); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.endpoints != nil {
+				if err := informer.Core().V1().Endpoints().Informer().GetIndexer().Add(tc.endpoints); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := c.gimbalService(svc)
+			for k, v := range tc.labels {
+				assert.Equal(t, v, got.Labels[k], k)
+			}
+			if _, ok := tc.labels[translator.GimbalLabelZone]; !ok {
+				assert.NotContains(t, got.Labels, translator.GimbalLabelZone)
+			}
+			assert.Equal(t, tc.annotations, got.Annotations)
+		})
+	}
+}
+
+func TestEndpointSlicesTopology(t *testing.T) {
+	metrics := localmetrics.NewMetrics("backendtype", "backend")
+	client := fake.NewSimpleClientset()
+	informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+	c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "cluster1", metrics,
+		Options{Topology: true, EndpointsMode: EndpointsModeEndpointSlices})
+	if err := informer.Core().V1().Nodes().Informer().GetIndexer().Add(zonedNode("node-b", "us-east-1b", false)); err != nil {
+		t.Fatal(err)
+	}
+
+	slice := &discovery.EndpointSlice{
+		Endpoints: []discovery.Endpoint{
+			{Addresses: []string{"192.168.0.1"}, Topology: map[string]string{v1.LabelZoneFailureDomainStable: "us-east-1a"}},
+			// The zone of endpoints without topology labels is read from their node
+			{Addresses: []string{"192.168.0.2"}, Topology: map[string]string{hostnameLabel: "node-b"}},
+		},
+	}
+	topology := c.endpointSlicesTopology(slice)
+	assert.Equal(t, []string{"us-east-1a", "us-east-1b"}, topology.Zones())
+	assert.Equal(t, []string{"us-east-1"}, topology.Regions())
+}
+
+func TestRefreshServiceTopology(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "team1"}}
+
+	metrics := localmetrics.NewMetrics("backendtype", "backend")
+	client := fake.NewSimpleClientset()
+	informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+	c := NewController(logrus.New(), sync.NewQueue(logrus.New(), client, 1, metrics), informer, "cluster1", metrics,
+		Options{Topology: true})
+	for _, node := range []*v1.Node{zonedNode("node-a1", "us-east-1a", false), zonedNode("node-a2", "us-east-1a", false),
+		zonedNode("node-b", "us-east-1b", false)} {
+		if err := informer.Core().V1().Nodes().Informer().GetIndexer().Add(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := informer.Core().V1().Services().Informer().GetIndexer().Add(svc); err != nil {
+		t.Fatal(err)
+	}
+
+	// Endpoints that move within the same zone only update the endpoints
+	old, ep := nodeEndpoints("node-a1"), nodeEndpoints("node-a2")
+	if err := informer.Core().V1().Endpoints().Informer().GetIndexer().Add(ep); err != nil {
+		t.Fatal(err)
+	}
+	c.updateEndpoints(old, ep)
+	assert.Equal(t, []string{"update"}, queuedActions(c))
+
+	// Endpoints that move to another zone update the service as well
+	old, ep = ep, nodeEndpoints("node-b")
+	if err := informer.Core().V1().Endpoints().Informer().GetIndexer().Update(ep); err != nil {
+		t.Fatal(err)
+	}
+	c.updateEndpoints(old, ep)
+	assert.Equal(t, []string{"update", "update"}, queuedActions(c))
+}
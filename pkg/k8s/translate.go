@@ -16,41 +16,112 @@ package k8s
 import (
 	"github.com/projectcontour/gimbal/pkg/translator"
 	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func translateService(svc *v1.Service, backendName string) *v1.Service {
+// translateService returns the Gimbal service of the remote service, in the
+// given Gimbal namespace. Only the spec fields that are meaningful to a
+// headless service are propagated:
+//
+//   - ports: name, protocol, appProtocol, port and targetPort
+//   - sessionAffinity and sessionAffinityConfig
+//   - publishNotReadyAddresses
+//
+// Unless pod addresses are replicated, the target ports are remapped to the
+// ports the endpoints of the address mode listen on. ExternalName services are
+// replicated as such, unless their external name is resolved into endpoints.
+// These have no session affinity, as they are not proxied. The annotations are
+// filtered and rewritten by the policy.
+func translateService(svc *v1.Service, backendName, namespace string, policy *translator.Policy, addressMode AddressMode,
+	externalNameMode ExternalNameMode) *v1.Service {
 	newService := &v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Namespace:   svc.Namespace,
+			Namespace:   namespace,
 			Name:        translator.BuildDiscoveredName(backendName, svc.Name),
 			Labels:      translator.AddGimbalLabels(backendName, svc.ObjectMeta.Name, svc.ObjectMeta.Labels),
-			Annotations: svc.Annotations,
+			Annotations: policy.Annotations(backendName, svc.Annotations),
 		},
 		Spec: v1.ServiceSpec{
-			ClusterIP: "None",
-			Type:      v1.ServiceTypeClusterIP,
+			ClusterIP:                "None",
+			Type:                     v1.ServiceTypeClusterIP,
+			SessionAffinity:          svc.Spec.SessionAffinity,
+			SessionAffinityConfig:    svc.Spec.SessionAffinityConfig.DeepCopy(),
+			PublishNotReadyAddresses: svc.Spec.PublishNotReadyAddresses,
 		},
 	}
 
+	switch {
+	case isExternalName(svc) && externalNameMode != ExternalNameModeResolve:
+		newService.Spec = v1.ServiceSpec{
+			Type:                     v1.ServiceTypeExternalName,
+			ExternalName:             svc.Spec.ExternalName,
+			PublishNotReadyAddresses: svc.Spec.PublishNotReadyAddresses,
+		}
+		addressMode = AddressModePod
+	case isExternalName(svc), isSelectorless(svc):
+		// The endpoints listen on the ports of the service, whatever the
+		// address mode.
+		addressMode = AddressModePod
+	}
+
 	for _, port := range svc.Spec.Ports {
 		newService.Spec.Ports = append(newService.Spec.Ports, v1.ServicePort{
-			Name: port.Name,
-			Port: port.Port,
+			Name:        port.Name,
+			Protocol:    port.Protocol,
+			AppProtocol: copyString(port.AppProtocol),
+			Port:        port.Port,
+			TargetPort:  servicePortTarget(port, addressMode),
 		})
 	}
 	return newService
 }
 
-func translateEndpoints(endpoints *v1.Endpoints, backendName string) *v1.Endpoints {
+// translateEndpoints returns the Gimbal endpoints of the remote endpoints, in
+// the given Gimbal namespace. The annotations are filtered and rewritten by the
+// policy.
+func translateEndpoints(endpoints *v1.Endpoints, backendName, namespace string, policy *translator.Policy) *v1.Endpoints {
 	newEndpoint := &v1.Endpoints{
 		ObjectMeta: metav1.ObjectMeta{
-			Namespace:   endpoints.Namespace,
+			Namespace:   namespace,
 			Name:        translator.BuildDiscoveredName(backendName, endpoints.Name),
 			Labels:      translator.AddGimbalLabels(backendName, endpoints.ObjectMeta.Name, endpoints.ObjectMeta.Labels),
-			Annotations: endpoints.Annotations,
+			Annotations: policy.Annotations(backendName, endpoints.Annotations),
 		},
-		Subsets: endpoints.Subsets,
+		Subsets: endpoints.DeepCopy().Subsets,
 	}
 	return newEndpoint
 }
+
+// translateEndpointSlice returns the Gimbal endpoint slice of the remote
+// endpoint slice, in the given Gimbal namespace. The slice is labelled with
+// the name of the Gimbal service it belongs to, and as managed by Gimbal so
+// that the endpoint slice controller of the Gimbal cluster leaves it alone.
+// The annotations are filtered and rewritten by the policy.
+func translateEndpointSlice(slice *discovery.EndpointSlice, backendName, namespace string, policy *translator.Policy) *discovery.EndpointSlice {
+	serviceName := slice.Labels[discovery.LabelServiceName]
+	labels := translator.AddGimbalLabels(backendName, serviceName, slice.ObjectMeta.Labels)
+	labels[discovery.LabelServiceName] = translator.BuildDiscoveredName(backendName, serviceName)
+	labels[discovery.LabelManagedBy] = endpointSliceManagedBy
+
+	slice = slice.DeepCopy()
+	return &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        translator.BuildDiscoveredName(backendName, slice.Name),
+			Labels:      labels,
+			Annotations: policy.Annotations(backendName, slice.Annotations),
+		},
+		AddressType: slice.AddressType,
+		Endpoints:   slice.Endpoints,
+		Ports:       slice.Ports,
+	}
+}
+
+func copyString(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	return &c
+}
@@ -16,14 +16,17 @@ package k8s
 import (
 	"testing"
 
+	"github.com/projectcontour/gimbal/pkg/translator"
 	"github.com/stretchr/testify/assert"
-
 	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 func TestTranslateService(t *testing.T) {
+	grpc := "grpc"
+	timeout := int32(600)
 	tests := []struct {
 		name        string
 		backendName string
@@ -56,7 +59,7 @@ func TestTranslateService(t *testing.T) {
 				},
 				Spec: v1.ServiceSpec{
 					ClusterIP: "None",
-					Ports:     []v1.ServicePort{{Name: "foo", Port: 80}}, //, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080)}},
+					Ports:     []v1.ServicePort{{Name: "foo", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080)}},
 					Type:      v1.ServiceTypeClusterIP,
 				},
 			},
@@ -91,17 +94,58 @@ func TestTranslateService(t *testing.T) {
 				Spec: v1.ServiceSpec{
 					ClusterIP: "None",
 					Ports: []v1.ServicePort{
-						{Name: "foo", Port: 80},
-						{Name: "bar", Port: 8080},
+						{Name: "foo", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080)},
+						{Name: "bar", Port: 8080, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080)},
 					},
 					Type: v1.ServiceTypeClusterIP,
 				},
 			},
 		},
+		{
+			name:        "protocols and session affinity",
+			backendName: "cluster1",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Name:      "dns",
+				},
+				Spec: v1.ServiceSpec{
+					ClusterIP: "10.99.179.252",
+					Ports: []v1.ServicePort{
+						{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP, TargetPort: intstr.FromString("dns"), NodePort: 30053},
+						{Name: "grpc", Port: 9000, Protocol: v1.ProtocolTCP, AppProtocol: &grpc, TargetPort: intstr.FromString("grpc")},
+					},
+					Selector:                 map[string]string{"app": "dns"},
+					Type:                     v1.ServiceTypeNodePort,
+					SessionAffinity:          v1.ServiceAffinityClientIP,
+					SessionAffinityConfig:    &v1.SessionAffinityConfig{ClientIP: &v1.ClientIPConfig{TimeoutSeconds: &timeout}},
+					PublishNotReadyAddresses: true,
+					ExternalTrafficPolicy:    v1.ServiceExternalTrafficPolicyTypeLocal,
+				},
+			},
+			expected: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Name:      "cluster1-dns",
+					Labels:    map[string]string{"gimbal.projectcontour.io/backend": "cluster1", "gimbal.projectcontour.io/service": "dns"},
+				},
+				Spec: v1.ServiceSpec{
+					ClusterIP: "None",
+					Ports: []v1.ServicePort{
+						{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP, TargetPort: intstr.FromString("dns")},
+						{Name: "grpc", Port: 9000, Protocol: v1.ProtocolTCP, AppProtocol: &grpc, TargetPort: intstr.FromString("grpc")},
+					},
+					Type:                     v1.ServiceTypeClusterIP,
+					SessionAffinity:          v1.ServiceAffinityClientIP,
+					SessionAffinityConfig:    &v1.SessionAffinityConfig{ClientIP: &v1.ClientIPConfig{TimeoutSeconds: &timeout}},
+					PublishNotReadyAddresses: true,
+				},
+			},
+		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			got := translateService(tc.service, tc.backendName)
+			got := translateService(tc.service, tc.backendName, tc.service.Namespace, nil, AddressModePod, ExternalNameModeService)
 			assert.EqualValues(t, tc.expected, got)
 		})
 	}
@@ -150,8 +194,93 @@ func TestTranslateEndpoints(t *testing.T) {
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			got := translateEndpoints(tc.endpoints, tc.backendName)
+			got := translateEndpoints(tc.endpoints, tc.backendName, tc.endpoints.Namespace, nil)
 			assert.EqualValues(t, tc.expected, got)
 		})
 	}
 }
+
+func TestTranslateEndpointSlice(t *testing.T) {
+	ready := true
+	port := int32(8080)
+	slice := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "kuard-x7k2p",
+			Labels: map[string]string{
+				"app":                                    "kuard",
+				"kubernetes.io/service-name":             "kuard",
+				"endpointslice.kubernetes.io/managed-by": "endpointslice-controller.k8s.io",
+			},
+			Annotations: map[string]string{"foo": "bar"},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+		Endpoints:   []discovery.Endpoint{{Addresses: []string{"172.17.0.4"}, Conditions: discovery.EndpointConditions{Ready: &ready}}},
+		Ports:       []discovery.EndpointPort{{Port: &port}},
+	}
+	expected := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "team1",
+			Name:      "cluster1-kuard-x7k2p",
+			Labels: map[string]string{
+				"app":                                    "kuard",
+				"kubernetes.io/service-name":             "cluster1-kuard",
+				"endpointslice.kubernetes.io/managed-by": "gimbal.projectcontour.io",
+				"gimbal.projectcontour.io/backend":       "cluster1",
+				"gimbal.projectcontour.io/service":       "kuard",
+			},
+			Annotations: map[string]string{"foo": "bar"},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+		Endpoints:   []discovery.Endpoint{{Addresses: []string{"172.17.0.4"}, Conditions: discovery.EndpointConditions{Ready: &ready}}},
+		Ports:       []discovery.EndpointPort{{Port: &port}},
+	}
+
+	got := translateEndpointSlice(slice, "cluster1", "team1", nil)
+	assert.EqualValues(t, expected, got)
+	// The labels of the remote slice are left alone
+	assert.Equal(t, "kuard", slice.Labels["kubernetes.io/service-name"])
+}
+
+func TestTranslatePolicy(t *testing.T) {
+	policy, err := translator.NewPolicy(nil, []string{translator.LastAppliedConfigAnnotation},
+		map[string]string{"projectcontour.io/": "remote.{{backend}}/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations := map[string]string{
+		translator.LastAppliedConfigAnnotation: "{}",
+		"projectcontour.io/max-connections":    "10",
+		"foo":                                  "bar",
+	}
+	expected := map[string]string{
+		"remote.cluster1/max-connections": "10",
+		"foo":                             "bar",
+	}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kuard", Labels: map[string]string{"app": "kuard"}, Annotations: annotations},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}, Selector: map[string]string{"app": "kuard"}},
+	}
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kuard", Labels: map[string]string{"app": "kuard"}, Annotations: annotations},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "172.17.0.4"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+		}},
+	}
+	original := service.DeepCopy()
+	originalEndpoints := endpoints.DeepCopy()
+
+	svc := translateService(service, "cluster1", "default", policy, AddressModePod, ExternalNameModeService)
+	assert.Equal(t, expected, svc.Annotations)
+	ep := translateEndpoints(endpoints, "cluster1", "default", policy)
+	assert.Equal(t, expected, ep.Annotations)
+
+	// Changing the translated objects leaves the remote objects alone
+	svc.Labels["foo"] = "bar"
+	svc.Annotations["foo"] = "baz"
+	ep.Labels["foo"] = "bar"
+	ep.Subsets[0].Addresses[0].IP = "172.17.0.5"
+	assert.Equal(t, original, service)
+	assert.Equal(t, originalEndpoints, endpoints)
+}
@@ -0,0 +1,197 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package leader elects a leader among the replicas of a discoverer
+package leader
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// DefaultLeaseDuration is the default duration that standby replicas
+	// wait before taking over a lease that is not renewed
+	DefaultLeaseDuration = 15 * time.Second
+	// DefaultRenewDeadline is the default duration that the leader retries
+	// renewing its lease before giving up leadership
+	DefaultRenewDeadline = 10 * time.Second
+	// DefaultRetryPeriod is the default duration between attempts to
+	// acquire or renew a lease
+	DefaultRetryPeriod = 2 * time.Second
+)
+
+// Config configures the election of the leader of the replicas of a
+// discoverer. The election uses a Lease per backend in the Gimbal cluster.
+type Config struct {
+	// Client is the client of the Gimbal cluster
+	Client kubernetes.Interface
+	// Namespace is the namespace of the leases
+	Namespace string
+	// Identity is the unique identity of the replica. See DefaultIdentity.
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// DefaultNamespace returns the namespace of the pod of the discoverer, from
+// the POD_NAMESPACE environment variable, or gimbal-discovery.
+func DefaultNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	return "gimbal-discovery"
+}
+
+// DefaultIdentity returns an identity built from the host name, which is the
+// pod name when running in Kubernetes, and a random suffix so that restarted
+// replicas do not reuse the lease of their previous incarnation.
+func DefaultIdentity() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return hostname + "_" + hex.EncodeToString(suffix), nil
+}
+
+// LeaseName returns the name of the lease of the given backend
+func LeaseName(backendName string) string {
+	return "gimbal-discoverer-" + backendName
+}
+
+// Elector elects the replica that discovers a backend. Replicas that are not
+// the leader keep watching the backend, but must not write to Gimbal. A nil
+// Elector is always the leader, for discoverers that run a single replica.
+type Elector struct {
+	config      Config
+	backendName string
+	log         *logrus.Logger
+	metrics     localmetrics.DiscovererMetrics
+
+	leading int32
+}
+
+// Validate returns an error if the configuration cannot be used to elect a
+// leader.
+func (c Config) Validate() error {
+	if c.Client == nil {
+		return fmt.Errorf("leader election requires a client of the Gimbal cluster")
+	}
+	if c.Namespace == "" {
+		return fmt.Errorf("leader election requires a namespace")
+	}
+	if c.Identity == "" {
+		return fmt.Errorf("leader election requires an identity")
+	}
+	if c.LeaseDuration <= c.RenewDeadline {
+		return fmt.Errorf("lease duration %v must be greater than renew deadline %v", c.LeaseDuration, c.RenewDeadline)
+	}
+	if c.RenewDeadline <= time.Duration(leaderelection.JitterFactor*float64(c.RetryPeriod)) {
+		return fmt.Errorf("renew deadline %v must be greater than %v times the retry period %v",
+			c.RenewDeadline, leaderelection.JitterFactor, c.RetryPeriod)
+	}
+	return nil
+}
+
+// NewElector returns an Elector of the leader of the given backend. The
+// configuration must be valid. Metrics record the leadership state of the
+// replica.
+func NewElector(config Config, backendName string, log *logrus.Logger, metrics localmetrics.DiscovererMetrics) *Elector {
+	e := &Elector{config: config, backendName: backendName, log: log, metrics: metrics}
+	e.metrics.DiscovererLeaderMetric(false)
+	return e
+}
+
+// IsLeader returns true if the replica is the leader.
+func (e *Elector) IsLeader() bool {
+	return e == nil || atomic.LoadInt32(&e.leading) == 1
+}
+
+// Run campaigns for leadership until stopCh is closed, calling
+// onStartedLeading every time the replica becomes the leader. When it closes,
+// the lease is released, so that a standby replica takes over without
+// waiting for the lease to expire.
+func (e *Elector) Run(stopCh <-chan struct{}, onStartedLeading func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	for {
+		le, err := e.leaderElector(onStartedLeading)
+		if err != nil {
+			e.log.Errorf("Error running leader election of backend %s: %v", e.backendName, err)
+			return
+		}
+		// Returns when leadership is lost, then campaign again
+		le.Run(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+func (e *Elector) leaderElector(onStartedLeading func()) (*leaderelection.LeaderElector, error) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: e.config.Namespace, Name: LeaseName(e.backendName)},
+		Client:     e.config.Client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: e.config.Identity},
+	}
+	return leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   e.config.LeaseDuration,
+		RenewDeadline:   e.config.RenewDeadline,
+		RetryPeriod:     e.config.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            LeaseName(e.backendName),
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				e.log.Infof("Started leading backend %s as %s", e.backendName, e.config.Identity)
+				atomic.StoreInt32(&e.leading, 1)
+				e.metrics.DiscovererLeaderMetric(true)
+				onStartedLeading()
+			},
+			OnStoppedLeading: func() {
+				e.log.Infof("Stopped leading backend %s", e.backendName)
+				atomic.StoreInt32(&e.leading, 0)
+				e.metrics.DiscovererLeaderMetric(false)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != e.config.Identity {
+					e.log.Infof("Backend %s is led by %s", e.backendName, identity)
+				}
+			},
+		},
+	})
+}
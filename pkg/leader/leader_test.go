@@ -0,0 +1,126 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package leader
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testConfig(client kubernetes.Interface, identity string) Config {
+	return Config{
+		Client:        client,
+		Namespace:     "gimbal-discovery",
+		Identity:      identity,
+		LeaseDuration: 1 * time.Second,
+		RenewDeadline: 500 * time.Millisecond,
+		RetryPeriod:   100 * time.Millisecond,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(c *Config) {}},
+		{name: "no client", modify: func(c *Config) { c.Client = nil }, wantErr: true},
+		{name: "no namespace", modify: func(c *Config) { c.Namespace = "" }, wantErr: true},
+		{name: "no identity", modify: func(c *Config) { c.Identity = "" }, wantErr: true},
+		{name: "lease shorter than renew deadline", modify: func(c *Config) { c.LeaseDuration = c.RenewDeadline }, wantErr: true},
+		{name: "renew deadline too short", modify: func(c *Config) { c.RetryPeriod = c.RenewDeadline }, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig(client, "replica-a")
+			tc.modify(&config)
+			err := config.Validate()
+			assert.Equal(t, tc.wantErr, err != nil, "got error %v", err)
+		})
+	}
+}
+
+func TestNilElectorIsLeader(t *testing.T) {
+	var e *Elector
+	assert.True(t, e.IsLeader())
+}
+
+func TestElector(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	metrics := localmetrics.NewMetrics("kubernetes", "cluster1")
+	metrics.RegisterPrometheus(false)
+
+	leaderMetric := func() float64 {
+		gathering, err := metrics.Registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range gathering {
+			if mf.GetName() == localmetrics.DiscovererLeaderGauge {
+				return mf.Metric[0].Gauge.GetValue()
+			}
+		}
+		return -1
+	}
+
+	first := NewElector(testConfig(client, "replica-a"), "cluster1", logrus.New(), metrics)
+	second := NewElector(testConfig(client, "replica-b"), "cluster1", logrus.New(), localmetrics.NewMetrics("kubernetes", "cluster1"))
+	assert.False(t, first.IsLeader())
+	assert.Equal(t, 0.0, leaderMetric())
+
+	firstStop := make(chan struct{})
+	elected := make(chan struct{}, 1)
+	go first.Run(firstStop, func() { elected <- struct{}{} })
+	select {
+	case <-elected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first replica was not elected")
+	}
+	assert.True(t, first.IsLeader())
+	assert.Equal(t, 1.0, leaderMetric())
+
+	lease, err := client.CoordinationV1().Leases("gimbal-discovery").Get(context.TODO(), LeaseName("cluster1"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "replica-a", *lease.Spec.HolderIdentity)
+
+	// The second replica stays a standby while the first leads
+	secondStop := make(chan struct{})
+	defer close(secondStop)
+	go second.Run(secondStop, func() { elected <- struct{}{} })
+	time.Sleep(300 * time.Millisecond)
+	assert.False(t, second.IsLeader())
+
+	// Stopping the first replica releases the lease to the second
+	close(firstStop)
+	select {
+	case <-elected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second replica was not elected")
+	}
+	assert.True(t, second.IsLeader())
+	// The first replica steps down once it released the lease
+	assert.Eventually(t, func() bool { return !first.IsLeader() && leaderMetric() == 0 }, time.Second, 10*time.Millisecond)
+}
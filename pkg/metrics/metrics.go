@@ -30,21 +30,28 @@ type DiscovererMetrics struct {
 }
 
 const (
-	ServiceEventTimestampGauge              = "gimbal_service_event_timestamp"
-	EndpointsEventTimestampGauge            = "gimbal_endpoints_event_timestamp"
-	ServiceErrorTotalCounter                = "gimbal_service_error_total"
-	EndpointsErrorTotalCounter              = "gimbal_endpoints_error_total"
-	QueueSizeGauge                          = "gimbal_queuesize"
-	DiscovererAPILatencyMsHistogram         = "gimbal_discoverer_api_latency_milliseconds"
-	DiscovererCycleDurationSecondsHistogram = "gimbal_discoverer_cycle_duration_seconds"
-	DiscovererErrorTotal                    = "gimbal_discoverer_error_total"
-	DiscovererUpstreamServicesGauge         = "gimbal_discoverer_upstream_services_total"
-	DiscovererReplicatedServicesGauge       = "gimbal_discoverer_replicated_services_total"
-	DiscovererInvalidServicesGauge          = "gimbal_discoverer_invalid_services_total"
-	DiscovererUpstreamEndpointsGauge        = "gimbal_discoverer_upstream_endpoints_total"
-	DiscovererReplicatedEndpointsGauge      = "gimbal_discoverer_replicated_endpoints_total"
-	DiscovererInvalidEndpointsGauge         = "gimbal_discoverer_invalid_endpoints_total"
-	DiscovererInfoGauge                     = "gimbal_discoverer_info"
+	ServiceEventTimestampGauge                = "gimbal_service_event_timestamp"
+	EndpointsEventTimestampGauge              = "gimbal_endpoints_event_timestamp"
+	ServiceErrorTotalCounter                  = "gimbal_service_error_total"
+	EndpointsErrorTotalCounter                = "gimbal_endpoints_error_total"
+	QueueSizeGauge                            = "gimbal_queuesize"
+	DiscovererAPILatencyMsHistogram           = "gimbal_discoverer_api_latency_milliseconds"
+	DiscovererCycleDurationSecondsHistogram   = "gimbal_discoverer_cycle_duration_seconds"
+	DiscovererErrorTotal                      = "gimbal_discoverer_error_total"
+	DiscovererUpstreamServicesGauge           = "gimbal_discoverer_upstream_services_total"
+	DiscovererReplicatedServicesGauge         = "gimbal_discoverer_replicated_services_total"
+	DiscovererInvalidServicesGauge            = "gimbal_discoverer_invalid_services_total"
+	DiscovererUpstreamEndpointsGauge          = "gimbal_discoverer_upstream_endpoints_total"
+	DiscovererReplicatedEndpointsGauge        = "gimbal_discoverer_replicated_endpoints_total"
+	DiscovererInvalidEndpointsGauge           = "gimbal_discoverer_invalid_endpoints_total"
+	DiscovererInfoGauge                       = "gimbal_discoverer_info"
+	DiscovererTombstonesTotalCounter          = "gimbal_discoverer_tombstones_total"
+	DiscovererCredentialsReloadsCounter       = "gimbal_discoverer_credentials_reloads_total"
+	DiscovererLeaderGauge                     = "gimbal_discoverer_leader"
+	DiscovererCoalescedUpdatesCounter         = "gimbal_discoverer_coalesced_updates_total"
+	DiscovererProjectDurationSecondsHistogram = "gimbal_discoverer_project_duration_seconds"
+	DiscovererSkippedCyclesCounter            = "gimbal_discoverer_skipped_cycles_total"
+	DiscovererWatchedProjectsGauge            = "gimbal_discoverer_watched_projects"
 )
 
 // NewMetrics returns a map of Prometheus metrics
@@ -161,10 +168,67 @@ func NewMetrics(BackendType, BackendName string) DiscovererMetrics {
 				},
 				[]string{"backendname", "version", "backendtype"},
 			),
+			DiscovererTombstonesTotalCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: DiscovererTombstonesTotalCounter,
+					Help: "Number of deletes that were received as tombstones, after the watch of the backend missed them",
+				},
+				[]string{"backendname", "kind", "backendtype"},
+			),
+			DiscovererCredentialsReloadsCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: DiscovererCredentialsReloadsCounter,
+					Help: "Number of times the credentials of the backend were reloaded after they changed",
+				},
+				[]string{"backendname", "backendtype"},
+			),
+			DiscovererLeaderGauge: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: DiscovererLeaderGauge,
+					Help: "Whether the replica is the leader of the discoverers of the backend (1) or a standby (0)",
+				},
+				[]string{"backendname", "backendtype"},
+			),
+			DiscovererCoalescedUpdatesCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: DiscovererCoalescedUpdatesCounter,
+					Help: "Number of updates that were coalesced with a later update of the same object before being synced",
+				},
+				[]string{"backendname", "kind", "backendtype"},
+			),
+			DiscovererProjectDurationSecondsHistogram: prometheus.NewHistogramVec(
+				prometheus.HistogramOpts{
+					Name:    DiscovererProjectDurationSecondsHistogram,
+					Help:    "The seconds it takes for the objects of a project to be synced from a remote backend",
+					Buckets: prometheus.ExponentialBuckets(0.1, 2, 12), // from 100ms to 204.8s
+				},
+				[]string{"backendname", "namespace", "result", "backendtype"},
+			),
+			DiscovererSkippedCyclesCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: DiscovererSkippedCyclesCounter,
+					Help: "Number of reconciliation cycles that were skipped because the previous one was still running",
+				},
+				[]string{"backendname", "backendtype"},
+			),
+			DiscovererWatchedProjectsGauge: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: DiscovererWatchedProjectsGauge,
+					Help: "The projects reconciled from the backend, along with the watchlist selector that matched them",
+				},
+				[]string{"backendname", "namespace", "selector", "backendtype"},
+			),
 		},
 	}
 }
 
+// WithBackendName returns a copy of the metrics that records values for the
+// given backend. The copy shares its registry and collectors with d.
+func (d DiscovererMetrics) WithBackendName(backendName string) DiscovererMetrics {
+	d.BackendName = backendName
+	return d
+}
+
 // RegisterPrometheus registers the Metrics
 func (d *DiscovererMetrics) RegisterPrometheus(registerDefault bool) {
 
@@ -291,3 +355,78 @@ func (d *DiscovererMetrics) DiscovererInfoMetric(version string) {
 		m.WithLabelValues(d.BackendName, version, d.BackendType).Set(1)
 	}
 }
+
+// DiscovererTombstoneMetric increments the number of tombstones received for
+// the given kind of object
+func (d *DiscovererMetrics) DiscovererTombstoneMetric(kind string) {
+	m, ok := d.Metrics[DiscovererTombstonesTotalCounter].(*prometheus.CounterVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, kind, d.BackendType).Inc()
+	}
+}
+
+// CredentialsReloadMetric increments the number of times the credentials of
+// the backend were reloaded
+func (d *DiscovererMetrics) CredentialsReloadMetric() {
+	m, ok := d.Metrics[DiscovererCredentialsReloadsCounter].(*prometheus.CounterVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, d.BackendType).Inc()
+	}
+}
+
+// CoalescedUpdateMetric increments the number of updates of the given kind of
+// object that were coalesced with a later update
+func (d *DiscovererMetrics) CoalescedUpdateMetric(kind string) {
+	m, ok := d.Metrics[DiscovererCoalescedUpdatesCounter].(*prometheus.CounterVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, kind, d.BackendType).Inc()
+	}
+}
+
+// DiscovererLeaderMetric records whether the replica leads the backend
+func (d *DiscovererMetrics) DiscovererLeaderMetric(leader bool) {
+	m, ok := d.Metrics[DiscovererLeaderGauge].(*prometheus.GaugeVec)
+	if ok {
+		value := 0.0
+		if leader {
+			value = 1
+		}
+		m.WithLabelValues(d.BackendName, d.BackendType).Set(value)
+	}
+}
+
+// ProjectDurationMetric records the duration and result of the
+// reconciliation of a project
+func (d *DiscovererMetrics) ProjectDurationMetric(namespace, result string, duration time.Duration) {
+	m, ok := d.Metrics[DiscovererProjectDurationSecondsHistogram].(*prometheus.HistogramVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, namespace, result, d.BackendType).Observe(duration.Seconds())
+	}
+}
+
+// SkippedCycleMetric records a reconciliation cycle skipped because the
+// previous one was still running
+func (d *DiscovererMetrics) SkippedCycleMetric() {
+	m, ok := d.Metrics[DiscovererSkippedCyclesCounter].(*prometheus.CounterVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, d.BackendType).Inc()
+	}
+}
+
+// WatchedProjectMetric records the watchlist selector that matched a
+// reconciled project
+func (d *DiscovererMetrics) WatchedProjectMetric(namespace, selector string) {
+	m, ok := d.Metrics[DiscovererWatchedProjectsGauge].(*prometheus.GaugeVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, namespace, selector, d.BackendType).Set(1)
+	}
+}
+
+// DeleteWatchedProjectMetric forgets a project that is no longer reconciled,
+// or that is matched by another selector
+func (d *DiscovererMetrics) DeleteWatchedProjectMetric(namespace, selector string) {
+	m, ok := d.Metrics[DiscovererWatchedProjectsGauge].(*prometheus.GaugeVec)
+	if ok {
+		m.DeleteLabelValues(d.BackendName, namespace, selector, d.BackendType)
+	}
+}
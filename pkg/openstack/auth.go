@@ -0,0 +1,323 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gophercloud/gophercloud"
+	"sigs.k8s.io/yaml"
+)
+
+// AuthMethod is the method used to authenticate with OpenStack
+type AuthMethod string
+
+const (
+	// AuthMethodPassword authenticates with a username and password
+	AuthMethodPassword AuthMethod = "password"
+	// AuthMethodApplicationCredential authenticates with an application
+	// credential, which is scoped to the project it was created in
+	AuthMethodApplicationCredential AuthMethod = "application credential"
+	// AuthMethodToken authenticates with an existing token
+	AuthMethodToken AuthMethod = "token"
+)
+
+// parseAuthType returns the AuthMethod of an OS_AUTH_TYPE or clouds.yaml
+// auth_type. If the auth type is empty, the method is inferred from the
+// configured credentials.
+func parseAuthType(authType string, config AuthConfig) (AuthMethod, error) {
+	switch authType {
+	case "":
+		if config.ApplicationCredentialID != "" || config.ApplicationCredentialName != "" {
+			return AuthMethodApplicationCredential, nil
+		}
+		if config.Token != "" {
+			return AuthMethodToken, nil
+		}
+		return AuthMethodPassword, nil
+	case "password", "v3password":
+		return AuthMethodPassword, nil
+	case "applicationcredential", "v3applicationcredential":
+		return AuthMethodApplicationCredential, nil
+	case "token", "v3token":
+		return AuthMethodToken, nil
+	}
+	return "", fmt.Errorf("unsupported OpenStack auth type %q, must be one of password, v3applicationcredential or token", authType)
+}
+
+// AuthConfig is the configuration used to authenticate with OpenStack, read
+// from OS_* environment variables or from a cloud of a clouds.yaml file.
+type AuthConfig struct {
+	Method  AuthMethod
+	AuthURL string
+	// Credentials are the username and password of password authentication.
+	// The username also identifies the user of application credentials
+	// referred to by name.
+	Credentials    Credentials
+	UserDomainID   string
+	UserDomainName string
+
+	// The project or domain the token is scoped to. Application credentials
+	// are always scoped to their project.
+	ProjectID         string
+	ProjectName       string
+	ProjectDomainID   string
+	ProjectDomainName string
+	DomainID          string
+	DomainName        string
+
+	ApplicationCredentialID     string
+	ApplicationCredentialName   string
+	ApplicationCredentialSecret string
+
+	Token string
+
+	RegionName string
+	CACertFile string
+}
+
+// AuthConfigFromEnv returns the AuthConfig of the OS_* environment variables
+// returned by getenv.
+func AuthConfigFromEnv(getenv func(string) string) (AuthConfig, error) {
+	config := AuthConfig{
+		AuthURL:                     getenv("OS_AUTH_URL"),
+		Credentials:                 Credentials{Username: getenv("OS_USERNAME"), Password: getenv("OS_PASSWORD")},
+		UserDomainID:                getenv("OS_USER_DOMAIN_ID"),
+		UserDomainName:              getenv("OS_USER_DOMAIN_NAME"),
+		ProjectID:                   firstNonEmpty(getenv("OS_PROJECT_ID"), getenv("OS_TENANT_ID")),
+		ProjectName:                 firstNonEmpty(getenv("OS_PROJECT_NAME"), getenv("OS_TENANT_NAME")),
+		ProjectDomainID:             getenv("OS_PROJECT_DOMAIN_ID"),
+		ProjectDomainName:           getenv("OS_PROJECT_DOMAIN_NAME"),
+		DomainID:                    getenv("OS_DOMAIN_ID"),
+		DomainName:                  getenv("OS_DOMAIN_NAME"),
+		ApplicationCredentialID:     getenv("OS_APPLICATION_CREDENTIAL_ID"),
+		ApplicationCredentialName:   getenv("OS_APPLICATION_CREDENTIAL_NAME"),
+		ApplicationCredentialSecret: getenv("OS_APPLICATION_CREDENTIAL_SECRET"),
+		Token:                       getenv("OS_TOKEN"),
+		RegionName:                  getenv("OS_REGION_NAME"),
+		CACertFile:                  getenv("OS_CACERT"),
+	}
+	method, err := parseAuthType(getenv("OS_AUTH_TYPE"), config)
+	if err != nil {
+		return AuthConfig{}, err
+	}
+	config.Method = method
+	return config, nil
+}
+
+// cloudsFile is the subset of a clouds.yaml file used by the discoverer
+type cloudsFile struct {
+	Clouds map[string]struct {
+		AuthType   string `json:"auth_type"`
+		RegionName string `json:"region_name"`
+		CACert     string `json:"cacert"`
+		Auth       struct {
+			AuthURL                     string `json:"auth_url"`
+			Username                    string `json:"username"`
+			Password                    string `json:"password"`
+			UserDomainID                string `json:"user_domain_id"`
+			UserDomainName              string `json:"user_domain_name"`
+			ProjectID                   string `json:"project_id"`
+			ProjectName                 string `json:"project_name"`
+			ProjectDomainID             string `json:"project_domain_id"`
+			ProjectDomainName           string `json:"project_domain_name"`
+			DomainID                    string `json:"domain_id"`
+			DomainName                  string `json:"domain_name"`
+			ApplicationCredentialID     string `json:"application_credential_id"`
+			ApplicationCredentialName   string `json:"application_credential_name"`
+			ApplicationCredentialSecret string `json:"application_credential_secret"`
+			Token                       string `json:"token"`
+		} `json:"auth"`
+	} `json:"clouds"`
+}
+
+// FindCloudsFile returns the path of the clouds.yaml file, looked up the same
+// way as the OpenStack CLI: the OS_CLIENT_CONFIG_FILE file, then clouds.yaml
+// in the current directory, in ~/.config/openstack and in /etc/openstack.
+func FindCloudsFile(getenv func(string) string) (string, error) {
+	if path := getenv("OS_CLIENT_CONFIG_FILE"); path != "" {
+		return path, nil
+	}
+	paths := []string{"clouds.yaml"}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".config", "openstack", "clouds.yaml"))
+	}
+	paths = append(paths, filepath.Join("/etc", "openstack", "clouds.yaml"))
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no clouds.yaml file found in %v, set OS_CLIENT_CONFIG_FILE", paths)
+}
+
+// AuthConfigFromCloudsFile returns the AuthConfig of the given cloud of a
+// clouds.yaml file.
+func AuthConfigFromCloudsFile(path, cloud string) (AuthConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return AuthConfig{}, fmt.Errorf("error reading clouds file: %v", err)
+	}
+	var file cloudsFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return AuthConfig{}, fmt.Errorf("error parsing clouds file %s: %v", path, err)
+	}
+	c, ok := file.Clouds[cloud]
+	if !ok {
+		return AuthConfig{}, fmt.Errorf("cloud %q not found in clouds file %s", cloud, path)
+	}
+	config := AuthConfig{
+		AuthURL:                     c.Auth.AuthURL,
+		Credentials:                 Credentials{Username: c.Auth.Username, Password: c.Auth.Password},
+		UserDomainID:                c.Auth.UserDomainID,
+		UserDomainName:              c.Auth.UserDomainName,
+		ProjectID:                   c.Auth.ProjectID,
+		ProjectName:                 c.Auth.ProjectName,
+		ProjectDomainID:             c.Auth.ProjectDomainID,
+		ProjectDomainName:           c.Auth.ProjectDomainName,
+		DomainID:                    c.Auth.DomainID,
+		DomainName:                  c.Auth.DomainName,
+		ApplicationCredentialID:     c.Auth.ApplicationCredentialID,
+		ApplicationCredentialName:   c.Auth.ApplicationCredentialName,
+		ApplicationCredentialSecret: c.Auth.ApplicationCredentialSecret,
+		Token:                       c.Auth.Token,
+		RegionName:                  c.RegionName,
+		CACertFile:                  c.CACert,
+	}
+	method, err := parseAuthType(c.AuthType, config)
+	if err != nil {
+		return AuthConfig{}, fmt.Errorf("cloud %q: %v", cloud, err)
+	}
+	config.Method = method
+	return config, nil
+}
+
+// Validate returns an error naming the authentication method if the
+// configuration is incomplete or ambiguous.
+func (c AuthConfig) Validate() error {
+	if err := c.validate(); err != nil {
+		return fmt.Errorf("%s authentication: %v", c.Method, err)
+	}
+	return nil
+}
+
+func (c AuthConfig) validate() error {
+	if c.AuthURL == "" {
+		return fmt.Errorf("the authentication URL must be set with OS_AUTH_URL or auth_url")
+	}
+	if c.UserDomainID != "" && c.UserDomainName != "" {
+		return fmt.Errorf("only one of the user domain ID and name can be set")
+	}
+	switch c.Method {
+	case AuthMethodPassword:
+		if c.Credentials.Username == "" {
+			return fmt.Errorf("the username must be set with OS_USERNAME, OS_USERNAME_FILE or username")
+		}
+		if c.Credentials.Password == "" {
+			return fmt.Errorf("the password must be set with OS_PASSWORD, OS_PASSWORD_FILE or password")
+		}
+		return c.validateScope()
+	case AuthMethodApplicationCredential:
+		if c.ApplicationCredentialID == "" && c.ApplicationCredentialName == "" {
+			return fmt.Errorf("the application credential ID must be set with OS_APPLICATION_CREDENTIAL_ID or application_credential_id")
+		}
+		if c.ApplicationCredentialSecret == "" {
+			return fmt.Errorf("the application credential secret must be set with OS_APPLICATION_CREDENTIAL_SECRET or application_credential_secret")
+		}
+		if c.ApplicationCredentialID == "" && c.Credentials.Username == "" {
+			return fmt.Errorf("the username must be set to use an application credential name")
+		}
+		return nil
+	case AuthMethodToken:
+		if c.Token == "" {
+			return fmt.Errorf("the token must be set with OS_TOKEN or token")
+		}
+		return c.validateScope()
+	}
+	return fmt.Errorf("unsupported authentication method")
+}
+
+// validateScope makes sure that the token is scoped to exactly one project or
+// domain, so that projects can be listed
+func (c AuthConfig) validateScope() error {
+	switch {
+	case c.ProjectID != "" && c.ProjectName != "":
+		return fmt.Errorf("only one of the project ID and name can be set")
+	case c.ProjectID != "" || c.ProjectName != "":
+		if c.DomainID != "" || c.DomainName != "" {
+			return fmt.Errorf("the token can be scoped to a project or to a domain, not both")
+		}
+		if c.ProjectDomainID != "" && c.ProjectDomainName != "" {
+			return fmt.Errorf("only one of the project domain ID and name can be set")
+		}
+	case c.DomainID != "" && c.DomainName != "":
+		return fmt.Errorf("only one of the domain ID and name can be set")
+	case c.DomainID == "" && c.DomainName == "":
+		return fmt.Errorf("the project must be set with OS_PROJECT_ID, OS_PROJECT_NAME or OS_TENANT_NAME, or the domain with OS_DOMAIN_ID or OS_DOMAIN_NAME")
+	}
+	return nil
+}
+
+// AuthOptions returns the gophercloud options of the configuration. The
+// username and password are set by the Authenticator.
+func (c AuthConfig) AuthOptions() gophercloud.AuthOptions {
+	options := gophercloud.AuthOptions{IdentityEndpoint: c.AuthURL}
+	switch c.Method {
+	case AuthMethodApplicationCredential:
+		options.ApplicationCredentialID = c.ApplicationCredentialID
+		options.ApplicationCredentialName = c.ApplicationCredentialName
+		options.ApplicationCredentialSecret = c.ApplicationCredentialSecret
+		if c.ApplicationCredentialID == "" {
+			options.DomainID = c.UserDomainID
+			options.DomainName = c.UserDomainName
+		}
+		return options
+	case AuthMethodToken:
+		options.TokenID = c.Token
+	default:
+		options.DomainID = c.UserDomainID
+		options.DomainName = c.UserDomainName
+	}
+
+	scope := &gophercloud.AuthScope{ProjectID: c.ProjectID, DomainID: c.DomainID, DomainName: c.DomainName}
+	if c.ProjectName != "" {
+		// Projects named without a domain are looked up in the domain of
+		// the user
+		scope.ProjectName = c.ProjectName
+		switch {
+		case c.ProjectDomainID != "":
+			scope.DomainID = c.ProjectDomainID
+		case c.ProjectDomainName != "":
+			scope.DomainName = c.ProjectDomainName
+		case c.UserDomainID != "":
+			scope.DomainID = c.UserDomainID
+		default:
+			scope.DomainName = c.UserDomainName
+		}
+	}
+	options.Scope = scope
+	return options
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
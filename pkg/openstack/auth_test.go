@@ -0,0 +1,346 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gophercloud/gophercloud"
+	gopheropenstack "github.com/gophercloud/gophercloud/openstack"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected AuthConfig
+		err      bool
+	}{
+		{
+			name: "password",
+			env: map[string]string{
+				"OS_AUTH_URL":         "https://keystone/v3",
+				"OS_USERNAME":         "admin",
+				"OS_PASSWORD":         "secret",
+				"OS_TENANT_NAME":      "gimbal",
+				"OS_USER_DOMAIN_NAME": "Default",
+			},
+			expected: AuthConfig{
+				Method:         AuthMethodPassword,
+				AuthURL:        "https://keystone/v3",
+				Credentials:    Credentials{Username: "admin", Password: "secret"},
+				UserDomainName: "Default",
+				ProjectName:    "gimbal",
+			},
+		},
+		{
+			name: "project name overrides tenant name",
+			env: map[string]string{
+				"OS_USERNAME":     "admin",
+				"OS_PROJECT_NAME": "project",
+				"OS_TENANT_NAME":  "tenant",
+			},
+			expected: AuthConfig{
+				Method:      AuthMethodPassword,
+				Credentials: Credentials{Username: "admin"},
+				ProjectName: "project",
+			},
+		},
+		{
+			name: "application credential",
+			env: map[string]string{
+				"OS_AUTH_URL":                      "https://keystone/v3",
+				"OS_APPLICATION_CREDENTIAL_ID":     "id",
+				"OS_APPLICATION_CREDENTIAL_SECRET": "secret",
+			},
+			expected: AuthConfig{
+				Method:                      AuthMethodApplicationCredential,
+				AuthURL:                     "https://keystone/v3",
+				ApplicationCredentialID:     "id",
+				ApplicationCredentialSecret: "secret",
+			},
+		},
+		{
+			name: "token",
+			env: map[string]string{
+				"OS_TOKEN":     "token",
+				"OS_DOMAIN_ID": "default",
+			},
+			expected: AuthConfig{
+				Method:   AuthMethodToken,
+				Token:    "token",
+				DomainID: "default",
+			},
+		},
+		{
+			name: "auth type overrides inferred method",
+			env: map[string]string{
+				"OS_AUTH_TYPE": "v3password",
+				"OS_TOKEN":     "token",
+			},
+			expected: AuthConfig{
+				Method: AuthMethodPassword,
+				Token:  "token",
+			},
+		},
+		{
+			name: "unsupported auth type",
+			env:  map[string]string{"OS_AUTH_TYPE": "v3oidcpassword"},
+			err:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := AuthConfigFromEnv(func(key string) string { return tc.env[key] })
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, config)
+		})
+	}
+}
+
+func TestAuthConfigFromCloudsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clouds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "clouds.yaml")
+	clouds := `
+clouds:
+  password:
+    region_name: RegionOne
+    cacert: /etc/ssl/openstack.pem
+    auth:
+      auth_url: https://keystone/v3
+      username: admin
+      password: secret
+      project_id: 8d0ec6a5f1b44b8e
+      user_domain_id: default
+  appcred:
+    auth_type: v3applicationcredential
+    auth:
+      auth_url: https://keystone/v3
+      application_credential_id: id
+      application_credential_secret: secret
+  oidc:
+    auth_type: v3oidcpassword
+`
+	if err := ioutil.WriteFile(path, []byte(clouds), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := AuthConfigFromCloudsFile(path, "password")
+	assert.NoError(t, err)
+	assert.Equal(t, AuthConfig{
+		Method:       AuthMethodPassword,
+		AuthURL:      "https://keystone/v3",
+		Credentials:  Credentials{Username: "admin", Password: "secret"},
+		UserDomainID: "default",
+		ProjectID:    "8d0ec6a5f1b44b8e",
+		RegionName:   "RegionOne",
+		CACertFile:   "/etc/ssl/openstack.pem",
+	}, config)
+
+	config, err = AuthConfigFromCloudsFile(path, "appcred")
+	assert.NoError(t, err)
+	assert.Equal(t, AuthConfig{
+		Method:                      AuthMethodApplicationCredential,
+		AuthURL:                     "https://keystone/v3",
+		ApplicationCredentialID:     "id",
+		ApplicationCredentialSecret: "secret",
+	}, config)
+
+	_, err = AuthConfigFromCloudsFile(path, "oidc")
+	assert.Error(t, err)
+
+	_, err = AuthConfigFromCloudsFile(path, "missing")
+	assert.EqualError(t, err, `cloud "missing" not found in clouds file `+path)
+
+	found, err := FindCloudsFile(func(key string) string { return map[string]string{"OS_CLIENT_CONFIG_FILE": path}[key] })
+	assert.NoError(t, err)
+	assert.Equal(t, path, found)
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	password := AuthConfig{
+		Method:         AuthMethodPassword,
+		AuthURL:        "https://keystone/v3",
+		Credentials:    Credentials{Username: "admin", Password: "secret"},
+		UserDomainName: "Default",
+		ProjectName:    "gimbal",
+	}
+	tests := []struct {
+		name   string
+		config func(c *AuthConfig)
+		err    string
+	}{
+		{
+			name:   "password",
+			config: func(c *AuthConfig) {},
+		},
+		{
+			name:   "missing password",
+			config: func(c *AuthConfig) { c.Credentials.Password = "" },
+			err:    "password authentication: the password must be set with OS_PASSWORD, OS_PASSWORD_FILE or password",
+		},
+		{
+			name:   "domain scope",
+			config: func(c *AuthConfig) { c.ProjectName = ""; c.DomainID = "default" },
+		},
+		{
+			name:   "missing scope",
+			config: func(c *AuthConfig) { c.ProjectName = "" },
+			err:    "password authentication: the project must be set with OS_PROJECT_ID, OS_PROJECT_NAME or OS_TENANT_NAME, or the domain with OS_DOMAIN_ID or OS_DOMAIN_NAME",
+		},
+		{
+			name:   "project and domain scope",
+			config: func(c *AuthConfig) { c.DomainID = "default" },
+			err:    "password authentication: the token can be scoped to a project or to a domain, not both",
+		},
+		{
+			name: "application credential",
+			config: func(c *AuthConfig) {
+				*c = AuthConfig{Method: AuthMethodApplicationCredential, AuthURL: c.AuthURL, ApplicationCredentialID: "id", ApplicationCredentialSecret: "secret"}
+			},
+		},
+		{
+			name: "application credential without secret",
+			config: func(c *AuthConfig) {
+				*c = AuthConfig{Method: AuthMethodApplicationCredential, AuthURL: c.AuthURL, ApplicationCredentialID: "id"}
+			},
+			err: "application credential authentication: the application credential secret must be set with OS_APPLICATION_CREDENTIAL_SECRET or application_credential_secret",
+		},
+		{
+			name: "token without token",
+			config: func(c *AuthConfig) {
+				*c = AuthConfig{Method: AuthMethodToken, AuthURL: c.AuthURL, ProjectID: "0123"}
+			},
+			err: "token authentication: the token must be set with OS_TOKEN or token",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := password
+			tc.config(&config)
+			err := config.Validate()
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestAuthConfigAuthOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   AuthConfig
+		expected gophercloud.AuthOptions
+	}{
+		{
+			name: "password scoped to a project of the user domain",
+			config: AuthConfig{
+				Method:         AuthMethodPassword,
+				AuthURL:        "https://keystone/v3",
+				UserDomainName: "Default",
+				ProjectName:    "gimbal",
+			},
+			expected: gophercloud.AuthOptions{
+				IdentityEndpoint: "https://keystone/v3",
+				DomainName:       "Default",
+				Scope:            &gophercloud.AuthScope{ProjectName: "gimbal", DomainName: "Default"},
+			},
+		},
+		{
+			name: "password scoped to a project of another domain",
+			config: AuthConfig{
+				Method:          AuthMethodPassword,
+				UserDomainName:  "Default",
+				ProjectName:     "gimbal",
+				ProjectDomainID: "projects",
+			},
+			expected: gophercloud.AuthOptions{
+				DomainName: "Default",
+				Scope:      &gophercloud.AuthScope{ProjectName: "gimbal", DomainID: "projects"},
+			},
+		},
+		{
+			name: "token scoped to a domain",
+			config: AuthConfig{
+				Method:   AuthMethodToken,
+				Token:    "token",
+				DomainID: "default",
+			},
+			expected: gophercloud.AuthOptions{
+				TokenID: "token",
+				Scope:   &gophercloud.AuthScope{DomainID: "default"},
+			},
+		},
+		{
+			name: "application credential is not scoped",
+			config: AuthConfig{
+				Method:                      AuthMethodApplicationCredential,
+				ApplicationCredentialID:     "id",
+				ApplicationCredentialSecret: "secret",
+				UserDomainName:              "Default",
+				ProjectID:                   "0123",
+			},
+			expected: gophercloud.AuthOptions{
+				ApplicationCredentialID:     "id",
+				ApplicationCredentialSecret: "secret",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.config.AuthOptions())
+		})
+	}
+}
+
+func TestAuthenticatorErrorNamesMethod(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	provider, err := gopheropenstack.NewClient(server.URL + "/v3/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := AuthConfig{
+		Method:                      AuthMethodApplicationCredential,
+		AuthURL:                     server.URL + "/v3/",
+		ApplicationCredentialID:     "id",
+		ApplicationCredentialSecret: "wrong",
+	}
+	err = NewAuthenticator(provider, config.AuthOptions()).Authenticate(config.Credentials)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "application credential authentication failed")
+	}
+}
@@ -19,9 +19,13 @@ import (
 
 	"github.com/gophercloud/gophercloud"
 	gopheropenstack "github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/availabilityzones"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
 	"github.com/gophercloud/gophercloud/openstack/identity/v3/projects"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/l7policies"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/listeners"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/monitors"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
 )
 
@@ -39,13 +43,93 @@ func NewIdentityV3(provider *gophercloud.ProviderClient) (*IdentityV3Client, err
 	return &IdentityV3Client{c}, nil
 }
 
+// Project is an OpenStack project along with its Keystone tags, which
+// gophercloud does not extract
+type Project struct {
+	projects.Project
+	Tags []string `json:"tags"`
+}
+
 // ListProjects returns the list of projects that are available to the user
-func (c *IdentityV3Client) ListProjects() ([]projects.Project, error) {
+func (c *IdentityV3Client) ListProjects() ([]Project, error) {
 	page, err := projects.List(c.client, projects.ListOpts{}).AllPages()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list projects: %v", err)
 	}
-	return projects.ExtractProjects(page)
+	var s struct {
+		Projects []Project `json:"projects"`
+	}
+	err = page.(projects.ProjectPage).ExtractInto(&s)
+	return s.Projects, err
+}
+
+// ComputeV2Client is a client of the OpenStack Nova v2 API
+type ComputeV2Client struct {
+	client *gophercloud.ServiceClient
+}
+
+// NewComputeV2 returns a client of the Nova v2 API
+func NewComputeV2(provider *gophercloud.ProviderClient) (*ComputeV2Client, error) {
+	c, err := gopheropenstack.NewComputeV2(provider, gophercloud.EndpointOpts{})
+	if err != nil {
+		return nil, err
+	}
+	return &ComputeV2Client{c}, nil
+}
+
+// Server is a Nova server, with the availability zone it runs in and its
+// fixed and floating IP addresses
+type Server struct {
+	Name             string
+	AvailabilityZone string
+	Addresses        []string
+}
+
+// ListServers returns the servers that exist in the given project. Listing
+// the servers of other projects than the one of the user requires the admin
+// role.
+func (c *ComputeV2Client) ListServers(projectID string) ([]Server, error) {
+	page, err := servers.List(c.client, servers.ListOpts{AllTenants: true, TenantID: projectID}).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list servers: %v", err)
+	}
+	var extracted []struct {
+		servers.Server
+		availabilityzones.ServerAvailabilityZoneExt
+	}
+	if err := servers.ExtractServersInto(page, &extracted); err != nil {
+		return nil, fmt.Errorf("failed to extract servers: %v", err)
+	}
+
+	var result []Server
+	for _, s := range extracted {
+		result = append(result, Server{
+			Name:             s.Name,
+			AvailabilityZone: s.AvailabilityZone,
+			Addresses:        serverAddresses(s.Server.Addresses),
+		})
+	}
+	return result, nil
+}
+
+// serverAddresses returns the IP addresses of a server, from the addresses of
+// each of its networks.
+func serverAddresses(networks map[string]interface{}) []string {
+	var addresses []string
+	for _, network := range networks {
+		list, ok := network.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, address := range list {
+			if a, ok := address.(map[string]interface{}); ok {
+				if addr, ok := a["addr"].(string); ok && addr != "" {
+					addresses = append(addresses, addr)
+				}
+			}
+		}
+	}
+	return addresses
 }
 
 // LoadBalancerV2Client is a client of the OpenStack LBaaS v2 API
@@ -84,13 +168,20 @@ func (c LoadBalancerV2Client) ListLoadBalancers(projectID string) ([]loadbalance
 		return nil, fmt.Errorf("failed to extract load balancer listeners: %v", err)
 	}
 
-	// hydrate each load balancer resource with its listeners
+	policies, err := c.listL7Policies(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	// hydrate each load balancer resource with its listeners, and each
+	// listener with its L7 policies
 	for i := range lbs {
 		lb := &lbs[i]
 		var listeners []listeners.Listener
 		for _, l := range lis {
 			for _, id := range l.Loadbalancers {
 				if id.ID == lb.ID {
+					l.L7Policies = policies[l.ID]
 					listeners = append(listeners, l)
 				}
 			}
@@ -100,7 +191,36 @@ func (c LoadBalancerV2Client) ListLoadBalancers(projectID string) ([]loadbalance
 	return lbs, nil
 }
 
-// ListPools returns all load balancer pools that exist in the given project
+// listL7Policies returns the L7 policies of the given project, along with
+// their rules, by listener ID
+func (c LoadBalancerV2Client) listL7Policies(projectID string) (map[string][]l7policies.L7Policy, error) {
+	page, err := l7policies.List(c.client, l7policies.ListOpts{TenantID: projectID}).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list L7 policies: %v", err)
+	}
+	ps, err := l7policies.ExtractL7Policies(page)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract L7 policies: %v", err)
+	}
+
+	policies := map[string][]l7policies.L7Policy{}
+	for _, p := range ps {
+		page, err = l7policies.ListRules(c.client, p.ID, l7policies.ListRulesOpts{TenantID: projectID}).AllPages()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list rules of L7 policy ID %q: %v", p.ID, err)
+		}
+		p.Rules, err = l7policies.ExtractRules(page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract rules of L7 policy ID %q: %v", p.ID, err)
+		}
+		policies[p.ListenerID] = append(policies[p.ListenerID], p)
+	}
+	return policies, nil
+}
+
+// ListPools returns all load balancer pools that exist in the given project,
+// along with their members and health monitors. The operating status of the
+// members is read from the status tree of their load balancers.
 func (c LoadBalancerV2Client) ListPools(projectID string) ([]pools.Pool, error) {
 	page, err := pools.List(c.client, pools.ListOpts{TenantID: projectID}).AllPages()
 	if err != nil {
@@ -112,9 +232,25 @@ func (c LoadBalancerV2Client) ListPools(projectID string) ([]pools.Pool, error)
 		return nil, fmt.Errorf("failed extract listener pools: %v", err)
 	}
 
-	// add members to each pool
+	page, err = monitors.List(c.client, monitors.ListOpts{TenantID: projectID}).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list health monitors: %v", err)
+	}
+	ms, err := monitors.ExtractMonitors(page)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract health monitors: %v", err)
+	}
+	monitorsByID := map[string]monitors.Monitor{}
+	for _, m := range ms {
+		monitorsByID[m.ID] = m
+	}
+
+	// add members and the health monitor to each pool
 	for i := range ps {
 		pool := &ps[i]
+		if m, ok := monitorsByID[pool.MonitorID]; ok {
+			pool.Monitor = m
+		}
 		page, err = pools.ListMembers(c.client, pool.ID, pools.ListMembersOpts{TenantID: projectID}).AllPages()
 		if err != nil {
 			return nil, fmt.Errorf("failed to list members of pool ID %q: %v", pool.ID, err)
@@ -126,5 +262,18 @@ func (c LoadBalancerV2Client) ListPools(projectID string) ([]pools.Pool, error)
 		pool.Members = m
 	}
 
+	statuses, err := c.memberStatuses(ps)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ps {
+		for j := range ps[i].Members {
+			member := &ps[i].Members[j]
+			if status, ok := statuses[member.ID]; ok {
+				member.OperatingStatus = status
+			}
+		}
+	}
+
 	return ps, nil
 }
@@ -0,0 +1,185 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	gopheropenstack "github.com/gophercloud/gophercloud/openstack"
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Credentials are the username and password used to authenticate with
+// OpenStack
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// CredentialsFiles are the files the username and password are read from, so
+// that they can be rotated without restarting the discoverer
+type CredentialsFiles struct {
+	UsernameFile string
+	PasswordFile string
+}
+
+// Read returns the credentials in the files. Trailing newlines are trimmed.
+func (f CredentialsFiles) Read() (Credentials, error) {
+	username, err := readCredentialsFile(f.UsernameFile)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("error reading username file: %v", err)
+	}
+	password, err := readCredentialsFile(f.PasswordFile)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("error reading password file: %v", err)
+	}
+	return Credentials{Username: username, Password: password}, nil
+}
+
+func readCredentialsFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Authenticator authenticates a provider client, and authenticates it again
+// when its token expires or its credentials change. The service clients built
+// from the provider client keep working across credential changes, as only
+// its token is replaced.
+type Authenticator struct {
+	provider *gophercloud.ProviderClient
+	options  gophercloud.AuthOptions
+
+	mu          gosync.Mutex
+	credentials Credentials
+}
+
+// NewAuthenticator returns an Authenticator of the provider client. The
+// username and password of the options are set from the credentials on every
+// authentication. Empty credentials leave the options as they are, e.g. for
+// application credential or token authentication.
+func NewAuthenticator(provider *gophercloud.ProviderClient, options gophercloud.AuthOptions) *Authenticator {
+	a := &Authenticator{provider: provider, options: options}
+	// The token is replaced while other goroutines use the client
+	provider.UseTokenLock()
+	provider.ReauthFunc = func() error {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.authenticate(a.credentials)
+	}
+	return a
+}
+
+// Authenticate authenticates the provider client with the given credentials.
+// If authentication fails, the client keeps its current token and
+// credentials.
+func (a *Authenticator) Authenticate(credentials Credentials) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.authenticate(credentials); err != nil {
+		return err
+	}
+	a.credentials = credentials
+	return nil
+}
+
+func (a *Authenticator) authenticate(credentials Credentials) error {
+	options := a.options
+	if credentials.Username != "" {
+		options.Username = credentials.Username
+	}
+	if credentials.Password != "" {
+		options.Password = credentials.Password
+	}
+	options.AllowReauth = false
+
+	// Authenticate a throwaway copy of the client, the same way gophercloud
+	// reauthenticates, so that the token in use is only replaced once the
+	// credentials are known to work.
+	tac := *a.provider
+	tac.SetThrowaway(true)
+	tac.ReauthFunc = nil
+	if err := tac.SetTokenAndAuthResult(nil); err != nil {
+		return err
+	}
+	if err := gopheropenstack.Authenticate(&tac, options); err != nil {
+		return fmt.Errorf("%s authentication failed: %v", optionsAuthMethod(options), err)
+	}
+	a.provider.CopyTokenFrom(&tac)
+	if a.provider.EndpointLocator == nil {
+		// Only set on the first authentication, before service clients
+		// are built
+		a.provider.EndpointLocator = tac.EndpointLocator
+	}
+	return nil
+}
+
+// optionsAuthMethod returns the method gophercloud authenticates with given
+// the options
+func optionsAuthMethod(options gophercloud.AuthOptions) AuthMethod {
+	switch {
+	case options.Password != "":
+		return AuthMethodPassword
+	case options.TokenID != "":
+		return AuthMethodToken
+	case options.ApplicationCredentialID != "" || options.ApplicationCredentialName != "":
+		return AuthMethodApplicationCredential
+	}
+	return AuthMethodPassword
+}
+
+// WatchCredentials reads the credentials in the files every period, and
+// authenticates again when they change, until stopCh is closed.
+func WatchCredentials(a *Authenticator, files CredentialsFiles, period time.Duration, log *logrus.Logger,
+	metrics localmetrics.DiscovererMetrics, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	checksum, _ := util.FilesChecksum(files.UsernameFile, files.PasswordFile)
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		current, err := util.FilesChecksum(files.UsernameFile, files.PasswordFile)
+		if err != nil || current == checksum {
+			// Files are briefly missing while mounted secrets are
+			// updated, they are read again on the next tick
+			continue
+		}
+		credentials, err := files.Read()
+		if err == nil {
+			err = a.Authenticate(credentials)
+		}
+		if err != nil {
+			metrics.GenericMetricError("ReloadCredentials")
+			log.Errorf("Error reloading OpenStack credentials, keeping the previous ones: %v", err)
+			continue
+		}
+		log.Info("OpenStack credentials changed, authenticated with the new credentials")
+		metrics.CredentialsReloadMetric()
+		checksum = current
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gophercloud/gophercloud"
+	gopheropenstack "github.com/gophercloud/gophercloud/openstack"
+	"github.com/stretchr/testify/assert"
+)
+
+// keystone returns a fake Keystone v3 server that issues a token for each
+// valid password
+func keystone(t *testing.T, tokens map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v3/auth/tokens" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req struct {
+			Auth struct {
+				Identity struct {
+					Password struct {
+						User struct {
+							Name     string `json:"name"`
+							Password string `json:"password"`
+						} `json:"user"`
+					} `json:"password"`
+				} `json:"identity"`
+			} `json:"auth"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		token, ok := tokens[req.Auth.Identity.Password.User.Password]
+		if !ok || req.Auth.Identity.Password.User.Name != "admin" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-Subject-Token", token)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"token": {"expires_at": "2030-01-01T00:00:00.000000Z", "catalog": []}}`)
+	}))
+}
+
+func TestAuthenticator(t *testing.T) {
+	server := keystone(t, map[string]string{"secret1": "token1", "secret2": "token2"})
+	defer server.Close()
+
+	provider, err := gopheropenstack.NewClient(server.URL + "/v3/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAuthenticator(provider, gophercloud.AuthOptions{IdentityEndpoint: server.URL + "/v3/", DomainName: "Default"})
+
+	assert.NoError(t, a.Authenticate(Credentials{Username: "admin", Password: "secret1"}))
+	assert.Equal(t, "token1", provider.Token())
+	assert.NotNil(t, provider.EndpointLocator)
+
+	// Invalid credentials keep the current token
+	assert.Error(t, a.Authenticate(Credentials{Username: "admin", Password: "wrong"}))
+	assert.Equal(t, "token1", provider.Token())
+
+	assert.NoError(t, a.Authenticate(Credentials{Username: "admin", Password: "secret2"}))
+	assert.Equal(t, "token2", provider.Token())
+
+	// Expired tokens are renewed with the current credentials
+	provider.SetToken("expired")
+	assert.NoError(t, provider.Reauthenticate(""))
+	assert.Equal(t, "token2", provider.Token())
+}
+
+func TestCredentialsFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := CredentialsFiles{UsernameFile: filepath.Join(dir, "username"), PasswordFile: filepath.Join(dir, "password")}
+
+	_, err = files.Read()
+	assert.Error(t, err)
+
+	if err := ioutil.WriteFile(files.UsernameFile, []byte("admin\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(files.PasswordFile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := files.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{Username: "admin", Password: "secret"}, got)
+}
@@ -16,6 +16,7 @@ package openstack
 import (
 	"reflect"
 
+	"github.com/projectcontour/gimbal/pkg/translator"
 	"k8s.io/api/core/v1"
 )
 
@@ -37,6 +38,7 @@ func diffServices(desired, current []v1.Service) (add, update, del []v1.Service)
 	for _, currentSvc := range current {
 		for _, desiredSvc := range desired {
 			if serviceEquals(&currentSvc, &desiredSvc) {
+				translator.OverrideWeight(&desiredSvc.ObjectMeta, &currentSvc.ObjectMeta)
 				if !serviceEqualsDetail(&currentSvc, &desiredSvc) {
 					update = append(update, desiredSvc)
 				}
@@ -99,7 +101,42 @@ func serviceEquals(o1, o2 *v1.Service) bool {
 func serviceEqualsDetail(o1, o2 *v1.Service) bool {
 	return o1.GetName() == o2.GetName() &&
 		o1.GetNamespace() == o2.GetNamespace() &&
-		reflect.DeepEqual(o1.Spec.Ports, o2.Spec.Ports)
+		mapsEqual(o1.GetLabels(), o2.GetLabels()) &&
+		mapsEqual(o1.GetAnnotations(), o2.GetAnnotations()) &&
+		portsEqual(o1.Spec.Ports, o2.Spec.Ports)
+}
+
+// portsEqual returns true if the current ports of a service are the desired
+// ports. The API server drops the app protocol unless the ServiceAppProtocol
+// feature gate is enabled, in which case it is not compared.
+func portsEqual(current, desired []v1.ServicePort) bool {
+	if len(current) != len(desired) {
+		return false
+	}
+	for i := range desired {
+		p := desired[i]
+		if current[i].AppProtocol == nil {
+			p.AppProtocol = nil
+		}
+		if !reflect.DeepEqual(current[i], p) {
+			return false
+		}
+	}
+	return true
+}
+
+// mapsEqual returns true if both maps have the same entries. Nil and empty
+// maps are equal.
+func mapsEqual(m1, m2 map[string]string) bool {
+	if len(m1) != len(m2) {
+		return false
+	}
+	for k, v := range m1 {
+		if v2, ok := m2[k]; !ok || v != v2 {
+			return false
+		}
+	}
+	return true
 }
 
 func endpointEquals(o1, o2 *Endpoints) bool {
@@ -21,6 +21,8 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+var appProtocolHTTP = "http"
+
 func TestDiffServices(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -207,6 +209,45 @@ func TestDiffServices(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "weight overridden in gimbal",
+			current: []v1.Service{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "finance",
+						Name:      "service1",
+						Annotations: map[string]string{
+							"gimbal.projectcontour.io/weight":          "0",
+							"gimbal.projectcontour.io/weight-override": "0",
+						},
+					},
+				},
+			},
+			desired: []v1.Service{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:   "finance",
+						Name:        "service1",
+						Annotations: map[string]string{"gimbal.projectcontour.io/weight": "10"},
+					},
+				},
+			},
+		},
+		{
+			name: "app protocol dropped by the API server",
+			current: []v1.Service{
+				{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "finance", Name: "service1"},
+					Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "port-80", Port: 80, Protocol: "TCP"}}},
+				},
+			},
+			desired: []v1.Service{
+				{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "finance", Name: "service1"},
+					Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "port-80", Port: 80, Protocol: "TCP", AppProtocol: &appProtocolHTTP}}},
+				},
+			},
+		},
 	}
 
 	for _, tc := range tests {
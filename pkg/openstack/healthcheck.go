@@ -0,0 +1,81 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"encoding/json"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/listeners"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GimbalAnnotationHealthChecks is the key of the annotation of a service that
+// records the health checks of its ports
+const GimbalAnnotationHealthChecks = "gimbal.projectcontour.io/health-checks"
+
+// HealthCheck is a health check recorded in the annotation of a service,
+// translated from the health monitor of the pool of the listener of a service
+// port. The type is one of HTTP, HTTPS, PING, TCP, TLS-HELLO or UDP-CONNECT.
+// The HTTP method, path and expected codes are only set for HTTP and HTTPS
+// health checks. Max retries is the number of checks the health monitor makes
+// before it changes the status of a member.
+type HealthCheck struct {
+	Port            int    `json:"port"`
+	Type            string `json:"type"`
+	IntervalSeconds int    `json:"intervalSeconds"`
+	TimeoutSeconds  int    `json:"timeoutSeconds"`
+	MaxRetries      int    `json:"maxRetries"`
+	HTTPMethod      string `json:"httpMethod,omitempty"`
+	Path            string `json:"path,omitempty"`
+	ExpectedCodes   string `json:"expectedCodes,omitempty"`
+}
+
+// healthCheck returns the health check of the port of a listener, from the
+// health monitor of its pool. It returns false if the pool has no health
+// monitor, or if the health monitor is disabled.
+func healthCheck(l *listeners.Listener, pool pools.Pool) (HealthCheck, bool) {
+	m := pool.Monitor
+	if m.ID == "" || !m.AdminStateUp {
+		return HealthCheck{}, false
+	}
+	check := HealthCheck{
+		Port:            l.ProtocolPort,
+		Type:            m.Type,
+		IntervalSeconds: m.Delay,
+		TimeoutSeconds:  m.Timeout,
+		MaxRetries:      m.MaxRetries,
+	}
+	if m.Type == "HTTP" || m.Type == "HTTPS" {
+		check.HTTPMethod = m.HTTPMethod
+		check.Path = m.URLPath
+		check.ExpectedCodes = m.ExpectedCodes
+	}
+	return check, true
+}
+
+// addHealthChecks records the health checks of the ports of a service in its
+// annotations, in the order of the ports. Services without health checks are
+// not annotated.
+func addHealthChecks(meta *metav1.ObjectMeta, checks []HealthCheck) {
+	if len(checks) == 0 {
+		return
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	// Marshalling a slice of structs of strings and numbers cannot fail
+	data, _ := json.Marshal(checks)
+	meta.Annotations[GimbalAnnotationHealthChecks] = string(data)
+}
@@ -0,0 +1,57 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/monitors"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKubeServicesHealthChecks(t *testing.T) {
+	withMonitor := func(p pools.Pool, m monitors.Monitor) pools.Pool {
+		p.MonitorID = m.ID
+		p.Monitor = m
+		return p
+	}
+	lbs := []loadbalancers.LoadBalancer{
+		loadbalancer("lb-1", "",
+			listener("l-1", "", "HTTP", "pool-http", 80),
+			listener("l-2", "", "TCP", "pool-tcp", 5432),
+			listener("l-3", "", "TCP", "pool-none", 6379)),
+		loadbalancer("lb-2", "", listener("l-4", "", "HTTP", "pool-disabled", 80)),
+		loadbalancer("lb-3", "", listener("l-5", "", "HTTP", "pool-none", 80)),
+	}
+	ps := []pools.Pool{
+		withMonitor(pool("pool-http", "HTTP", "lb-1"), monitors.Monitor{ID: "hm-1", Type: "HTTP", Delay: 5, Timeout: 3, MaxRetries: 2,
+			HTTPMethod: "GET", URLPath: "/healthz", ExpectedCodes: "200-204", AdminStateUp: true}),
+		// HTTP settings are only recorded for HTTP health checks
+		withMonitor(pool("pool-tcp", "TCP", "lb-1"), monitors.Monitor{ID: "hm-2", Type: "TCP", Delay: 10, Timeout: 5, MaxRetries: 3,
+			HTTPMethod: "GET", URLPath: "/", AdminStateUp: true}),
+		withMonitor(pool("pool-disabled", "HTTP", "lb-2"), monitors.Monitor{ID: "hm-3", Type: "HTTP", Delay: 5, Timeout: 3, MaxRetries: 2}),
+		pool("pool-none", "TCP", "lb-1"),
+	}
+
+	svcs := kubeServices("us-east", "finance", lbs, ps)
+	assert.JSONEq(t, `[
+		{"port": 80, "type": "HTTP", "intervalSeconds": 5, "timeoutSeconds": 3, "maxRetries": 2,
+		 "httpMethod": "GET", "path": "/healthz", "expectedCodes": "200-204"},
+		{"port": 5432, "type": "TCP", "intervalSeconds": 10, "timeoutSeconds": 5, "maxRetries": 3}
+	]`, svcs[0].Annotations[GimbalAnnotationHealthChecks])
+	assert.NotContains(t, svcs[1].Annotations, GimbalAnnotationHealthChecks)
+	assert.NotContains(t, svcs[2].Annotations, GimbalAnnotationHealthChecks)
+}
@@ -0,0 +1,152 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/l7policies"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/listeners"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
+)
+
+const (
+	// GimbalAnnotationL7Policies is the key of the annotation of the service
+	// of a pool that records the L7 policies that route requests to it
+	GimbalAnnotationL7Policies = "gimbal.projectcontour.io/l7-policies"
+
+	// poolIDLabel is the key of the label that contains the ID of the pool of
+	// the services of L7 policies
+	poolIDLabel = "gimbal.projectcontour.io/pool-id"
+
+	l7ActionRedirectToPool = "REDIRECT_TO_POOL"
+)
+
+// L7Policy is an L7 policy recorded in the annotation of the service of its
+// pool. Requests to the service port that match all the rules of the policy
+// are routed to the pool, unless a policy with a lower position matches them
+// first.
+type L7Policy struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name,omitempty"`
+	Port     int      `json:"port"`
+	Position int32    `json:"position"`
+	Rules    []L7Rule `json:"rules"`
+}
+
+// L7Rule is a rule of an L7 policy. The type is one of HOST_NAME, PATH,
+// FILE_TYPE, HEADER or COOKIE, and the compare type one of EQUAL_TO,
+// STARTS_WITH, ENDS_WITH, CONTAINS or REGEX. The key is the name of the
+// header or cookie.
+type L7Rule struct {
+	Type        string `json:"type"`
+	CompareType string `json:"compareType"`
+	Key         string `json:"key,omitempty"`
+	Value       string `json:"value"`
+	Invert      bool   `json:"invert,omitempty"`
+}
+
+// l7Pool is a pool that L7 policies of a load balancer route requests to,
+// other than the default pools of the listeners of the policies
+type l7Pool struct {
+	id        string
+	listeners []listeners.Listener
+	policies  []L7Policy
+}
+
+// l7Pools returns the pools that the enabled L7 policies of the load balancer
+// redirect requests to, sorted by ID. Policies that redirect requests to the
+// default pool of their listener, to a URL, or reject them, are skipped.
+func l7Pools(lb loadbalancers.LoadBalancer) []l7Pool {
+	byID := map[string]*l7Pool{}
+	for _, l := range lb.Listeners {
+		for _, p := range l.L7Policies {
+			if !p.AdminStateUp || p.Action != l7ActionRedirectToPool || p.RedirectPoolID == "" || p.RedirectPoolID == l.DefaultPoolID {
+				continue
+			}
+			pool, ok := byID[p.RedirectPoolID]
+			if !ok {
+				pool = &l7Pool{id: p.RedirectPoolID}
+				byID[p.RedirectPoolID] = pool
+			}
+			if !containsListener(pool.listeners, l.ID) {
+				pool.listeners = append(pool.listeners, l)
+			}
+			pool.policies = append(pool.policies, l7Policy(l, p))
+		}
+	}
+
+	result := make([]l7Pool, 0, len(byID))
+	for _, pool := range byID {
+		sort.Slice(pool.policies, func(i, j int) bool {
+			if pool.policies[i].Port != pool.policies[j].Port {
+				return pool.policies[i].Port < pool.policies[j].Port
+			}
+			return pool.policies[i].Position < pool.policies[j].Position
+		})
+		result = append(result, *pool)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].id < result[j].id })
+	return result
+}
+
+// l7Policy returns the annotation of a policy of the listener. Disabled rules
+// are skipped.
+func l7Policy(l listeners.Listener, p l7policies.L7Policy) L7Policy {
+	policy := L7Policy{ID: p.ID, Name: p.Name, Port: l.ProtocolPort, Position: p.Position, Rules: []L7Rule{}}
+	for _, r := range p.Rules {
+		if !r.AdminStateUp {
+			continue
+		}
+		policy.Rules = append(policy.Rules, L7Rule{
+			Type:        r.RuleType,
+			CompareType: r.CompareType,
+			Key:         r.Key,
+			Value:       r.Value,
+			Invert:      r.Invert,
+		})
+	}
+	return policy
+}
+
+// annotation returns the value of the L7 policies annotation of the pool
+func (p l7Pool) annotation() string {
+	// Marshalling a slice of structs of strings and numbers cannot fail
+	data, _ := json.Marshal(p.policies)
+	return string(data)
+}
+
+// serviceName returns the name of the service of the pool before it is
+// prefixed with the backend name. Pool IDs are unique, like load balancer IDs.
+func (p l7Pool) serviceName() string {
+	return strings.ToLower(p.id)
+}
+
+// labels returns the labels of the service of the pool
+func (p l7Pool) labels(lb loadbalancers.LoadBalancer) map[string]string {
+	labels := loadbalancerLabels(lb)
+	labels[poolIDLabel] = p.id
+	return labels
+}
+
+func containsListener(ls []listeners.Listener, id string) bool {
+	for _, l := range ls {
+		if l.ID == id {
+			return true
+		}
+	}
+	return false
+}
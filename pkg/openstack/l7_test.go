@@ -0,0 +1,93 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/l7policies"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestKubeServicesL7Policies(t *testing.T) {
+	http := listener("l-1", "", "HTTP", "pool-1", 80)
+	http.L7Policies = []l7policies.L7Policy{
+		l7policy("policy-2", 2, "pool-api", l7policies.Rule{RuleType: "HOST_NAME", CompareType: "EQUAL_TO", Value: "api.example.com", AdminStateUp: true}),
+		l7policy("policy-1", 1, "pool-api",
+			l7policies.Rule{RuleType: "PATH", CompareType: "STARTS_WITH", Value: "/api", AdminStateUp: true},
+			l7policies.Rule{RuleType: "HEADER", CompareType: "EQUAL_TO", Key: "X-Debug", Value: "1", AdminStateUp: false}),
+		// Policies to the default pool of the listener do not get a service
+		l7policy("policy-3", 3, "pool-1"),
+	}
+	disabled := l7policy("policy-4", 4, "pool-disabled")
+	disabled.AdminStateUp = false
+	reject := l7policy("policy-5", 5, "")
+	reject.Action = "REJECT"
+	http.L7Policies = append(http.L7Policies, disabled, reject)
+	https := listener("l-2", "", "HTTPS", "pool-1", 443)
+	https.L7Policies = []l7policies.L7Policy{l7policy("policy-6", 1, "pool-api")}
+
+	lbs := []loadbalancers.LoadBalancer{loadbalancer("lb-1", "web", http, https)}
+	ps := []pools.Pool{
+		pool("pool-1", "HTTP", "lb-1", poolmember("10.0.0.1", 8080)),
+		pool("pool-api", "HTTP", "lb-1", poolmember("10.0.0.2", 9090)),
+	}
+	svcs := kubeServices("us-east", "finance", lbs, ps)
+	require.Len(t, svcs, 2)
+
+	svc := svcs[1]
+	assert.Equal(t, "us-east-pool-api", svc.Name)
+	assert.Equal(t, map[string]string{
+		"gimbal.projectcontour.io/backend":            "us-east",
+		"gimbal.projectcontour.io/service":            "pool-api",
+		"gimbal.projectcontour.io/load-balancer-id":   "lb-1",
+		"gimbal.projectcontour.io/load-balancer-name": "web",
+		"gimbal.projectcontour.io/pool-id":            "pool-api",
+	}, svc.Labels)
+	assert.JSONEq(t, `[
+		{"id": "policy-1", "port": 80, "position": 1, "rules": [{"type": "PATH", "compareType": "STARTS_WITH", "value": "/api"}]},
+		{"id": "policy-2", "port": 80, "position": 2, "rules": [{"type": "HOST_NAME", "compareType": "EQUAL_TO", "value": "api.example.com"}]},
+		{"id": "policy-6", "port": 443, "position": 1, "rules": []}
+	]`, svc.Annotations[GimbalAnnotationL7Policies])
+	http1 := "http"
+	assert.Equal(t, []v1.ServicePort{
+		{Name: "port-80", Port: 80, TargetPort: intstr.FromInt(80), Protocol: v1.ProtocolTCP, AppProtocol: &http1},
+		{Name: "port-443", Port: 443, TargetPort: intstr.FromInt(443), Protocol: v1.ProtocolTCP, AppProtocol: &http1},
+	}, svc.Spec.Ports)
+
+	endpoints := kubeEndpoints("us-east", "finance", lbs, ps, UnhealthyMemberNotReady)
+	require.Len(t, endpoints, 2)
+	assert.Equal(t, "us-east-pool-api", endpoints[1].endpoints.Name)
+	assert.Equal(t, "pool-api", endpoints[1].upstreamName)
+	assert.ElementsMatch(t, []v1.EndpointSubset{
+		{Addresses: []v1.EndpointAddress{{IP: "10.0.0.2"}}, Ports: []v1.EndpointPort{{Name: "port-80", Port: 9090, Protocol: v1.ProtocolTCP}}},
+		{Addresses: []v1.EndpointAddress{{IP: "10.0.0.2"}}, Ports: []v1.EndpointPort{{Name: "port-443", Port: 9090, Protocol: v1.ProtocolTCP}}},
+	}, endpoints[1].endpoints.Subsets)
+}
+
+func l7policy(id string, position int32, poolID string, rules ...l7policies.Rule) l7policies.L7Policy {
+	return l7policies.L7Policy{
+		ID:             id,
+		Action:         "REDIRECT_TO_POOL",
+		RedirectPoolID: poolID,
+		Position:       position,
+		AdminStateUp:   true,
+		Rules:          rules,
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"fmt"
+
+	"github.com/gophercloud/gophercloud"
+	gopheropenstack "github.com/gophercloud/gophercloud/openstack"
+	octavial7policies "github.com/gophercloud/gophercloud/openstack/loadbalancer/v2/l7policies"
+	octavialisteners "github.com/gophercloud/gophercloud/openstack/loadbalancer/v2/listeners"
+	octavialoadbalancers "github.com/gophercloud/gophercloud/openstack/loadbalancer/v2/loadbalancers"
+	octaviamonitors "github.com/gophercloud/gophercloud/openstack/loadbalancer/v2/monitors"
+	octaviapools "github.com/gophercloud/gophercloud/openstack/loadbalancer/v2/pools"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/l7policies"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/listeners"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/monitors"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+)
+
+// LoadBalancerAPI is the OpenStack API that load balancers are listed from
+type LoadBalancerAPI string
+
+const (
+	// LoadBalancerAPIAuto uses Octavia if the service catalog has a
+	// load-balancer endpoint, and the Neutron LBaaS v2 extension otherwise.
+	LoadBalancerAPIAuto LoadBalancerAPI = "auto"
+	// LoadBalancerAPIOctavia uses the Octavia load-balancer v2 API.
+	LoadBalancerAPIOctavia LoadBalancerAPI = "octavia"
+	// LoadBalancerAPINeutron uses the LBaaS v2 extension of the Neutron
+	// network API, which is removed from recent OpenStack releases.
+	LoadBalancerAPINeutron LoadBalancerAPI = "neutron"
+)
+
+// ParseLoadBalancerAPI returns the LoadBalancerAPI with the given name.
+func ParseLoadBalancerAPI(api string) (LoadBalancerAPI, error) {
+	switch LoadBalancerAPI(api) {
+	case LoadBalancerAPIAuto, LoadBalancerAPIOctavia, LoadBalancerAPINeutron:
+		return LoadBalancerAPI(api), nil
+	}
+	return "", fmt.Errorf("invalid load balancer API %q, must be one of %q, %q or %q", api,
+		LoadBalancerAPIAuto, LoadBalancerAPIOctavia, LoadBalancerAPINeutron)
+}
+
+// NewLoadBalancerLister returns a client of the given load balancer API, and
+// the API it uses. In auto mode, the API is selected from the service catalog.
+func NewLoadBalancerLister(provider *gophercloud.ProviderClient, api LoadBalancerAPI) (LoadBalancerLister, LoadBalancerAPI, error) {
+	switch api {
+	case LoadBalancerAPINeutron:
+		c, err := NewLoadBalancerV2(provider)
+		if err != nil {
+			return nil, api, fmt.Errorf("failed to create Network V2 API client: %v", err)
+		}
+		return c, api, nil
+	case LoadBalancerAPIOctavia:
+		c, err := NewOctaviaV2(provider)
+		if err != nil {
+			return nil, api, fmt.Errorf("failed to create Load Balancer V2 API client: %v", err)
+		}
+		return c, api, nil
+	}
+
+	c, err := NewOctaviaV2(provider)
+	if err == nil {
+		return c, LoadBalancerAPIOctavia, nil
+	}
+	if _, ok := err.(*gophercloud.ErrEndpointNotFound); !ok {
+		return nil, LoadBalancerAPIOctavia, fmt.Errorf("failed to create Load Balancer V2 API client: %v", err)
+	}
+	return NewLoadBalancerLister(provider, LoadBalancerAPINeutron)
+}
+
+// OctaviaV2Client is a client of the OpenStack Octavia load-balancer v2 API.
+// It returns the same LBaaS v2 load balancers and pools as the
+// LoadBalancerV2Client, so that they are translated the same way.
+type OctaviaV2Client struct {
+	client *gophercloud.ServiceClient
+}
+
+// NewOctaviaV2 returns a client of the Octavia load-balancer v2 API
+func NewOctaviaV2(provider *gophercloud.ProviderClient) (*OctaviaV2Client, error) {
+	c, err := gopheropenstack.NewLoadBalancerV2(provider, gophercloud.EndpointOpts{})
+	if err != nil {
+		return nil, err
+	}
+	return &OctaviaV2Client{c}, nil
+}
+
+// ListLoadBalancers returns the load balancers that exist in the given project
+func (c OctaviaV2Client) ListLoadBalancers(projectID string) ([]loadbalancers.LoadBalancer, error) {
+	lbPage, err := octavialoadbalancers.List(c.client, octavialoadbalancers.ListOpts{ProjectID: projectID}).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list load balancers: %v", err)
+	}
+
+	lbs, err := octavialoadbalancers.ExtractLoadBalancers(lbPage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract load balancers: %v", err)
+	}
+
+	lisPage, err := octavialisteners.List(c.client, octavialisteners.ListOpts{ProjectID: projectID}).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list load balancer listeners: %v", err)
+	}
+
+	lis, err := octavialisteners.ExtractListeners(lisPage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract load balancer listeners: %v", err)
+	}
+
+	policies, err := c.listL7Policies(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	// hydrate each load balancer resource with its listeners, and each
+	// listener with its L7 policies
+	result := make([]loadbalancers.LoadBalancer, 0, len(lbs))
+	for _, lb := range lbs {
+		converted := octaviaLoadBalancer(lb)
+		for _, l := range lis {
+			for _, id := range l.Loadbalancers {
+				if id.ID == lb.ID {
+					converted.Listeners = append(converted.Listeners, octaviaListener(l, policies[l.ID]))
+				}
+			}
+		}
+		result = append(result, converted)
+	}
+	return result, nil
+}
+
+// listL7Policies returns the L7 policies of the given project, along with
+// their rules, by listener ID
+func (c OctaviaV2Client) listL7Policies(projectID string) (map[string][]l7policies.L7Policy, error) {
+	page, err := octavial7policies.List(c.client, octavial7policies.ListOpts{ProjectID: projectID}).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list L7 policies: %v", err)
+	}
+	ps, err := octavial7policies.ExtractL7Policies(page)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract L7 policies: %v", err)
+	}
+
+	policies := map[string][]l7policies.L7Policy{}
+	for _, p := range ps {
+		page, err = octavial7policies.ListRules(c.client, p.ID, octavial7policies.ListRulesOpts{ProjectID: projectID}).AllPages()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list rules of L7 policy ID %q: %v", p.ID, err)
+		}
+		p.Rules, err = octavial7policies.ExtractRules(page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract rules of L7 policy ID %q: %v", p.ID, err)
+		}
+		policies[p.ListenerID] = append(policies[p.ListenerID], octaviaL7Policy(p))
+	}
+	return policies, nil
+}
+
+// ListPools returns all load balancer pools that exist in the given project,
+// along with their members and health monitors
+func (c OctaviaV2Client) ListPools(projectID string) ([]pools.Pool, error) {
+	page, err := octaviapools.List(c.client, octaviapools.ListOpts{ProjectID: projectID}).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list listener pools: %v", err)
+	}
+
+	ps, err := octaviapools.ExtractPools(page)
+	if err != nil {
+		return nil, fmt.Errorf("failed extract listener pools: %v", err)
+	}
+
+	page, err = octaviamonitors.List(c.client, octaviamonitors.ListOpts{ProjectID: projectID}).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list health monitors: %v", err)
+	}
+	ms, err := octaviamonitors.ExtractMonitors(page)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract health monitors: %v", err)
+	}
+	monitorsByID := map[string]monitors.Monitor{}
+	for _, m := range ms {
+		monitorsByID[m.ID] = octaviaMonitor(m)
+	}
+
+	// add members and the health monitor to each pool
+	result := make([]pools.Pool, 0, len(ps))
+	for _, p := range ps {
+		page, err = octaviapools.ListMembers(c.client, p.ID, octaviapools.ListMembersOpts{ProjectID: projectID}).AllPages()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list members of pool ID %q: %v", p.ID, err)
+		}
+		m, err := octaviapools.ExtractMembers(page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract members of pool ID %q: %v", p.ID, err)
+		}
+		p.Members = m
+		pool := octaviaPool(p)
+		if m, ok := monitorsByID[p.MonitorID]; ok {
+			pool.Monitor = m
+		}
+		result = append(result, pool)
+	}
+	return result, nil
+}
+
+// octaviaLoadBalancer returns the LBaaS v2 load balancer of an Octavia load
+// balancer, without its listeners and pools.
+func octaviaLoadBalancer(lb octavialoadbalancers.LoadBalancer) loadbalancers.LoadBalancer {
+	return loadbalancers.LoadBalancer{
+		Description:        lb.Description,
+		AdminStateUp:       lb.AdminStateUp,
+		TenantID:           lb.ProjectID,
+		ProvisioningStatus: lb.ProvisioningStatus,
+		VipAddress:         lb.VipAddress,
+		VipPortID:          lb.VipPortID,
+		VipSubnetID:        lb.VipSubnetID,
+		ID:                 lb.ID,
+		OperatingStatus:    lb.OperatingStatus,
+		Name:               lb.Name,
+		Flavor:             lb.Flavor,
+		Provider:           lb.Provider,
+	}
+}
+
+// octaviaListener returns the LBaaS v2 listener of an Octavia listener with the
+// given L7 policies, without its pools.
+func octaviaListener(l octavialisteners.Listener, policies []l7policies.L7Policy) listeners.Listener {
+	result := listeners.Listener{
+		ID:                     l.ID,
+		TenantID:               l.ProjectID,
+		Name:                   l.Name,
+		Description:            l.Description,
+		Protocol:               l.Protocol,
+		ProtocolPort:           l.ProtocolPort,
+		DefaultPoolID:          l.DefaultPoolID,
+		ConnLimit:              l.ConnLimit,
+		SniContainerRefs:       l.SniContainerRefs,
+		DefaultTlsContainerRef: l.DefaultTlsContainerRef,
+		AdminStateUp:           l.AdminStateUp,
+		ProvisioningStatus:     l.ProvisioningStatus,
+	}
+	for _, id := range l.Loadbalancers {
+		result.Loadbalancers = append(result.Loadbalancers, listeners.LoadBalancerID{ID: id.ID})
+	}
+	result.L7Policies = policies
+	return result
+}
+
+// octaviaL7Policy returns the LBaaS v2 L7 policy of an Octavia L7 policy,
+// with its rules.
+func octaviaL7Policy(p octavial7policies.L7Policy) l7policies.L7Policy {
+	result := l7policies.L7Policy{
+		ID:                 p.ID,
+		Name:               p.Name,
+		ListenerID:         p.ListenerID,
+		Action:             p.Action,
+		Position:           p.Position,
+		Description:        p.Description,
+		TenantID:           p.ProjectID,
+		RedirectPoolID:     p.RedirectPoolID,
+		RedirectURL:        p.RedirectURL,
+		AdminStateUp:       p.AdminStateUp,
+		ProvisioningStatus: p.ProvisioningStatus,
+		OperatingStatus:    p.OperatingStatus,
+	}
+	for _, r := range p.Rules {
+		result.Rules = append(result.Rules, l7policies.Rule{
+			ID:                 r.ID,
+			RuleType:           r.RuleType,
+			CompareType:        r.CompareType,
+			Value:              r.Value,
+			TenantID:           r.ProjectID,
+			Key:                r.Key,
+			Invert:             r.Invert,
+			AdminStateUp:       r.AdminStateUp,
+			ProvisioningStatus: r.ProvisioningStatus,
+			OperatingStatus:    r.OperatingStatus,
+		})
+	}
+	return result
+}
+
+// octaviaPool returns the LBaaS v2 pool of an Octavia pool, with its members
+// but without its health monitor, of which only the ID is kept.
+func octaviaPool(p octaviapools.Pool) pools.Pool {
+	result := pools.Pool{
+		LBMethod:           p.LBMethod,
+		Protocol:           p.Protocol,
+		Description:        p.Description,
+		MonitorID:          p.MonitorID,
+		SubnetID:           p.SubnetID,
+		TenantID:           p.ProjectID,
+		AdminStateUp:       p.AdminStateUp,
+		Name:               p.Name,
+		ID:                 p.ID,
+		Persistence:        pools.SessionPersistence{Type: p.Persistence.Type, CookieName: p.Persistence.CookieName},
+		Provider:           p.Provider,
+		ProvisioningStatus: p.ProvisioningStatus,
+		OperatingStatus:    p.OperatingStatus,
+	}
+	for _, id := range p.Listeners {
+		result.Listeners = append(result.Listeners, pools.ListenerID{ID: id.ID})
+	}
+	for _, id := range p.Loadbalancers {
+		result.Loadbalancers = append(result.Loadbalancers, pools.LoadBalancerID{ID: id.ID})
+	}
+	for _, m := range p.Members {
+		result.Members = append(result.Members, pools.Member{
+			Name:               m.Name,
+			Weight:             m.Weight,
+			AdminStateUp:       m.AdminStateUp,
+			TenantID:           m.ProjectID,
+			SubnetID:           m.SubnetID,
+			PoolID:             m.PoolID,
+			Address:            m.Address,
+			ProtocolPort:       m.ProtocolPort,
+			ID:                 m.ID,
+			ProvisioningStatus: m.ProvisioningStatus,
+			OperatingStatus:    m.OperatingStatus,
+		})
+	}
+	return result
+}
+
+// octaviaMonitor returns the LBaaS v2 health monitor of an Octavia health
+// monitor.
+func octaviaMonitor(m octaviamonitors.Monitor) monitors.Monitor {
+	result := monitors.Monitor{
+		ID:                 m.ID,
+		Name:               m.Name,
+		TenantID:           m.ProjectID,
+		Type:               m.Type,
+		Delay:              m.Delay,
+		Timeout:            m.Timeout,
+		MaxRetries:         m.MaxRetries,
+		HTTPMethod:         m.HTTPMethod,
+		URLPath:            m.URLPath,
+		ExpectedCodes:      m.ExpectedCodes,
+		AdminStateUp:       m.AdminStateUp,
+		Status:             m.Status,
+		ProvisioningStatus: m.ProvisioningStatus,
+	}
+	for _, id := range m.Pools {
+		result.Pools = append(result.Pools, monitors.PoolID{ID: id.ID})
+	}
+	return result
+}
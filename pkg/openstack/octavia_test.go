@@ -0,0 +1,185 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/l7policies"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/listeners"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/monitors"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func octaviaServer(t *testing.T) *httptest.Server {
+	bodies := map[string]string{
+		"/lbaas/loadbalancers": `{"loadbalancers": [{"id": "lb-1", "name": "stocks", "project_id": "finance", "vip_address": "10.0.0.100",
+			"provisioning_status": "ACTIVE", "listeners": [{"id": "l-1"}]}]}`,
+		"/lbaas/listeners": `{"listeners": [{"id": "l-1", "project_id": "finance", "protocol": "HTTP", "protocol_port": 80,
+			"default_pool_id": "pool-1", "loadbalancers": [{"id": "lb-1"}], "l7policies": [{"id": "policy-1"}]},
+			{"id": "l-2", "project_id": "finance", "protocol": "TCP", "protocol_port": 443, "loadbalancers": [{"id": "lb-2"}]}]}`,
+		"/lbaas/l7policies": `{"l7policies": [{"id": "policy-1", "name": "api", "project_id": "finance", "listener_id": "l-1",
+			"action": "REDIRECT_TO_POOL", "redirect_pool_id": "pool-2", "position": 1, "admin_state_up": true, "rules": [{"id": "rule-1"}]}]}`,
+		"/lbaas/l7policies/policy-1/rules": `{"rules": [{"id": "rule-1", "project_id": "finance", "type": "PATH",
+			"compare_type": "STARTS_WITH", "value": "/api", "admin_state_up": true}]}`,
+		"/lbaas/pools": `{"pools": [{"id": "pool-1", "project_id": "finance", "protocol": "HTTP", "lb_algorithm": "ROUND_ROBIN",
+			"healthmonitor_id": "hm-1", "listeners": [{"id": "l-1"}], "loadbalancers": [{"id": "lb-1"}], "members": [{"id": "m-1"}]},
+			{"id": "pool-2", "project_id": "finance", "protocol": "HTTP", "lb_algorithm": "ROUND_ROBIN",
+			"loadbalancers": [{"id": "lb-1"}], "members": [{"id": "m-2"}]}]}`,
+		"/lbaas/healthmonitors": `{"healthmonitors": [{"id": "hm-1", "project_id": "finance", "type": "HTTP", "delay": 5, "timeout": 3,
+			"max_retries": 2, "http_method": "GET", "url_path": "/healthz", "expected_codes": "200", "admin_state_up": true,
+			"pools": [{"id": "pool-1"}]}]}`,
+		"/lbaas/pools/pool-1/members": `{"members": [{"id": "m-1", "project_id": "finance", "address": "192.168.0.1",
+			"protocol_port": 8080, "weight": 1, "admin_state_up": true, "operating_status": "ONLINE"}]}`,
+		"/lbaas/pools/pool-2/members": `{"members": [{"id": "m-2", "project_id": "finance", "address": "192.168.0.2",
+			"protocol_port": 9090, "weight": 1, "admin_state_up": true, "operating_status": "ONLINE"}]}`,
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "finance", r.URL.Query().Get("project_id"), r.URL.Path)
+		body, ok := bodies[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestOctaviaListLoadBalancers(t *testing.T) {
+	srv := octaviaServer(t)
+	defer srv.Close()
+	c := OctaviaV2Client{&gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: srv.URL + "/"}}
+
+	lbs, err := c.ListLoadBalancers("finance")
+	require.NoError(t, err)
+	require.Len(t, lbs, 1)
+	assert.Equal(t, "lb-1", lbs[0].ID)
+	assert.Equal(t, "stocks", lbs[0].Name)
+	assert.Equal(t, "finance", lbs[0].TenantID)
+	assert.Equal(t, "10.0.0.100", lbs[0].VipAddress)
+	require.Len(t, lbs[0].Listeners, 1)
+	l := lbs[0].Listeners[0]
+	assert.Equal(t, "l-1", l.ID)
+	assert.Equal(t, "HTTP", l.Protocol)
+	assert.Equal(t, 80, l.ProtocolPort)
+	assert.Equal(t, "pool-1", l.DefaultPoolID)
+	assert.Equal(t, []listeners.LoadBalancerID{{ID: "lb-1"}}, l.Loadbalancers)
+	assert.Equal(t, []l7policies.L7Policy{{ID: "policy-1", Name: "api", TenantID: "finance", ListenerID: "l-1",
+		Action: "REDIRECT_TO_POOL", RedirectPoolID: "pool-2", Position: 1, AdminStateUp: true,
+		Rules: []l7policies.Rule{{ID: "rule-1", TenantID: "finance", RuleType: "PATH", CompareType: "STARTS_WITH", Value: "/api", AdminStateUp: true}},
+	}}, l.L7Policies)
+
+	ps, err := c.ListPools("finance")
+	require.NoError(t, err)
+	require.Len(t, ps, 2)
+	assert.Equal(t, "pool-1", ps[0].ID)
+	assert.Equal(t, "hm-1", ps[0].MonitorID)
+	assert.Equal(t, monitors.Monitor{ID: "hm-1", TenantID: "finance", Type: "HTTP", Delay: 5, Timeout: 3, MaxRetries: 2,
+		HTTPMethod: "GET", URLPath: "/healthz", ExpectedCodes: "200", AdminStateUp: true, Pools: []monitors.PoolID{{ID: "pool-1"}}},
+		ps[0].Monitor)
+	assert.Empty(t, ps[1].Monitor.ID)
+	assert.Equal(t, []pools.LoadBalancerID{{ID: "lb-1"}}, ps[0].Loadbalancers)
+	assert.Equal(t, []pools.Member{{ID: "m-1", TenantID: "finance", Address: "192.168.0.1", ProtocolPort: 8080, Weight: 1,
+		AdminStateUp: true, OperatingStatus: "ONLINE"}}, ps[0].Members)
+
+	// Octavia load balancers are translated the same as LBaaS v2 ones
+	svcs := kubeServices("us-east", "finance", lbs, ps)
+	require.Len(t, svcs, 2)
+	assert.Equal(t, "us-east-lb-1", svcs[0].Name)
+	assert.Equal(t, "port-80", svcs[0].Spec.Ports[0].Name)
+	assert.Contains(t, svcs[0].Annotations, GimbalAnnotationHealthChecks)
+	assert.Equal(t, "us-east-pool-2", svcs[1].Name)
+	endpoints := kubeEndpoints("us-east", "finance", lbs, ps, UnhealthyMemberNotReady)
+	assert.Equal(t, "192.168.0.1", endpoints[0].endpoints.Subsets[0].Addresses[0].IP)
+	assert.Equal(t, "192.168.0.2", endpoints[1].endpoints.Subsets[0].Addresses[0].IP)
+}
+
+func TestNewLoadBalancerLister(t *testing.T) {
+	tests := []struct {
+		name        string
+		api         LoadBalancerAPI
+		catalog     map[string]string
+		expectedAPI LoadBalancerAPI
+		expectErr   bool
+	}{
+		{
+			name:        "auto with octavia",
+			api:         LoadBalancerAPIAuto,
+			catalog:     map[string]string{"load-balancer": "https://octavia/", "network": "https://neutron/"},
+			expectedAPI: LoadBalancerAPIOctavia,
+		},
+		{
+			name:        "auto without octavia",
+			api:         LoadBalancerAPIAuto,
+			catalog:     map[string]string{"network": "https://neutron/"},
+			expectedAPI: LoadBalancerAPINeutron,
+		},
+		{
+			name:        "neutron",
+			api:         LoadBalancerAPINeutron,
+			catalog:     map[string]string{"load-balancer": "https://octavia/", "network": "https://neutron/"},
+			expectedAPI: LoadBalancerAPINeutron,
+		},
+		{
+			name:        "octavia without endpoint",
+			api:         LoadBalancerAPIOctavia,
+			catalog:     map[string]string{"network": "https://neutron/"},
+			expectedAPI: LoadBalancerAPIOctavia,
+			expectErr:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := &gophercloud.ProviderClient{
+				EndpointLocator: func(opts gophercloud.EndpointOpts) (string, error) {
+					if url, ok := tc.catalog[opts.Type]; ok {
+						return url, nil
+					}
+					return "", &gophercloud.ErrEndpointNotFound{}
+				},
+			}
+			lister, api, err := NewLoadBalancerLister(provider, tc.api)
+			assert.Equal(t, tc.expectedAPI, api)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			switch api {
+			case LoadBalancerAPIOctavia:
+				assert.IsType(t, &OctaviaV2Client{}, lister)
+			case LoadBalancerAPINeutron:
+				assert.IsType(t, &LoadBalancerV2Client{}, lister)
+			}
+		})
+	}
+}
+
+func TestParseLoadBalancerAPI(t *testing.T) {
+	for _, api := range []string{"auto", "octavia", "neutron"} {
+		got, err := ParseLoadBalancerAPI(api)
+		assert.NoError(t, err)
+		assert.Equal(t, LoadBalancerAPI(api), got)
+	}
+	_, err := ParseLoadBalancerAPI("lbaas")
+	assert.Error(t, err)
+}
@@ -16,16 +16,18 @@ package openstack
 import (
 	"context"
 	"fmt"
-	"strings"
+	gosync "sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/projectcontour/gimbal/pkg/translator"
 
-	"github.com/gophercloud/gophercloud/openstack/identity/v3/projects"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+	"github.com/projectcontour/gimbal/pkg/leader"
 	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
 	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/util"
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -33,7 +35,13 @@ import (
 )
 
 type ProjectLister interface {
-	ListProjects() ([]projects.Project, error)
+	ListProjects() ([]Project, error)
+}
+
+// ServerLister lists the servers of a project, to find the availability
+// zones of the members of load balancers
+type ServerLister interface {
+	ListServers(projectID string) ([]Server, error)
 }
 
 type LoadBalancerLister interface {
@@ -50,9 +58,14 @@ type Reconciler struct {
 	ProjectLister
 
 	// BackendName is the name of the OpenStack cluster
-	BackendName               string
-	ClusterType               string
-	OpenstackProjectWatchlist string
+	BackendName string
+	ClusterType string
+	// Watchlist selects the projects that are reconciled
+	Watchlist ProjectWatchlist
+	// WatchlistFile is the file the watchlist is read from. If set, the
+	// watchlist is read again on every reconciliation when the file
+	// changes.
+	WatchlistFile string
 	// GimbalKubeClient is the client of the Kubernetes cluster where Gimbal is running
 	GimbalKubeClient kubernetes.Interface
 	// Interval between reconciliation loops
@@ -61,8 +74,47 @@ type Reconciler struct {
 	syncqueue  sync.Queue
 
 	Metrics localmetrics.DiscovererMetrics
+	// ServerLister lists the servers that back load balancer members. If
+	// nil, the topology of load balancers is not recorded.
+	ServerLister ServerLister
+	// Region is the region of the OpenStack cluster, recorded in the
+	// topology of load balancers
+	Region string
+	// Weight is the weight of the services of the backend, recorded in their
+	// weight annotation. If empty, services have no weight unless it is
+	// overridden in Gimbal.
+	Weight string
+	// Elector elects the replica that reconciles the backend. If nil, the
+	// reconciler always runs.
+	Elector *leader.Elector
+	// Workers is the number of projects that are reconciled in parallel. If
+	// less than one, projects are reconciled one at a time.
+	Workers int
+	// ProjectTimeout bounds the time spent reconciling each project. If
+	// zero, projects do not time out.
+	ProjectTimeout time.Duration
+	// UnhealthyMembers determines whether the addresses of disabled or
+	// unhealthy pool members are not ready, or left out of the endpoints.
+	// If empty, they are not ready.
+	UnhealthyMembers UnhealthyMemberPolicy
+
+	// running is set while a reconciliation cycle runs
+	running int32
+	// watchlistChecksum is the checksum of the watchlist file in use
+	watchlistChecksum string
+	// watched maps the projects reconciled in the last cycle to the
+	// selectors that matched them
+	watched map[string]string
 }
 
+// The results of the reconciliation of a project, recorded in its duration
+// metric
+const (
+	projectResultSuccess = "success"
+	projectResultError   = "error"
+	projectResultTimeout = "timeout"
+)
+
 // Endpoints represents a v1.Endpoints + upstream name to facilicate metrics
 type Endpoints struct {
 	endpoints    v1.Endpoints
@@ -70,19 +122,19 @@ type Endpoints struct {
 }
 
 // NewReconciler returns an OpenStack reconciler
-func NewReconciler(backendName, openstackProjectWatchlist string, gimbalKubeClient kubernetes.Interface, syncPeriod time.Duration, lbLister LoadBalancerLister,
+func NewReconciler(backendName string, watchlist ProjectWatchlist, gimbalKubeClient kubernetes.Interface, syncPeriod time.Duration, lbLister LoadBalancerLister,
 	projectLister ProjectLister, log *logrus.Logger, queueWorkers int, metrics localmetrics.DiscovererMetrics) Reconciler {
 
 	return Reconciler{
-		BackendName:               backendName,
-		GimbalKubeClient:          gimbalKubeClient,
-		SyncPeriod:                syncPeriod,
-		LoadBalancerLister:        lbLister,
-		ProjectLister:             projectLister,
-		Logger:                    log,
-		Metrics:                   metrics,
-		syncqueue:                 sync.NewQueue(log, gimbalKubeClient, queueWorkers, metrics),
-		OpenstackProjectWatchlist: openstackProjectWatchlist,
+		BackendName:        backendName,
+		GimbalKubeClient:   gimbalKubeClient,
+		SyncPeriod:         syncPeriod,
+		LoadBalancerLister: lbLister,
+		ProjectLister:      projectLister,
+		Logger:             log,
+		Metrics:            metrics,
+		syncqueue:          sync.NewQueue(log, gimbalKubeClient, queueWorkers, metrics),
+		Watchlist:          watchlist,
 	}
 }
 
@@ -90,11 +142,26 @@ func NewReconciler(backendName, openstackProjectWatchlist string, gimbalKubeClie
 func (r *Reconciler) Run(stop <-chan struct{}) {
 	go r.syncqueue.Run(stop)
 
+	// Cancel the running reconciliation on stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	ticker := time.NewTicker(r.SyncPeriod)
 	defer ticker.Stop()
 
-	// Perform an initial reconciliation
-	r.reconcile()
+	// Perform an initial reconciliation, or one every time the replica is
+	// elected
+	elected := make(chan struct{}, 1)
+	if r.Elector != nil {
+		go r.Elector.Run(stop, func() {
+			select {
+			case elected <- struct{}{}:
+			default:
+			}
+		})
+	} else {
+		go r.reconcile(ctx)
+	}
 
 	// Perform reconciliation on every tick
 	for {
@@ -102,99 +169,289 @@ func (r *Reconciler) Run(stop <-chan struct{}) {
 		case <-stop:
 			r.Logger.Info("Stopping openstack reconciler")
 			return
+		case <-elected:
+			go r.reconcile(ctx)
 		case <-ticker.C:
-			r.reconcile()
+			go r.reconcile(ctx)
 		}
 	}
 }
 
-func (r *Reconciler) reconcile() {
+// workers returns the number of projects that are reconciled in parallel
+func (r *Reconciler) workers() int {
+	if r.Workers < 1 {
+		return 1
+	}
+	return r.Workers
+}
+
+func (r *Reconciler) reconcile(ctx context.Context) {
+	// Standby replicas must not write to Gimbal
+	if !r.Elector.IsLeader() {
+		return
+	}
+
+	// Skip the cycle if the previous one is still running, so that cycles
+	// longer than the sync period do not pile up
+	if !atomic.CompareAndSwapInt32(&r.running, 0, 1) {
+		r.Metrics.SkippedCycleMetric()
+		r.Logger.Warn("skipping reconciliation, the previous one is still running")
+		return
+	}
+	defer atomic.StoreInt32(&r.running, 0)
+
 	// Calculate cycle time
 	start := time.Now()
 
 	log := r.Logger
 	log.Info("reconciling load balancers")
 	// Get all the openstack tenants that must be synced
-	projects, err := r.ProjectLister.ListProjects()
+	allProjects, err := r.ProjectLister.ListProjects()
 	if err != nil {
 		r.Metrics.GenericMetricError("ListProjects")
 		log.Errorf("error listing OpenStack projects: %v", err)
 		return
 	}
 
-	// import watch list
-	watchlist := []string{}
-	openstackProjectWatchlist := r.OpenstackProjectWatchlist
-	if len(openstackProjectWatchlist) > 0 {
-		watchlist = strings.Split(openstackProjectWatchlist, ",")
+	r.reloadWatchlist()
+
+	// Reconcile the projects with a bounded pool of workers
+	queue := make(chan watchedProject)
+	var wg gosync.WaitGroup
+	for i := 0; i < r.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w := range queue {
+				r.reconcileProject(ctx, w.project, w.selector)
+			}
+		}()
 	}
 
-	for _, project := range projects {
-		projectName := project.Name
-		if !contains(watchlist, projectName) && len(watchlist) > 0 {
-			continue
+	watched := map[string]string{}
+	func() {
+		defer close(queue)
+		for _, project := range allProjects {
+			selector, ok := r.Watchlist.Match(project)
+			if !ok {
+				if selector != "" {
+					log.Debugf("skipping project %q excluded by selector %q", project.Name, selector)
+				}
+				continue
+			}
+			watched[project.Name] = selector
+			select {
+			case queue <- watchedProject{project: project, selector: selector}:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
+	wg.Wait()
+	if ctx.Err() == nil {
+		r.writeWatchedMetrics(watched)
+	}
 
-		// Get load balancers that are defined in the project
-		loadbalancers, err := r.ListLoadBalancers(project.ID)
-		if err != nil {
-			r.Metrics.GenericMetricError("ListLoadBalancers")
-			log.Errorf("error reconciling project %q: %v", projectName, err)
-			continue
+	// Log to Prometheus the cycle duration
+	r.Metrics.CycleDurationMetric(time.Since(start))
+}
+
+// watchedProject is a project to reconcile, along with the watchlist selector
+// that matched it
+type watchedProject struct {
+	project  Project
+	selector string
+}
+
+// reloadWatchlist reads the watchlist file again when it changes. If the new
+// watchlist is invalid, the previous one is kept.
+func (r *Reconciler) reloadWatchlist() {
+	if r.WatchlistFile == "" {
+		return
+	}
+	checksum, err := util.FilesChecksum(r.WatchlistFile)
+	if err != nil || checksum == r.watchlistChecksum {
+		// The file is briefly missing while a mounted config map is
+		// updated, it is read again on the next reconciliation
+		return
+	}
+	watchlist, err := ReadProjectWatchlistFile(r.WatchlistFile)
+	if err != nil {
+		r.Metrics.GenericMetricError("ReloadWatchlist")
+		r.Logger.Errorf("Error reloading the project watchlist, keeping the previous one: %v", err)
+		return
+	}
+	r.Watchlist = watchlist
+	r.watchlistChecksum = checksum
+	r.Logger.Infof("Loaded project watchlist from %s: %s", r.WatchlistFile, watchlist)
+}
+
+// writeWatchedMetrics records the selector that matched each reconciled
+// project, and forgets the projects that are no longer reconciled
+func (r *Reconciler) writeWatchedMetrics(watched map[string]string) {
+	for namespace, selector := range r.watched {
+		if watched[namespace] != selector {
+			r.Metrics.DeleteWatchedProjectMetric(namespace, selector)
 		}
+	}
+	for namespace, selector := range watched {
+		r.Metrics.WatchedProjectMetric(namespace, selector)
+	}
+	r.watched = watched
+}
 
-		totalUpstreamServices := len(loadbalancers)
-		totalInvalidServices := totalUpstreamServices - len(loadbalancers)
+// reconcileProject reconciles a project within the project timeout, and
+// records its duration and result. Errors are logged, and do not stop the
+// reconciliation of other projects.
+func (r *Reconciler) reconcileProject(ctx context.Context, project Project, selector string) {
+	if r.ProjectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.ProjectTimeout)
+		defer cancel()
+	}
 
-		// Get all pools defined in the project
-		pools, err := r.ListPools(project.ID)
-		if err != nil {
-			r.Metrics.GenericMetricError("ListPools")
-			log.Errorf("error reconciling project %q: %v", projectName, err)
-			continue
+	r.Logger.Debugf("reconciling project %q matched by selector %q", project.Name, selector)
+	start := time.Now()
+	result := projectResultSuccess
+	if err := r.syncProject(ctx, project); err != nil {
+		result = projectResultError
+		if ctx.Err() == context.DeadlineExceeded {
+			result = projectResultTimeout
 		}
+		r.Logger.Errorf("error reconciling project %q matched by selector %q: %v", project.Name, selector, err)
+	}
+	r.Metrics.ProjectDurationMetric(project.Name, result, time.Since(start))
+}
 
-		// Get all services and endpoints that exist in the corresponding namespace
-		clusterLabelSelector := fmt.Sprintf("%s=%s", translator.GimbalLabelBackend, r.BackendName)
-		currentServices, err := r.GimbalKubeClient.CoreV1().Services(projectName).List(context.TODO(), metav1.ListOptions{LabelSelector: clusterLabelSelector})
-		if err != nil {
-			r.Metrics.GenericMetricError("ListServicesInNamespace")
-			log.Errorf("error listing services in namespace %q: %v", projectName, err)
+// syncProject makes the services and endpoints of the namespace of a project
+// match its load balancers. Nothing is written to Gimbal once the context is
+// done.
+func (r *Reconciler) syncProject(ctx context.Context, project Project) error {
+	projectName := project.Name
+
+	// Get load balancers that are defined in the project
+	var lbs []loadbalancers.LoadBalancer
+	err := withContext(ctx, func() (err error) {
+		lbs, err = r.ListLoadBalancers(project.ID)
+		return err
+	})
+	if err != nil {
+		r.Metrics.GenericMetricError("ListLoadBalancers")
+		return err
+	}
+
+	totalUpstreamServices := len(lbs)
+	// The services of load balancers that are broken or being changed are
+	// left as they are in Gimbal until the load balancers are active again
+	invalid := map[string]bool{}
+	validLBs := lbs[:0]
+	for _, lb := range lbs {
+		if !loadBalancerValid(lb) {
+			r.Logger.Warnf("skipping load balancer %q of project %q in provisioning status %s", lb.ID, projectName, lb.ProvisioningStatus)
+			invalid[lb.ID] = true
 			continue
 		}
+		validLBs = append(validLBs, lb)
+	}
+	lbs = validLBs
+	totalInvalidServices := totalUpstreamServices - len(lbs)
+
+	// Get all pools defined in the project
+	var lbPools []pools.Pool
+	err = withContext(ctx, func() (err error) {
+		lbPools, err = r.ListPools(project.ID)
+		return err
+	})
+	if err != nil {
+		r.Metrics.GenericMetricError("ListPools")
+		return err
+	}
 
-		currentk8sEndpoints, err := r.GimbalKubeClient.CoreV1().Endpoints(projectName).List(context.TODO(), metav1.ListOptions{LabelSelector: clusterLabelSelector})
-		if err != nil {
-			r.Metrics.GenericMetricError("ListEndpointsInNamespace")
-			log.Errorf("error listing endpoints in namespace:%q: %v", projectName, err)
+	// Get all services and endpoints that exist in the corresponding namespace
+	clusterLabelSelector := fmt.Sprintf("%s=%s", translator.GimbalLabelBackend, r.BackendName)
+	currentServices, err := r.GimbalKubeClient.CoreV1().Services(projectName).List(ctx, metav1.ListOptions{LabelSelector: clusterLabelSelector})
+	if err != nil {
+		r.Metrics.GenericMetricError("ListServicesInNamespace")
+		return fmt.Errorf("error listing services in namespace %q: %v", projectName, err)
+	}
+
+	currentk8sEndpoints, err := r.GimbalKubeClient.CoreV1().Endpoints(projectName).List(ctx, metav1.ListOptions{LabelSelector: clusterLabelSelector})
+	if err != nil {
+		r.Metrics.GenericMetricError("ListEndpointsInNamespace")
+		return fmt.Errorf("error listing endpoints in namespace %q: %v", projectName, err)
+	}
+
+	// Convert the k8s list to type []Endpoints so make comparison easier
+	currentEndpoints := []Endpoints{}
+	for _, v := range currentk8sEndpoints.Items {
+		if invalid[v.Labels[loadBalancerIDLabel]] {
 			continue
 		}
+		currentEndpoints = append(currentEndpoints, Endpoints{endpoints: v, upstreamName: ""})
+	}
+	currentSvcs := []v1.Service{}
+	for _, svc := range currentServices.Items {
+		if invalid[svc.Labels[loadBalancerIDLabel]] {
+			continue
+		}
+		currentSvcs = append(currentSvcs, svc)
+	}
 
-		// Convert the k8s list to type []Endpoints so make comparison easier
-		currentEndpoints := []Endpoints{}
-		for _, v := range currentk8sEndpoints.Items {
-			currentEndpoints = append(currentEndpoints, Endpoints{endpoints: v, upstreamName: ""})
+	// Reconcile current state with desired state
+	desiredSvcs := kubeServices(r.BackendName, projectName, lbs, lbPools)
+	desiredEndpoints := kubeEndpoints(r.BackendName, projectName, lbs, lbPools, r.UnhealthyMembers)
+	if r.Weight != "" {
+		for i := range desiredSvcs {
+			translator.AddWeight(&desiredSvcs[i].ObjectMeta, r.Weight, nil)
 		}
+	}
 
-		// Reconcile current state with desired state
-		desiredSvcs := kubeServices(r.BackendName, projectName, loadbalancers)
-		r.reconcileSvcs(desiredSvcs, currentServices.Items)
+	if r.ServerLister != nil {
+		var servers []Server
+		err = withContext(ctx, func() (err error) {
+			servers, err = r.ServerLister.ListServers(project.ID)
+			return err
+		})
+		if err != nil {
+			r.Metrics.GenericMetricError("ListServers")
+			return err
+		}
+		addTopology(desiredSvcs, desiredEndpoints, lbs, lbPools, servers, r.Region)
+	}
 
-		desiredEndpoints := kubeEndpoints(r.BackendName, projectName, loadbalancers, pools)
-		r.reconcileEndpoints(desiredEndpoints, currentEndpoints)
+	// Do not write a state that may be outdated by the time it is synced
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.reconcileSvcs(desiredSvcs, currentSvcs)
+	r.reconcileEndpoints(desiredEndpoints, currentEndpoints)
 
-		// Log upstream /invalid services to prometheus
-		r.Metrics.DiscovererUpstreamServicesMetric(projectName, totalUpstreamServices)
-		r.Metrics.DiscovererInvalidServicesMetric(projectName, totalInvalidServices)
+	// Log upstream /invalid services to prometheus
+	r.Metrics.DiscovererUpstreamServicesMetric(projectName, totalUpstreamServices)
+	r.Metrics.DiscovererInvalidServicesMetric(projectName, totalInvalidServices)
 
-		for _, ep := range desiredEndpoints {
-			totalUpstreamEndpoints := sync.SumEndpoints(&ep.endpoints)
-			r.Metrics.DiscovererUpstreamEndpointsMetric(projectName, ep.upstreamName, totalUpstreamEndpoints)
-		}
+	for _, ep := range desiredEndpoints {
+		totalUpstreamEndpoints := sync.SumEndpoints(&ep.endpoints)
+		r.Metrics.DiscovererUpstreamEndpointsMetric(projectName, ep.upstreamName, totalUpstreamEndpoints)
 	}
+	return nil
+}
 
-	// Log to Prometheus the cycle duration
-	r.Metrics.CycleDurationMetric(time.Since(start))
+// withContext runs f, and returns the error of the context if it is done
+// before f returns. The OpenStack clients do not take a context, so f keeps
+// running in the background until it returns, which the HTTP client timeout
+// bounds, and its results are discarded.
+func withContext(ctx context.Context, f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (r *Reconciler) reconcileSvcs(desiredSvcs, currentSvcs []v1.Service) {
@@ -0,0 +1,61 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+)
+
+// memberStatuses returns the operating status of the members of the load
+// balancers of the given pools, by member ID. The member lists of the Neutron
+// LBaaS v2 API do not include the operating status of members, which is only
+// returned in the status tree of their load balancer.
+func (c LoadBalancerV2Client) memberStatuses(ps []pools.Pool) (map[string]string, error) {
+	ids := map[string]bool{}
+	for _, p := range ps {
+		for _, lb := range p.Loadbalancers {
+			ids[lb.ID] = true
+		}
+	}
+	sorted := make([]string, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+
+	statuses := map[string]string{}
+	for _, id := range sorted {
+		tree, err := loadbalancers.GetStatuses(c.client, id).Extract()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get statuses of load balancer ID %q: %v", id, err)
+		}
+		if tree == nil || tree.Loadbalancer == nil {
+			continue
+		}
+		treePools := tree.Loadbalancer.Pools
+		for _, l := range tree.Loadbalancer.Listeners {
+			treePools = append(treePools, l.Pools...)
+		}
+		for _, p := range treePools {
+			for _, m := range p.Members {
+				statuses[m.ID] = m.OperatingStatus
+			}
+		}
+	}
+	return statuses, nil
+}
@@ -0,0 +1,69 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadBalancerV2ListPoolsMemberStatuses(t *testing.T) {
+	// The Neutron member lists have no operating status, which is only in
+	// the status tree of the load balancer
+	bodies := map[string]string{
+		"/lbaas/pools": `{"pools": [{"id": "pool-1", "tenant_id": "finance", "healthmonitor_id": "hm-1",
+			"loadbalancers": [{"id": "lb-1"}]}, {"id": "pool-2", "tenant_id": "finance", "loadbalancers": [{"id": "lb-1"}]}]}`,
+		"/lbaas/healthmonitors": `{"healthmonitors": [{"id": "hm-1", "tenant_id": "finance", "type": "HTTP"}]}`,
+		"/lbaas/pools/pool-1/members": `{"members": [{"id": "m-1", "tenant_id": "finance", "address": "192.168.0.1",
+			"protocol_port": 8080, "admin_state_up": true}, {"id": "m-2", "tenant_id": "finance", "address": "192.168.0.2",
+			"protocol_port": 8080, "admin_state_up": true}]}`,
+		"/lbaas/pools/pool-2/members": `{"members": [{"id": "m-3", "tenant_id": "finance", "address": "192.168.0.3",
+			"protocol_port": 9090, "admin_state_up": true}]}`,
+		"/lbaas/loadbalancers/lb-1/statuses": `{"statuses": {"loadbalancer": {"id": "lb-1",
+			"listeners": [{"id": "l-1", "pools": [{"id": "pool-1", "members": [{"id": "m-1", "operating_status": "ONLINE"},
+			{"id": "m-2", "operating_status": "ERROR"}]}]}],
+			"pools": [{"id": "pool-2", "members": [{"id": "m-3", "operating_status": "NO_MONITOR"}]}]}}}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := bodies[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+	c := LoadBalancerV2Client{&gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: srv.URL + "/"}}
+
+	ps, err := c.ListPools("finance")
+	require.NoError(t, err)
+	require.Len(t, ps, 2)
+	statuses := map[string]string{}
+	ready := map[string]bool{}
+	for _, p := range ps {
+		for _, m := range p.Members {
+			statuses[m.ID] = m.OperatingStatus
+			ready[m.ID] = memberReady(m)
+		}
+	}
+	assert.Equal(t, map[string]string{"m-1": "ONLINE", "m-2": "ERROR", "m-3": "NO_MONITOR"}, statuses)
+	assert.Equal(t, map[string]bool{"m-1": true, "m-2": false, "m-3": true}, ready)
+}
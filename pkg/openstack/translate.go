@@ -14,7 +14,7 @@
 package openstack
 
 import (
-	"regexp"
+	"fmt"
 	"strconv"
 	"strings"
 
@@ -28,8 +28,74 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-// returns a kubernetes service for each load balancer in the slice
-func kubeServices(backendName, tenantName string, lbs []loadbalancers.LoadBalancer) []v1.Service {
+const (
+	// loadBalancerIDLabel is the key of the label that contains the ID of the
+	// load balancer of a service
+	loadBalancerIDLabel = "gimbal.projectcontour.io/load-balancer-id"
+
+	// GimbalAnnotationProxyProtocol is the key of the annotation of a service
+	// that lists the ports whose pool members expect the PROXY protocol
+	GimbalAnnotationProxyProtocol = "gimbal.projectcontour.io/proxy-protocol"
+
+	// contourAnnotationUpstreamProtocol is the prefix of the keys of the
+	// Contour annotations that list the ports of a service whose endpoints
+	// speak the protocol of the key suffix
+	contourAnnotationUpstreamProtocol = "projectcontour.io/upstream-protocol."
+)
+
+// UnhealthyMemberPolicy determines what happens to the addresses of the pool
+// members that are disabled or unhealthy
+type UnhealthyMemberPolicy string
+
+const (
+	// UnhealthyMemberNotReady writes the addresses of unhealthy members to
+	// the not ready addresses of the endpoints. This is the default.
+	UnhealthyMemberNotReady UnhealthyMemberPolicy = "not-ready"
+	// UnhealthyMemberDrop leaves the addresses of unhealthy members out of
+	// the endpoints.
+	UnhealthyMemberDrop UnhealthyMemberPolicy = "drop"
+)
+
+// ParseUnhealthyMemberPolicy returns the UnhealthyMemberPolicy with the given
+// name.
+func ParseUnhealthyMemberPolicy(policy string) (UnhealthyMemberPolicy, error) {
+	switch UnhealthyMemberPolicy(policy) {
+	case UnhealthyMemberNotReady, UnhealthyMemberDrop:
+		return UnhealthyMemberPolicy(policy), nil
+	}
+	return "", fmt.Errorf("invalid unhealthy member policy %q, must be one of %q or %q", policy,
+		UnhealthyMemberNotReady, UnhealthyMemberDrop)
+}
+
+// memberReady returns true if the member is enabled, and it is not reported
+// as unhealthy or draining by the health monitor of its pool. Members of
+// pools without health monitors are ready.
+func memberReady(member pools.Member) bool {
+	if !member.AdminStateUp {
+		return false
+	}
+	switch member.OperatingStatus {
+	case "ERROR", "OFFLINE", "DRAINING":
+		return false
+	}
+	return true
+}
+
+// loadBalancerValid returns false if the load balancer failed to provision, or
+// if a change to it is pending. The state of such load balancers is not
+// replicated until they are active again.
+func loadBalancerValid(lb loadbalancers.LoadBalancer) bool {
+	return lb.ProvisioningStatus != "ERROR" && !strings.HasPrefix(lb.ProvisioningStatus, "PENDING_")
+}
+
+// returns a kubernetes service for each load balancer in the slice, and for
+// each pool that the L7 policies of the load balancers route requests to
+func kubeServices(backendName, tenantName string, lbs []loadbalancers.LoadBalancer, ps []pools.Pool) []v1.Service {
+	poolsByID := map[string]pools.Pool{}
+	for _, p := range ps {
+		poolsByID[p.ID] = p
+	}
+
 	var svcs []v1.Service
 	for _, lb := range lbs {
 		svc := v1.Service{
@@ -43,16 +109,57 @@ func kubeServices(backendName, tenantName string, lbs []loadbalancers.LoadBalanc
 				ClusterIP: "None",
 			},
 		}
+		var checks []HealthCheck
 		for _, l := range lb.Listeners {
-			svc.Spec.Ports = append(svc.Spec.Ports, servicePort(&l))
+			pool := poolsByID[l.DefaultPoolID]
+			svc.Spec.Ports = append(svc.Spec.Ports, servicePort(&l, pool))
+			addProtocolAnnotations(&svc.ObjectMeta, &l, pool)
+			if check, ok := healthCheck(&l, pool); ok {
+				checks = append(checks, check)
+			}
 		}
+		addHealthChecks(&svc.ObjectMeta, checks)
 		svcs = append(svcs, svc)
+
+		// The pools that L7 policies route requests to get services of
+		// their own
+		for _, pool := range l7Pools(lb) {
+			svc := v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   tenantName,
+					Name:        translator.BuildDiscoveredName(backendName, pool.serviceName()),
+					Labels:      translator.AddGimbalLabels(backendName, pool.serviceName(), pool.labels(lb)),
+					Annotations: map[string]string{GimbalAnnotationL7Policies: pool.annotation()},
+				},
+				Spec: v1.ServiceSpec{
+					Type:      v1.ServiceTypeClusterIP,
+					ClusterIP: "None",
+				},
+			}
+			var checks []HealthCheck
+			for _, l := range pool.listeners {
+				svc.Spec.Ports = append(svc.Spec.Ports, servicePort(&l, poolsByID[pool.id]))
+				addProtocolAnnotations(&svc.ObjectMeta, &l, poolsByID[pool.id])
+				if check, ok := healthCheck(&l, poolsByID[pool.id]); ok {
+					checks = append(checks, check)
+				}
+			}
+			addHealthChecks(&svc.ObjectMeta, checks)
+			svcs = append(svcs, svc)
+		}
 	}
 	return svcs
 }
 
-// returns a kubernetes endpoints resource for each load balancer in the slice
-func kubeEndpoints(backendName, tenantName string, lbs []loadbalancers.LoadBalancer, ps []pools.Pool) []Endpoints {
+// returns a kubernetes endpoints resource for each load balancer in the slice,
+// and for each pool that the L7 policies of the load balancers route requests to
+func kubeEndpoints(backendName, tenantName string, lbs []loadbalancers.LoadBalancer, ps []pools.Pool,
+	unhealthy UnhealthyMemberPolicy) []Endpoints {
+	poolsByID := map[string]pools.Pool{}
+	for _, p := range ps {
+		poolsByID[p.ID] = p
+	}
+
 	endpoints := []Endpoints{}
 	for _, lb := range lbs {
 		ep := v1.Endpoints{
@@ -63,70 +170,132 @@ func kubeEndpoints(backendName, tenantName string, lbs []loadbalancers.LoadBalan
 			},
 		}
 		for _, l := range lb.Listeners {
-			// compute endpoint susbsets for each listener
-			subsets := map[int]v1.EndpointSubset{}
-
-			// get the listeners pool
-			var pool pools.Pool
-			for _, p := range ps {
-				if l.DefaultPoolID == p.ID {
-					pool = p
-					break
-				}
-			}
+			ep.Subsets = append(ep.Subsets, poolSubsets(&l, poolsByID[l.DefaultPoolID], unhealthy)...)
+		}
+		endpoints = append(endpoints, Endpoints{endpoints: ep, upstreamName: serviceNameOriginal(lb)})
 
-			// We want to group all members that are listening on the same port
-			// into a single EndpointSubset. We achieve this by using a map of
-			// subsets, keyed by the listening port.
-			for _, member := range pool.Members {
-				s := subsets[member.ProtocolPort]
-				// Add the port if we haven't added it yet to the EndpointSubset
-				if len(s.Ports) == 0 {
-					s.Ports = append(s.Ports, v1.EndpointPort{Name: portName(&l), Port: int32(member.ProtocolPort), Protocol: v1.ProtocolTCP})
-				}
-				s.Addresses = append(s.Addresses, v1.EndpointAddress{IP: member.Address}) // TODO: can address be something other than an IP address?
-				subsets[member.ProtocolPort] = s
+		for _, pool := range l7Pools(lb) {
+			ep := v1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: tenantName,
+					Name:      translator.BuildDiscoveredName(backendName, pool.serviceName()),
+					Labels:    translator.AddGimbalLabels(backendName, pool.serviceName(), pool.labels(lb)),
+				},
 			}
-
-			// Add the subsets to the Endpoint
-			for _, s := range subsets {
-				ep.Subsets = append(ep.Subsets, s)
+			for _, l := range pool.listeners {
+				ep.Subsets = append(ep.Subsets, poolSubsets(&l, poolsByID[pool.id], unhealthy)...)
 			}
+			endpoints = append(endpoints, Endpoints{endpoints: ep, upstreamName: poolNameOriginal(poolsByID[pool.id])})
 		}
-		endpoints = append(endpoints, Endpoints{endpoints: ep, upstreamName: serviceNameOriginal(lb)})
 	}
 	return endpoints
 }
 
-func loadbalancerLabels(lb loadbalancers.LoadBalancer) map[string]string {
-	// Sanitize the load balancer name according to the kubernetes label value
-	// requirements: "Valid label values must be 63 characters or less and must
-	// be empty or begin and end with an alphanumeric character ([a-z0-9A-Z])
-	// with dashes (-), underscores (_), dots (.), and alphanumerics between."
-	name := lb.Name
-	if name != "" {
-		// 1. replace unallowed chars with a dash
-		reg := regexp.MustCompile(`[^a-zA-Z0-9\-._]`)
-		name = reg.ReplaceAllString(lb.Name, "-")
-
-		// 2. prepend/append a special marker if first/last char is not an alphanum
-		if !isalphanum(name[0]) {
-			name = "lb" + name
+// poolSubsets returns the endpoint subsets of the members of the pool that
+// the listener routes requests to
+func poolSubsets(l *listeners.Listener, pool pools.Pool, unhealthy UnhealthyMemberPolicy) []v1.EndpointSubset {
+	subsets := map[int]v1.EndpointSubset{}
+
+	// We want to group all members that are listening on the same port
+	// into a single EndpointSubset. We achieve this by using a map of
+	// subsets, keyed by the listening port.
+	for _, member := range pool.Members {
+		ready := memberReady(member)
+		if !ready && unhealthy == UnhealthyMemberDrop {
+			continue
 		}
-		if !isalphanum(name[len(name)-1]) {
-			name = name + "lb"
+		s := subsets[member.ProtocolPort]
+		// Add the port if we haven't added it yet to the EndpointSubset
+		if len(s.Ports) == 0 {
+			s.Ports = append(s.Ports, v1.EndpointPort{Name: portName(l), Port: int32(member.ProtocolPort), Protocol: portProtocol(l)})
 		}
-		// 3. shorten if necessary
-		name = translator.ShortenKubernetesLabelValue(name)
+		address := v1.EndpointAddress{IP: member.Address} // TODO: can address be something other than an IP address?
+		if ready {
+			s.Addresses = append(s.Addresses, address)
+		} else {
+			s.NotReadyAddresses = append(s.NotReadyAddresses, address)
+		}
+		subsets[member.ProtocolPort] = s
 	}
-	return map[string]string{
-		"gimbal.projectcontour.io/load-balancer-id":   lb.ID,
-		"gimbal.projectcontour.io/load-balancer-name": name,
+
+	var result []v1.EndpointSubset
+	for _, s := range subsets {
+		result = append(result, s)
 	}
+	return result
 }
 
-func isalphanum(c byte) bool {
-	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+// addTopology records the availability zones of the servers of the members of
+// each load balancer, and the region of the cluster, in the labels and
+// annotations of its service. The addresses of the endpoints get the name of
+// their server as node name.
+func addTopology(svcs []v1.Service, endpoints []Endpoints, lbs []loadbalancers.LoadBalancer, ps []pools.Pool,
+	servers []Server, region string) {
+	serversByAddress := map[string]Server{}
+	for _, s := range servers {
+		for _, address := range s.Addresses {
+			serversByAddress[address] = s
+		}
+	}
+	poolsByID := map[string]pools.Pool{}
+	for _, p := range ps {
+		poolsByID[p.ID] = p
+	}
+
+	topologies := map[string]translator.Topology{}
+	for _, lb := range lbs {
+		var t translator.Topology
+		t.Add("", region)
+		for _, l := range lb.Listeners {
+			for _, member := range poolsByID[l.DefaultPoolID].Members {
+				if s, ok := serversByAddress[member.Address]; ok {
+					t.Add(s.AvailabilityZone, region)
+				}
+			}
+		}
+		topologies[lb.ID] = t
+	}
+	// The services of the pools of L7 policies span the zones of the
+	// members of their pool
+	poolTopologies := map[string]translator.Topology{}
+	for _, p := range ps {
+		var t translator.Topology
+		t.Add("", region)
+		for _, member := range p.Members {
+			if s, ok := serversByAddress[member.Address]; ok {
+				t.Add(s.AvailabilityZone, region)
+			}
+		}
+		poolTopologies[p.ID] = t
+	}
+
+	for i := range svcs {
+		t := topologies[svcs[i].Labels[loadBalancerIDLabel]]
+		if poolID, ok := svcs[i].Labels[poolIDLabel]; ok {
+			t = poolTopologies[poolID]
+		}
+		translator.AddTopology(&svcs[i].ObjectMeta, t)
+	}
+	for i := range endpoints {
+		for j := range endpoints[i].endpoints.Subsets {
+			subset := &endpoints[i].endpoints.Subsets[j]
+			for _, addresses := range [][]v1.EndpointAddress{subset.Addresses, subset.NotReadyAddresses} {
+				for k := range addresses {
+					if s, ok := serversByAddress[addresses[k].IP]; ok && s.Name != "" {
+						name := s.Name
+						addresses[k].NodeName = &name
+					}
+				}
+			}
+		}
+	}
+}
+
+func loadbalancerLabels(lb loadbalancers.LoadBalancer) map[string]string {
+	return map[string]string{
+		loadBalancerIDLabel:                           lb.ID,
+		"gimbal.projectcontour.io/load-balancer-name": translator.SanitizeLabelValue(lb.Name, "lb"),
+	}
 }
 
 // use the load balancer ID as the service name
@@ -135,6 +304,14 @@ func serviceName(lb loadbalancers.LoadBalancer) string {
 	return strings.ToLower(lb.ID)
 }
 
+// get the pool Name or ID if name is empty
+func poolNameOriginal(pool pools.Pool) string {
+	if pool.Name == "" {
+		return strings.ToLower(pool.ID)
+	}
+	return strings.ToLower(pool.Name)
+}
+
 // get the lb Name or ID if name is empty
 func serviceNameOriginal(lb loadbalancers.LoadBalancer) string {
 	lbName := lb.Name
@@ -144,7 +321,9 @@ func serviceNameOriginal(lb loadbalancers.LoadBalancer) string {
 	return strings.ToLower(lbName)
 }
 
-func servicePort(listener *listeners.Listener) v1.ServicePort {
+// servicePort returns the service port of a listener, whose application
+// protocol is the one of the members of the pool of the listener
+func servicePort(listener *listeners.Listener, pool pools.Pool) v1.ServicePort {
 	pn := portName(listener)
 	return v1.ServicePort{
 		Name: pn,
@@ -153,9 +332,62 @@ func servicePort(listener *listeners.Listener) v1.ServicePort {
 		// this ourselves, we prevent the discoverer from thinking it needs to
 		// perform an update every time it compares the translated object with
 		// the one that exists in gimbal.
-		TargetPort: intstr.FromInt(listener.ProtocolPort),
-		Protocol:   v1.ProtocolTCP, // only support TCP
+		TargetPort:  intstr.FromInt(listener.ProtocolPort),
+		Protocol:    portProtocol(listener),
+		AppProtocol: appProtocol(pool),
+	}
+}
+
+// portProtocol returns the transport protocol of a listener. Listeners of
+// all the other protocols, from TCP to TERMINATED_HTTPS, run over TCP.
+func portProtocol(listener *listeners.Listener) v1.Protocol {
+	switch listener.Protocol {
+	case "UDP":
+		return v1.ProtocolUDP
+	case "SCTP":
+		return v1.ProtocolSCTP
+	}
+	return v1.ProtocolTCP
+}
+
+// appProtocol returns the application protocol of the members of a pool, or
+// nil if the pool does not define one, such as TCP, UDP and PROXY pools
+func appProtocol(pool pools.Pool) *string {
+	var protocol string
+	switch pool.Protocol {
+	case "HTTP":
+		protocol = "http"
+	case "HTTPS":
+		protocol = "https"
+	default:
+		return nil
+	}
+	return &protocol
+}
+
+// addProtocolAnnotations records the port of a listener in the Contour
+// upstream protocol annotation of the service when the members of its pool
+// expect TLS, and in the PROXY protocol annotation when they expect the PROXY
+// protocol. The pools of HTTPS listeners pass TLS through, so Contour must not
+// originate TLS to their members.
+func addProtocolAnnotations(meta *metav1.ObjectMeta, listener *listeners.Listener, pool pools.Pool) {
+	var key string
+	switch {
+	case pool.Protocol == "HTTPS" && listener.Protocol != "HTTPS":
+		key = contourAnnotationUpstreamProtocol + "tls"
+	case pool.Protocol == "PROXY" || pool.Protocol == "PROXYV2":
+		key = GimbalAnnotationProxyProtocol
+	default:
+		return
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	port := strconv.Itoa(listener.ProtocolPort)
+	if ports, ok := meta.Annotations[key]; ok {
+		port = ports + "," + port
 	}
+	meta.Annotations[key] = port
 }
 
 func portName(listener *listeners.Listener) string {
@@ -418,7 +418,7 @@ func TestKubeServices(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			got := kubeServices(tc.backendName, tc.tenantName, tc.lbs)
+			got := kubeServices(tc.backendName, tc.tenantName, tc.lbs, nil)
 			assert.Equal(t, tc.expected, got)
 			assert.Len(t, got, len(tc.lbs))
 		})
@@ -550,7 +550,7 @@ func TestKubeEndpoints(t *testing.T) {
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			gotReturn := kubeEndpoints(tc.backendName, tc.tenantName, tc.lbs, tc.pools)
+			gotReturn := kubeEndpoints(tc.backendName, tc.tenantName, tc.lbs, tc.pools, UnhealthyMemberNotReady)
 			// Cannot use assert.Equal on the structs as the order of subsets is undetermined.
 			var got []Endpoints
 			got = append(got, gotReturn...)
@@ -565,6 +565,159 @@ func TestKubeEndpoints(t *testing.T) {
 	}
 }
 
+func TestKubeServicesProtocols(t *testing.T) {
+	lbs := []loadbalancers.LoadBalancer{loadbalancer("lb-1", "",
+		listener("l-1", "", "HTTP", "pool-http", 80),
+		listener("l-2", "", "TERMINATED_HTTPS", "pool-https", 443),
+		listener("l-3", "", "HTTPS", "pool-passthrough", 8443),
+		listener("l-4", "", "TCP", "pool-proxy", 8080),
+		listener("l-5", "", "UDP", "pool-udp", 53),
+		listener("l-6", "", "TCP", "pool-https", 9443),
+	)}
+	ps := []pools.Pool{
+		pool("pool-http", "HTTP", "lb-1", poolmember("10.0.0.1", 8080)),
+		pool("pool-https", "HTTPS", "lb-1", poolmember("10.0.0.1", 8443)),
+		pool("pool-passthrough", "HTTPS", "lb-1", poolmember("10.0.0.1", 8443)),
+		pool("pool-proxy", "PROXY", "lb-1", poolmember("10.0.0.1", 8080)),
+		pool("pool-udp", "UDP", "lb-1", poolmember("10.0.0.1", 5353)),
+	}
+	http, https := "http", "https"
+
+	svcs := kubeServices("us-east", "finance", lbs, ps)
+	assert.Equal(t, []v1.ServicePort{
+		{Name: "port-80", Port: 80, TargetPort: intstr.FromInt(80), Protocol: v1.ProtocolTCP, AppProtocol: &http},
+		{Name: "port-443", Port: 443, TargetPort: intstr.FromInt(443), Protocol: v1.ProtocolTCP, AppProtocol: &https},
+		{Name: "port-8443", Port: 8443, TargetPort: intstr.FromInt(8443), Protocol: v1.ProtocolTCP, AppProtocol: &https},
+		{Name: "port-8080", Port: 8080, TargetPort: intstr.FromInt(8080), Protocol: v1.ProtocolTCP},
+		{Name: "port-53", Port: 53, TargetPort: intstr.FromInt(53), Protocol: v1.ProtocolUDP},
+		{Name: "port-9443", Port: 9443, TargetPort: intstr.FromInt(9443), Protocol: v1.ProtocolTCP, AppProtocol: &https},
+	}, svcs[0].Spec.Ports)
+	// TLS passes through HTTPS listeners, so Contour must not originate it
+	assert.Equal(t, map[string]string{
+		"projectcontour.io/upstream-protocol.tls": "443,9443",
+		"gimbal.projectcontour.io/proxy-protocol": "8080",
+	}, svcs[0].Annotations)
+
+	endpoints := kubeEndpoints("us-east", "finance", lbs, ps, UnhealthyMemberNotReady)
+	assert.Contains(t, endpoints[0].endpoints.Subsets, v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+		Ports:     []v1.EndpointPort{{Name: "port-53", Port: 5353, Protocol: v1.ProtocolUDP}},
+	})
+}
+
+func TestKubeEndpointsUnhealthyMembers(t *testing.T) {
+	member := func(address string, adminStateUp bool, operatingStatus string) pools.Member {
+		m := poolmember(address, 8080)
+		m.AdminStateUp = adminStateUp
+		m.OperatingStatus = operatingStatus
+		return m
+	}
+	lbs := []loadbalancers.LoadBalancer{loadbalancer("lb-1", "", listener("l-1", "", "HTTP", "pool-1", 80))}
+	ps := []pools.Pool{pool("pool-1", "HTTP", "lb-1",
+		member("10.0.0.1", true, "ONLINE"),
+		member("10.0.0.2", true, "NO_MONITOR"),
+		member("10.0.0.3", true, ""),
+		member("10.0.0.4", false, "ONLINE"),
+		member("10.0.0.5", true, "ERROR"),
+		member("10.0.0.6", true, "DRAINING"),
+	)}
+	ports := []v1.EndpointPort{{Name: "port-80", Port: 8080, Protocol: v1.ProtocolTCP}}
+	ready := []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}, {IP: "10.0.0.3"}}
+
+	endpoints := kubeEndpoints("us-east", "finance", lbs, ps, UnhealthyMemberNotReady)
+	assert.Equal(t, []v1.EndpointSubset{{
+		Addresses:         ready,
+		NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.4"}, {IP: "10.0.0.5"}, {IP: "10.0.0.6"}},
+		Ports:             ports,
+	}}, endpoints[0].endpoints.Subsets)
+
+	endpoints = kubeEndpoints("us-east", "finance", lbs, ps, UnhealthyMemberDrop)
+	assert.Equal(t, []v1.EndpointSubset{{Addresses: ready, Ports: ports}}, endpoints[0].endpoints.Subsets)
+}
+
+func TestLoadBalancerValid(t *testing.T) {
+	tests := map[string]bool{
+		"":               true,
+		"ACTIVE":         true,
+		"ERROR":          false,
+		"PENDING_CREATE": false,
+		"PENDING_UPDATE": false,
+		"PENDING_DELETE": false,
+	}
+	for status, valid := range tests {
+		lb := loadbalancer("lb-1", "")
+		lb.ProvisioningStatus = status
+		assert.Equal(t, valid, loadBalancerValid(lb), status)
+	}
+}
+
+func TestParseUnhealthyMemberPolicy(t *testing.T) {
+	policy, err := ParseUnhealthyMemberPolicy("drop")
+	assert.NoError(t, err)
+	assert.Equal(t, UnhealthyMemberDrop, policy)
+
+	_, err = ParseUnhealthyMemberPolicy("ignore")
+	assert.Error(t, err)
+}
+
+func TestAddTopology(t *testing.T) {
+	lbs := []loadbalancers.LoadBalancer{
+		loadbalancer("lb-1", "", listener("l-1", "", "HTTP", "pool-1", 80)),
+		loadbalancer("lb-2", "", listener("l-2", "", "HTTP", "pool-2", 80)),
+		loadbalancer("lb-3", "", listener("l-3", "", "HTTP", "pool-3", 80)),
+	}
+	ps := []pools.Pool{
+		pool("pool-1", "HTTP", "lb-1", poolmember("10.0.0.1", 8080), poolmember("10.0.0.2", 8080)),
+		pool("pool-2", "HTTP", "lb-2", poolmember("10.0.0.1", 8080), poolmember("10.0.0.3", 8080)),
+		pool("pool-3", "HTTP", "lb-3", poolmember("10.0.0.9", 8080)),
+	}
+	servers := []Server{
+		{Name: "web-1", AvailabilityZone: "nova-a", Addresses: []string{"10.0.0.1"}},
+		{Name: "web-2", AvailabilityZone: "nova-a", Addresses: []string{"10.0.0.2", "172.16.0.2"}},
+		{Name: "web-3", AvailabilityZone: "nova-b", Addresses: []string{"10.0.0.3"}},
+	}
+	svcs := kubeServices("us-east", "finance", lbs, ps)
+	endpoints := kubeEndpoints("us-east", "finance", lbs, ps, UnhealthyMemberNotReady)
+
+	addTopology(svcs, endpoints, lbs, ps, servers, "RegionOne")
+
+	// All the members of lb-1 are in the same zone
+	assert.Equal(t, "nova-a", svcs[0].Labels["gimbal.projectcontour.io/zone"])
+	assert.Equal(t, "RegionOne", svcs[0].Labels["gimbal.projectcontour.io/region"])
+	assert.Equal(t, map[string]string{"gimbal.projectcontour.io/zones": "nova-a"}, svcs[0].Annotations)
+	// The members of lb-2 span two zones
+	assert.NotContains(t, svcs[1].Labels, "gimbal.projectcontour.io/zone")
+	assert.Equal(t, "RegionOne", svcs[1].Labels["gimbal.projectcontour.io/region"])
+	assert.Equal(t, map[string]string{"gimbal.projectcontour.io/zones": "nova-a,nova-b"}, svcs[1].Annotations)
+	// The member of lb-3 is not a known server
+	assert.NotContains(t, svcs[2].Labels, "gimbal.projectcontour.io/zone")
+	assert.Equal(t, "RegionOne", svcs[2].Labels["gimbal.projectcontour.io/region"])
+	assert.Empty(t, svcs[2].Annotations)
+
+	nodeNames := map[string]string{}
+	for _, ep := range endpoints {
+		for _, s := range ep.endpoints.Subsets {
+			for _, a := range s.Addresses {
+				if a.NodeName != nil {
+					nodeNames[a.IP] = *a.NodeName
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]string{"10.0.0.1": "web-1", "10.0.0.2": "web-2", "10.0.0.3": "web-3"}, nodeNames)
+}
+
+func TestServerAddresses(t *testing.T) {
+	networks := map[string]interface{}{
+		"private": []interface{}{
+			map[string]interface{}{"addr": "10.0.0.1", "version": float64(4)},
+			map[string]interface{}{"addr": "fd00::1", "version": float64(6)},
+		},
+		"invalid": "not a list",
+	}
+	assert.ElementsMatch(t, []string{"10.0.0.1", "fd00::1"}, serverAddresses(networks))
+}
+
 func service(namespace, name string, labels map[string]string, ports []v1.ServicePort) v1.Service {
 	return v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
@@ -619,21 +772,5 @@ func pool(id, protocol, loadBalancerID string, members ...pools.Member) pools.Po
 }
 
 func poolmember(address string, port int) pools.Member {
-	return pools.Member{Address: address, ProtocolPort: port}
-}
-
-func TestIsAlphanum(t *testing.T) {
-	someAlphanums := []byte{'a', 'e', 'z', 'A', 'E', 'Z', '0', '5', '9'}
-	for _, a := range someAlphanums {
-		if !isalphanum(a) {
-			t.Errorf("got not alphanum for %c", a)
-		}
-	}
-
-	someNonAlphanums := []byte{'!', '@', '#', '$', '%', '^', '&', '*', '(', ')', '.', ',', ':', '-', '_', '+', '='}
-	for _, a := range someNonAlphanums {
-		if isalphanum(a) {
-			t.Errorf("got yes alphanum for %c", a)
-		}
-	}
+	return pools.Member{Address: address, ProtocolPort: port, AdminStateUp: true}
 }
@@ -0,0 +1,179 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// SelectorAll is the selector recorded for the projects that are reconciled
+// because the watchlist is empty
+const SelectorAll = "all"
+
+// ProjectSelector selects OpenStack projects by ID, name, name regular
+// expression, Keystone tag or domain ID
+type ProjectSelector struct {
+	text  string
+	match func(project Project) bool
+}
+
+// ParseProjectSelector parses a selector of the form id:<project ID>,
+// name:<project name>, regex:<name regular expression>, tag:<project tag> or
+// domain:<domain ID>. Selectors without a prefix select projects by name.
+func ParseProjectSelector(text string) (ProjectSelector, error) {
+	text = strings.TrimSpace(text)
+	kind, value := "name", text
+	if i := strings.Index(text, ":"); i >= 0 {
+		kind, value = text[:i], text[i+1:]
+	}
+	if value == "" {
+		return ProjectSelector{}, fmt.Errorf("invalid project selector %q, the value is empty", text)
+	}
+
+	s := ProjectSelector{text: text}
+	switch kind {
+	case "id":
+		s.match = func(project Project) bool { return project.ID == value }
+	case "name":
+		s.match = func(project Project) bool { return project.Name == value }
+	case "regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return ProjectSelector{}, fmt.Errorf("invalid project selector %q: %v", text, err)
+		}
+		s.match = func(project Project) bool { return re.MatchString(project.Name) }
+	case "tag":
+		s.match = func(project Project) bool { return contains(project.Tags, value) }
+	case "domain":
+		s.match = func(project Project) bool { return project.DomainID == value }
+	default:
+		return ProjectSelector{}, fmt.Errorf("invalid project selector %q, must start with id:, name:, regex:, tag: or domain:", text)
+	}
+	return s, nil
+}
+
+// String returns the selector as it was written
+func (s ProjectSelector) String() string {
+	return s.text
+}
+
+// Matches returns true if the selector selects the project
+func (s ProjectSelector) Matches(project Project) bool {
+	return s.match(project)
+}
+
+// ProjectWatchlist selects the projects that are reconciled. A project is
+// reconciled if it matches a selector of the watchlist, or if the watchlist
+// is empty, unless it matches a selector of the exclude list.
+type ProjectWatchlist struct {
+	Watchlist []ProjectSelector
+	Exclude   []ProjectSelector
+}
+
+// ParseProjectWatchlist parses the comma-separated selectors of the watchlist
+// and of the exclude list.
+func ParseProjectWatchlist(watchlist, exclude string) (ProjectWatchlist, error) {
+	return parseProjectWatchlist(splitSelectors(watchlist), splitSelectors(exclude))
+}
+
+func parseProjectWatchlist(watchlist, exclude []string) (ProjectWatchlist, error) {
+	var w ProjectWatchlist
+	for _, text := range watchlist {
+		s, err := ParseProjectSelector(text)
+		if err != nil {
+			return ProjectWatchlist{}, err
+		}
+		w.Watchlist = append(w.Watchlist, s)
+	}
+	for _, text := range exclude {
+		s, err := ParseProjectSelector(text)
+		if err != nil {
+			return ProjectWatchlist{}, err
+		}
+		w.Exclude = append(w.Exclude, s)
+	}
+	return w, nil
+}
+
+func splitSelectors(selectors string) []string {
+	var result []string
+	for _, s := range strings.Split(selectors, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// projectWatchlistFile is the format of the watchlist file
+type projectWatchlistFile struct {
+	Watchlist []string `json:"watchlist"`
+	Exclude   []string `json:"exclude"`
+}
+
+// ReadProjectWatchlistFile reads a YAML file with the selectors of the
+// watchlist and of the exclude list, e.g.:
+//
+//	watchlist:
+//	- tag:gimbal
+//	exclude:
+//	- regex:^test-
+func ReadProjectWatchlistFile(path string) (ProjectWatchlist, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ProjectWatchlist{}, fmt.Errorf("error reading project watchlist file: %v", err)
+	}
+	var file projectWatchlistFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return ProjectWatchlist{}, fmt.Errorf("error parsing project watchlist file %s: %v", path, err)
+	}
+	return parseProjectWatchlist(file.Watchlist, file.Exclude)
+}
+
+// Match returns the selector that selects the project, or SelectorAll if the
+// watchlist is empty. The project is not reconciled if ok is false, in which
+// case the selector is the one that excludes the project, if any.
+func (w ProjectWatchlist) Match(project Project) (selector string, ok bool) {
+	for _, s := range w.Exclude {
+		if s.Matches(project) {
+			return s.String(), false
+		}
+	}
+	if len(w.Watchlist) == 0 {
+		return SelectorAll, true
+	}
+	for _, s := range w.Watchlist {
+		if s.Matches(project) {
+			return s.String(), true
+		}
+	}
+	return "", false
+}
+
+// String returns the selectors of the watchlist, for logs
+func (w ProjectWatchlist) String() string {
+	join := func(selectors []ProjectSelector) string {
+		texts := make([]string, 0, len(selectors))
+		for _, s := range selectors {
+			texts = append(texts, s.String())
+		}
+		return strings.Join(texts, ",")
+	}
+	return fmt.Sprintf("watchlist=[%s] exclude=[%s]", join(w.Watchlist), join(w.Exclude))
+}
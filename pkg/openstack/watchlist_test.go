@@ -0,0 +1,183 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/projects"
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProjectSelector(t *testing.T) {
+	project := Project{
+		Project: projects.Project{ID: "8d0ec6a5", Name: "team-a", DomainID: "default"},
+		Tags:    []string{"gimbal", "production"},
+	}
+	tests := []struct {
+		selector string
+		matches  bool
+		err      bool
+	}{
+		{selector: "team-a", matches: true},
+		{selector: "team-b", matches: false},
+		{selector: "name:team-a", matches: true},
+		{selector: "id:8d0ec6a5", matches: true},
+		{selector: "id:team-a", matches: false},
+		{selector: "regex:^team-", matches: true},
+		{selector: "regex:^test-", matches: false},
+		{selector: "tag:gimbal", matches: true},
+		{selector: "tag:staging", matches: false},
+		{selector: "domain:default", matches: true},
+		{selector: "domain:other", matches: false},
+		{selector: "regex:[", err: true},
+		{selector: "label:gimbal", err: true},
+		{selector: "tag:", err: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.selector, func(t *testing.T) {
+			s, err := ParseProjectSelector(tc.selector)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.matches, s.Matches(project))
+			assert.Equal(t, tc.selector, s.String())
+		})
+	}
+}
+
+func TestProjectWatchlistMatch(t *testing.T) {
+	teamA := Project{Project: projects.Project{Name: "team-a"}, Tags: []string{"gimbal"}}
+	teamTest := Project{Project: projects.Project{Name: "team-test"}, Tags: []string{"gimbal"}}
+	admin := Project{Project: projects.Project{Name: "admin"}}
+
+	tests := []struct {
+		name      string
+		watchlist string
+		exclude   string
+		project   Project
+		selector  string
+		ok        bool
+	}{
+		{name: "empty watchlist", project: admin, selector: SelectorAll, ok: true},
+		{name: "first matching selector", watchlist: "regex:^team-, tag:gimbal", project: teamA, selector: "regex:^team-", ok: true},
+		{name: "no matching selector", watchlist: "regex:^team-,tag:gimbal", project: admin},
+		{name: "excluded", watchlist: "tag:gimbal", exclude: "regex:-test$", project: teamTest, selector: "regex:-test$"},
+		{name: "excluded from empty watchlist", exclude: "admin", project: admin, selector: "admin"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w, err := ParseProjectWatchlist(tc.watchlist, tc.exclude)
+			assert.NoError(t, err)
+			selector, ok := w.Match(tc.project)
+			assert.Equal(t, tc.selector, selector)
+			assert.Equal(t, tc.ok, ok)
+		})
+	}
+}
+
+// watchedProjects returns the selector of each project in the watched
+// projects metric
+func watchedProjects(t *testing.T, r *Reconciler) map[string]string {
+	gathering, err := r.Metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	watched := map[string]string{}
+	for _, mf := range gathering {
+		if mf.GetName() != localmetrics.DiscovererWatchedProjectsGauge {
+			continue
+		}
+		for _, m := range mf.Metric {
+			labels := map[string]string{}
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			watched[labels["namespace"]] = labels["selector"]
+		}
+	}
+	return watched
+}
+
+func TestReconcileWatchlistFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watchlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "watchlist.yaml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lister := &fakeLister{
+		projects: []string{"team-a", "team-b", "team-test", "admin"},
+		tags:     map[string][]string{"admin": {"gimbal"}},
+	}
+	r := testReconciler(lister, 2, 0)
+	r.WatchlistFile = path
+
+	write("watchlist:\n- regex:^team-\nexclude:\n- team-test\n")
+	r.reconcile(context.Background())
+	assert.Equal(t, map[string]int{"team-a": 2, "team-b": 2}, syncedNamespaces(t, r, 4))
+	assert.Equal(t, map[string]string{"team-a": "regex:^team-", "team-b": "regex:^team-"}, watchedProjects(t, r))
+
+	// Changes take effect on the next reconciliation
+	write("watchlist:\n- tag:gimbal\n- team-a\n")
+	r.reconcile(context.Background())
+	assert.Equal(t, map[string]int{"team-a": 2, "admin": 2}, syncedNamespaces(t, r, 4))
+	assert.Equal(t, map[string]string{"team-a": "team-a", "admin": "tag:gimbal"}, watchedProjects(t, r))
+
+	// An invalid watchlist keeps the previous one
+	write("watchlist:\n- regex:[\n")
+	r.reconcile(context.Background())
+	assert.Equal(t, map[string]int{"team-a": 2, "admin": 2}, syncedNamespaces(t, r, 4))
+}
+
+func TestReadProjectWatchlistFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watchlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "watchlist.yaml")
+
+	_, err = ReadProjectWatchlistFile(path)
+	assert.Error(t, err)
+
+	// Unknown keys are rejected, so that typos do not widen the watchlist
+	if err := ioutil.WriteFile(path, []byte("watchlists:\n- team-a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadProjectWatchlistFile(path)
+	assert.Error(t, err)
+
+	if err := ioutil.WriteFile(path, []byte("watchlist:\n- id:8d0ec6a5\nexclude:\n- domain:admin\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, err := ReadProjectWatchlistFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "watchlist=[id:8d0ec6a5] exclude=[domain:admin]", w.String())
+}
@@ -0,0 +1,240 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"context"
+	"errors"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/projects"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeLister lists one load balancer per project, after a delay. It records
+// the maximum number of projects listed at the same time.
+type fakeLister struct {
+	projects []string
+	tags     map[string][]string
+	status   map[string]string
+	delay    map[string]time.Duration
+	fail     map[string]bool
+
+	mu      gosync.Mutex
+	current int
+	max     int
+}
+
+func (l *fakeLister) ListProjects() ([]Project, error) {
+	var result []Project
+	for _, name := range l.projects {
+		result = append(result, Project{Project: projects.Project{ID: name + "-id", Name: name}, Tags: l.tags[name]})
+	}
+	return result, nil
+}
+
+func (l *fakeLister) ListLoadBalancers(projectID string) ([]loadbalancers.LoadBalancer, error) {
+	l.mu.Lock()
+	l.current++
+	if l.current > l.max {
+		l.max = l.current
+	}
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.current--
+		l.mu.Unlock()
+	}()
+
+	time.Sleep(l.delay[projectID])
+	if l.fail[projectID] {
+		return nil, errors.New("internal server error")
+	}
+	lb := loadbalancer(projectID, "", listener("listener", "", "HTTP", "pool", 80))
+	lb.ProvisioningStatus = l.status[projectID]
+	return []loadbalancers.LoadBalancer{lb}, nil
+}
+
+func (l *fakeLister) ListPools(projectID string) ([]pools.Pool, error) {
+	return []pools.Pool{pool("pool", "HTTP", projectID, poolmember("192.168.0.1", 8080))}, nil
+}
+
+func testReconciler(lister *fakeLister, workers int, timeout time.Duration) *Reconciler {
+	metrics := localmetrics.NewMetrics("openstack", "backend")
+	metrics.RegisterPrometheus(false)
+	client := fake.NewSimpleClientset()
+	r := NewReconciler("backend", ProjectWatchlist{}, client, time.Minute, lister, lister, logrus.New(), 1, metrics)
+	r.Workers = workers
+	r.ProjectTimeout = timeout
+	return &r
+}
+
+// syncedNamespaces returns the namespaces of the actions in the sync queue
+func syncedNamespaces(t *testing.T, r *Reconciler, total int) map[string]int {
+	namespaces := map[string]int{}
+	assert.Eventually(t, func() bool { return r.syncqueue.Workqueue.Len() == total }, time.Second, 10*time.Millisecond)
+	for r.syncqueue.Workqueue.Len() > 0 {
+		item, _ := r.syncqueue.Workqueue.Get()
+		namespaces[item.(sync.Action).ObjectMeta().GetNamespace()]++
+		r.syncqueue.Workqueue.Done(item)
+	}
+	return namespaces
+}
+
+// projectResults returns the number of projects reconciled with each result
+func projectResults(t *testing.T, r *Reconciler) map[string]uint64 {
+	gathering, err := r.Metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := map[string]uint64{}
+	for _, mf := range gathering {
+		if mf.GetName() != localmetrics.DiscovererProjectDurationSecondsHistogram {
+			continue
+		}
+		for _, m := range mf.Metric {
+			for _, l := range m.Label {
+				if l.GetName() == "result" {
+					results[l.GetValue()] += m.Histogram.GetSampleCount()
+				}
+			}
+		}
+	}
+	return results
+}
+
+func TestReconcileProjectsInParallel(t *testing.T) {
+	lister := &fakeLister{
+		projects: []string{"p1", "p2", "p3", "p4", "p5", "p6", "p7", "p8"},
+		delay: map[string]time.Duration{
+			"p1-id": 50 * time.Millisecond, "p2-id": 50 * time.Millisecond, "p3-id": 50 * time.Millisecond,
+			"p4-id": 50 * time.Millisecond, "p5-id": 50 * time.Millisecond, "p6-id": 50 * time.Millisecond,
+		},
+		fail: map[string]bool{"p7-id": true},
+	}
+	r := testReconciler(lister, 3, 0)
+	r.Watchlist, _ = ParseProjectWatchlist("p1,p2,p3,p4,p5,p6,p7", "")
+
+	r.reconcile(context.Background())
+
+	assert.Equal(t, 3, lister.max)
+	// The failed project does not keep the others from being reconciled
+	assert.Equal(t, map[string]int{"p1": 2, "p2": 2, "p3": 2, "p4": 2, "p5": 2, "p6": 2}, syncedNamespaces(t, r, 12))
+	assert.Equal(t, map[string]uint64{"success": 6, "error": 1}, projectResults(t, r))
+}
+
+func TestReconcileProjectTimeout(t *testing.T) {
+	lister := &fakeLister{
+		projects: []string{"fast", "slow"},
+		delay:    map[string]time.Duration{"slow-id": 500 * time.Millisecond},
+	}
+	r := testReconciler(lister, 2, 100*time.Millisecond)
+
+	start := time.Now()
+	r.reconcile(context.Background())
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "the cycle waited for the slow project")
+
+	// Nothing is written for the project that timed out
+	assert.Equal(t, map[string]int{"fast": 2}, syncedNamespaces(t, r, 2))
+	assert.Equal(t, map[string]uint64{"success": 1, "timeout": 1}, projectResults(t, r))
+}
+
+func TestReconcileSkipsOverlappingCycles(t *testing.T) {
+	lister := &fakeLister{
+		projects: []string{"p1"},
+		delay:    map[string]time.Duration{"p1-id": 200 * time.Millisecond},
+	}
+	r := testReconciler(lister, 1, 0)
+
+	done := make(chan struct{})
+	go func() {
+		r.reconcile(context.Background())
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		lister.mu.Lock()
+		defer lister.mu.Unlock()
+		return lister.current == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// The second cycle is skipped while the first one runs
+	r.reconcile(context.Background())
+	<-done
+	assert.Equal(t, map[string]int{"p1": 2}, syncedNamespaces(t, r, 2))
+	assert.Equal(t, map[string]uint64{"success": 1}, projectResults(t, r))
+
+	gathering, err := r.Metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped := 0.0
+	for _, mf := range gathering {
+		if mf.GetName() == localmetrics.DiscovererSkippedCyclesCounter {
+			skipped = mf.Metric[0].Counter.GetValue()
+		}
+	}
+	assert.Equal(t, 1.0, skipped)
+
+	// Cycles run again once the previous one is done
+	r.reconcile(context.Background())
+	assert.Equal(t, map[string]uint64{"success": 2}, projectResults(t, r))
+}
+
+func TestReconcileInvalidLoadBalancers(t *testing.T) {
+	lister := &fakeLister{
+		projects: []string{"p1", "p2"},
+		status:   map[string]string{"p1-id": "PENDING_UPDATE", "p2-id": "ACTIVE"},
+	}
+	r := testReconciler(lister, 1, 0)
+
+	// The service replicated before the load balancer started changing is
+	// left as it is
+	lbs, _ := lister.ListLoadBalancers("p1-id")
+	for _, svc := range kubeServices("backend", "p1", lbs, nil) {
+		if _, err := r.GimbalKubeClient.CoreV1().Services("p1").Create(context.Background(), &svc, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r.reconcile(context.Background())
+	assert.Equal(t, map[string]int{"p2": 2}, syncedNamespaces(t, r, 2))
+
+	gathering, err := r.Metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := map[string]float64{}
+	for _, mf := range gathering {
+		if mf.GetName() != localmetrics.DiscovererInvalidServicesGauge {
+			continue
+		}
+		for _, m := range mf.Metric {
+			for _, l := range m.Label {
+				if l.GetName() == "namespace" {
+					invalid[l.GetValue()] = m.Gauge.GetValue()
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{"p1": 1, "p2": 0}, invalid)
+}
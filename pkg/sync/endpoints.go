@@ -100,7 +100,12 @@ func addEndpoints(kubeClient kubernetes.Interface, endpoints *v1.Endpoints) erro
 }
 
 func deleteEndpoints(kubeClient kubernetes.Interface, endpoints *v1.Endpoints) error {
-	return kubeClient.CoreV1().Endpoints(endpoints.Namespace).Delete(context.TODO(), endpoints.Name, metav1.DeleteOptions{})
+	err := kubeClient.CoreV1().Endpoints(endpoints.Namespace).Delete(context.TODO(), endpoints.Name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		// Nothing to do, the endpoints is already gone
+		return nil
+	}
+	return err
 }
 
 func updateEndpoints(kubeClient kubernetes.Interface, endpoints *v1.Endpoints) error {
@@ -0,0 +1,167 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	discovery "k8s.io/api/discovery/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// AddEndpointSliceAction returns an action that adds a new endpoint slice to the cluster
+func AddEndpointSliceAction(slice *discovery.EndpointSlice, upstreamName string) Action {
+	return endpointSliceAction{kind: actionAdd, upstreamName: upstreamName, slice: slice}
+}
+
+// UpdateEndpointSliceAction returns an action that updates the given endpoint slice in the cluster
+func UpdateEndpointSliceAction(slice *discovery.EndpointSlice, upstreamName string) Action {
+	return endpointSliceAction{kind: actionUpdate, upstreamName: upstreamName, slice: slice}
+}
+
+// DeleteEndpointSliceAction returns an action that deletes the given endpoint slice from the cluster
+func DeleteEndpointSliceAction(slice *discovery.EndpointSlice, upstreamName string) Action {
+	return endpointSliceAction{kind: actionDelete, upstreamName: upstreamName, slice: slice}
+}
+
+// endpointSliceAction is an action that is to be performed on a specific endpoint slice.
+type endpointSliceAction struct {
+	kind         string
+	slice        *discovery.EndpointSlice
+	upstreamName string
+}
+
+// ObjectMeta returns the objectMeta piece of the Action interface object
+func (action endpointSliceAction) ObjectMeta() *metav1.ObjectMeta {
+	return &action.slice.ObjectMeta
+}
+
+func (action endpointSliceAction) GetActionType() string {
+	return action.kind
+}
+
+// Sync performs the action on the given EndpointSlice resource
+func (action endpointSliceAction) Sync(kubeClient kubernetes.Interface, logger *logrus.Logger) error {
+	var err error
+	switch action.kind {
+	case actionAdd:
+		err = addEndpointSlice(kubeClient, action.slice)
+	case actionUpdate:
+		err = updateEndpointSlice(kubeClient, action.slice)
+	case actionDelete:
+		err = deleteEndpointSlice(kubeClient, action.slice)
+	}
+	if err != nil {
+		return fmt.Errorf("error handling %s: %v", action, err)
+	}
+
+	return nil
+}
+
+func (action endpointSliceAction) String() string {
+	return fmt.Sprintf(`%s endpointslice '%s/%s'`, action.kind, action.slice.Namespace, action.slice.Name)
+}
+
+// SetMetrics records the number of endpoints replicated for the upstream
+// service. A service can have many slices, so all the slices of the service
+// in the Gimbal cluster are counted.
+func (action endpointSliceAction) SetMetrics(gimbalKubeClient kubernetes.Interface, metrics localmetrics.DiscovererMetrics,
+	logger *logrus.Logger) {
+	metrics.EndpointsEventTimestampMetric(action.slice.GetNamespace(), action.slice.GetName(), now().Unix())
+
+	selector := fmt.Sprintf("%s=%s", discovery.LabelServiceName, action.slice.Labels[discovery.LabelServiceName])
+	slices, err := gimbalKubeClient.DiscoveryV1beta1().EndpointSlices(action.slice.GetNamespace()).List(context.TODO(),
+		metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		logger.Errorf("Error listing endpoint slices in namespace %s: %v", action.slice.GetNamespace(), err)
+		return
+	}
+	total := 0
+	for i := range slices.Items {
+		total += SumEndpointSlice(&slices.Items[i])
+	}
+	metrics.DiscovererReplicatedEndpointsMetric(action.slice.GetNamespace(), action.upstreamName, total)
+}
+
+func (action endpointSliceAction) SetMetricError(metrics localmetrics.DiscovererMetrics) {
+	metrics.EndpointsMetricError(action.ObjectMeta().GetNamespace(), action.ObjectMeta().GetName(), action.GetActionType())
+}
+
+func addEndpointSlice(kubeClient kubernetes.Interface, slice *discovery.EndpointSlice) error {
+	_, err := kubeClient.DiscoveryV1beta1().EndpointSlices(slice.Namespace).Create(context.TODO(), slice, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		return updateEndpointSlice(kubeClient, slice)
+	}
+	return err
+}
+
+func deleteEndpointSlice(kubeClient kubernetes.Interface, slice *discovery.EndpointSlice) error {
+	err := kubeClient.DiscoveryV1beta1().EndpointSlices(slice.Namespace).Delete(context.TODO(), slice.Name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		// Nothing to do, the endpoint slice is already gone
+		return nil
+	}
+	return err
+}
+
+func updateEndpointSlice(kubeClient kubernetes.Interface, slice *discovery.EndpointSlice) error {
+	client := kubeClient.DiscoveryV1beta1().EndpointSlices(slice.Namespace)
+	existing, err := client.Get(context.TODO(), slice.Name, metav1.GetOptions{})
+
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return addEndpointSlice(kubeClient, slice)
+		}
+		return err
+	}
+
+	existingBytes, err := json.Marshal(existing)
+	if err != nil {
+		return err
+	}
+	// Need to set the resource version of the updated slice to the resource
+	// version of the current slice. Otherwise, the resulting patch does not
+	// have a resource version, and the server complains.
+	slice.ResourceVersion = existing.ResourceVersion
+	updatedBytes, err := json.Marshal(slice)
+	if err != nil {
+		return err
+	}
+	patchBytes, err := strategicpatch.CreateTwoWayMergePatch(existingBytes, updatedBytes, discovery.EndpointSlice{})
+	if err != nil {
+		return err
+	}
+	_, err = client.Patch(context.TODO(), slice.Name, types.StrategicMergePatchType, patchBytes, metav1.PatchOptions{})
+	return err
+}
+
+// SumEndpointSlice takes an endpoint slice and returns the total number of
+// addresses of its ready endpoints
+func SumEndpointSlice(slice *discovery.EndpointSlice) int {
+	total := 0
+	for _, ep := range slice.Endpoints {
+		if ep.Conditions.Ready == nil || *ep.Conditions.Ready {
+			total += len(ep.Addresses)
+		}
+	}
+	return total
+}
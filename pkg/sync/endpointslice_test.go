@@ -0,0 +1,137 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"testing"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestEndpointSliceAction(t *testing.T) {
+	tests := []struct {
+		name          string
+		actionKind    string
+		expectedVerbs []string
+		slice         discovery.EndpointSlice
+		existingSlice discovery.EndpointSlice
+	}{
+		{
+			name:          "add new endpointslice resource",
+			actionKind:    actionAdd,
+			slice:         discovery.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
+			expectedVerbs: []string{"create"},
+		},
+		{
+			name:          "add pre-existing endpointslice resource",
+			actionKind:    actionAdd,
+			slice:         discovery.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
+			existingSlice: discovery.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
+			expectedVerbs: []string{"create", "get", "patch"},
+		},
+		{
+			name:          "update pre-existing endpointslice resource",
+			actionKind:    actionUpdate,
+			slice:         discovery.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
+			existingSlice: discovery.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
+			expectedVerbs: []string{"get", "patch"},
+		},
+		{
+			name:          "update non-existent endpointslice resource",
+			actionKind:    actionUpdate,
+			slice:         discovery.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
+			expectedVerbs: []string{"get", "create"},
+		},
+		{
+			name:          "delete endpointslice resource",
+			actionKind:    actionDelete,
+			slice:         discovery.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
+			existingSlice: discovery.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
+			expectedVerbs: []string{"delete"},
+		},
+		{
+			name:          "delete non-existent endpointslice resource",
+			actionKind:    actionDelete,
+			slice:         discovery.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
+			expectedVerbs: []string{"delete"},
+		},
+	}
+
+	expectedResource := schema.GroupVersionResource{Group: "discovery.k8s.io", Version: "v1beta1", Resource: "endpointslices"}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(&tc.existingSlice)
+			a := endpointSliceAction{kind: tc.actionKind, slice: &tc.slice}
+			err := a.Sync(client, logrus.New())
+
+			require.NoError(t, err)
+			require.Len(t, client.Actions(), len(tc.expectedVerbs))
+			for i, expectedVerb := range tc.expectedVerbs {
+				assert.Equal(t, expectedResource, client.Actions()[i].GetResource())
+				assert.Equal(t, expectedVerb, client.Actions()[i].GetVerb())
+				// The patches are strategic merge patches, like the ones of services
+				if patch, ok := client.Actions()[i].(k8stesting.PatchAction); ok {
+					assert.Equal(t, types.StrategicMergePatchType, patch.GetPatchType())
+				}
+			}
+		})
+	}
+}
+
+func TestDiscovererEndpointSliceMetrics(t *testing.T) {
+	ready, notReady := true, false
+	labels := map[string]string{discovery.LabelServiceName: "backend-bar"}
+	existing := discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "backend-bar-abcde", Labels: labels},
+		Endpoints: []discovery.Endpoint{
+			{Addresses: []string{"192.168.0.1"}},
+			{Addresses: []string{"192.168.0.2"}, Conditions: discovery.EndpointConditions{Ready: &notReady}},
+		},
+	}
+	slice := discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "backend-bar-fghij", Labels: labels},
+		Endpoints: []discovery.Endpoint{
+			{Addresses: []string{"192.168.0.3"}, Conditions: discovery.EndpointConditions{Ready: &ready}},
+			{Addresses: []string{"192.168.0.4"}},
+		},
+	}
+
+	client := fake.NewSimpleClientset(&existing)
+	metrics := localmetrics.NewMetrics("backtype", "backend")
+	metrics.RegisterPrometheus(false)
+	a := endpointSliceAction{kind: actionAdd, slice: &slice, upstreamName: "bar"}
+	require.NoError(t, a.Sync(client, logrus.New()))
+
+	a.SetMetrics(client, metrics, logrus.New())
+
+	gathering, err := prometheus.Gatherers{metrics.Registry}.Gather()
+	require.NoError(t, err)
+	replicatedEndpoints := float64(-1)
+	for _, mf := range gathering {
+		if mf.GetName() == localmetrics.DiscovererReplicatedEndpointsGauge {
+			replicatedEndpoints = mf.Metric[0].Gauge.GetValue()
+		}
+	}
+	assert.Equal(t, float64(3), replicatedEndpoints)
+}
@@ -14,8 +14,10 @@
 package sync
 
 import (
+	"fmt"
 	"time"
 
+	"github.com/projectcontour/gimbal/pkg/health"
 	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
 	"github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -63,12 +65,103 @@ type Action interface {
 	GetActionType() string
 }
 
+// WithMetrics returns an action that records its metrics using the given
+// metrics instead of the queue's. This allows a single queue to be shared by
+// multiple backends.
+func WithMetrics(action Action, metrics *localmetrics.DiscovererMetrics) Action {
+	return backendAction{Action: action, metrics: metrics}
+}
+
+type backendAction struct {
+	Action
+	metrics *localmetrics.DiscovererMetrics
+}
+
+func (action backendAction) SetMetrics(gimbalKubeClient kubernetes.Interface, _ localmetrics.DiscovererMetrics, logger *logrus.Logger) {
+	action.Action.SetMetrics(gimbalKubeClient, *action.metrics, logger)
+}
+
+func (action backendAction) SetMetricError(_ localmetrics.DiscovererMetrics) {
+	action.Action.SetMetricError(*action.metrics)
+}
+
+func (action backendAction) String() string {
+	return fmt.Sprint(action.Action)
+}
+
+// WithPrecondition returns an action that is only synced if the precondition
+// holds when the action is processed by the queue. The precondition may query
+// the Gimbal cluster, which must not be done by the event handlers that queue
+// actions. If it does not hold, the action is dropped.
+func WithPrecondition(action Action, precondition func(kube kubernetes.Interface, logger *logrus.Logger) bool) Action {
+	return &conditionalAction{Action: action, precondition: precondition}
+}
+
+// conditionalAction is a pointer, so that it can be a key of the workqueue in
+// spite of its precondition
+type conditionalAction struct {
+	Action
+	precondition func(kube kubernetes.Interface, logger *logrus.Logger) bool
+}
+
+func (action *conditionalAction) Sync(kube kubernetes.Interface, logger *logrus.Logger) error {
+	if !action.precondition(kube, logger) {
+		return nil
+	}
+	return action.Action.Sync(kube, logger)
+}
+
+func (action *conditionalAction) String() string {
+	return fmt.Sprint(action.Action)
+}
+
+// ObjectKey returns the key of the object of an action, made of its kind,
+// namespace and name. Actions on the same object have the same key, whatever
+// their type.
+func ObjectKey(action Action) string {
+	kind := "unknown"
+	switch a := action.(type) {
+	case backendAction:
+		return ObjectKey(a.Action)
+	case *conditionalAction:
+		return ObjectKey(a.Action)
+	case serviceAction:
+		kind = "service"
+	case endpointsAction:
+		kind = "endpoints"
+	case endpointSliceAction:
+		kind = "endpointslice"
+	}
+	meta := action.ObjectMeta()
+	return kind + "/" + meta.GetNamespace() + "/" + meta.GetName()
+}
+
 // Enqueue adds a new resource action to the worker queue
 func (sq *Queue) Enqueue(action Action) {
 	sq.Workqueue.AddRateLimited(action)
 	sq.Metrics.QueueSizeGaugeMetric(sq.Workqueue.Len())
 }
 
+// HealthCheck returns a check that the queue is running. If maxLength is
+// positive, the check also fails when more actions than maxLength are waiting,
+// which means that the workers cannot keep up with the changes.
+func (sq *Queue) HealthCheck(maxLength int) health.Check {
+	return health.Check{
+		Name: "queue",
+		Run: func() (string, error) {
+			if sq.Workqueue.ShuttingDown() {
+				return "", fmt.Errorf("queue is shut down")
+			}
+			length := sq.Workqueue.Len()
+			detail := fmt.Sprintf("%d actions queued", length)
+			if maxLength > 0 && length > maxLength {
+				return detail, fmt.Errorf("more than %d actions queued", maxLength)
+			}
+			return detail, nil
+		},
+	}
+}
+
 // Run starts the queue workers. It blocks until the stopCh is closed.
 func (sq *Queue) Run(stopCh <-chan struct{}) {
 	defer runtime.HandleCrash()
@@ -1,7 +1,9 @@
 package sync
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -12,7 +14,10 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
 	k8stesting "k8s.io/client-go/testing"
 )
@@ -226,3 +231,40 @@ func assertCounterEqual(t *testing.T, expected float64, metricName string, reg *
 	}
 	assert.Equal(t, expected, v)
 }
+
+func TestObjectKey(t *testing.T) {
+	meta := metav1.ObjectMeta{Namespace: "team1", Name: "cluster1-test"}
+	m := metrics.NewMetrics("test", "backend")
+	tests := []struct {
+		name     string
+		action   Action
+		expected string
+	}{
+		{name: "service", action: UpdateServiceAction(&v1.Service{ObjectMeta: meta}), expected: "service/team1/cluster1-test"},
+		{name: "endpoints", action: DeleteEndpointsAction(&v1.Endpoints{ObjectMeta: meta}, "test"), expected: "endpoints/team1/cluster1-test"},
+		{name: "endpoint slice", action: AddEndpointSliceAction(&discovery.EndpointSlice{ObjectMeta: meta}, "test"), expected: "endpointslice/team1/cluster1-test"},
+		{name: "with metrics", action: WithMetrics(UpdateEndpointsAction(&v1.Endpoints{ObjectMeta: meta}, "test"), &m), expected: "endpoints/team1/cluster1-test"},
+		{name: "with precondition", action: WithPrecondition(DeleteServiceAction(&v1.Service{ObjectMeta: meta}), nil), expected: "service/team1/cluster1-test"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, ObjectKey(tc.action))
+		})
+	}
+}
+
+func TestWithPrecondition(t *testing.T) {
+	for _, holds := range []bool{true, false} {
+		t.Run(fmt.Sprint(holds), func(t *testing.T) {
+			client := fake.NewSimpleClientset(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "cluster1-test"}})
+			action := WithPrecondition(DeleteServiceAction(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "cluster1-test"}}),
+				func(kube kubernetes.Interface, logger *logrus.Logger) bool { return holds })
+
+			assert.NoError(t, action.Sync(client, logrus.New()))
+			assert.Equal(t, "delete service 'team1/cluster1-test'", fmt.Sprint(action))
+			services, err := client.CoreV1().Services("team1").List(context.TODO(), metav1.ListOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, !holds, len(services.Items) == 1)
+		})
+	}
+}
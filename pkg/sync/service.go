@@ -19,6 +19,7 @@ import (
 	"fmt"
 
 	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/translator"
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -90,7 +91,12 @@ func addService(kubeClient kubernetes.Interface, service *v1.Service) error {
 }
 
 func deleteService(kubeClient kubernetes.Interface, service *v1.Service) error {
-	return kubeClient.CoreV1().Services(service.Namespace).Delete(context.TODO(), service.Name, metav1.DeleteOptions{})
+	err := kubeClient.CoreV1().Services(service.Namespace).Delete(context.TODO(), service.Name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		// Nothing to do, the service is already gone
+		return nil
+	}
+	return err
 }
 
 func updateService(kubeClient kubernetes.Interface, service *v1.Service) error {
@@ -108,6 +114,8 @@ func updateService(kubeClient kubernetes.Interface, service *v1.Service) error {
 	if err != nil {
 		return err
 	}
+	// Keep the weight override set on the service in Gimbal
+	translator.OverrideWeight(&service.ObjectMeta, &existing.ObjectMeta)
 	// Need to set the resource version of the updated service to the resource
 	// version of the current service. Otherwise, the resulting patch does not
 	// have a resource version, and the server complains.
@@ -14,6 +14,7 @@
 package sync
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -23,6 +24,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/translator"
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -144,6 +146,35 @@ func TestUpdateService(t *testing.T) {
 	assert.Equal(t, expectedPatch, string(gotPatchBytes))
 }
 
+func TestUpdateServiceWeightOverride(t *testing.T) {
+	existing := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "foo",
+			Name:      "bar",
+			Annotations: map[string]string{
+				translator.GimbalAnnotationWeight:         "0",
+				translator.GimbalAnnotationWeightOverride: "0",
+			},
+		},
+	}
+	client := fake.NewSimpleClientset(&existing)
+
+	newService := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "foo",
+			Name:        "bar",
+			Annotations: map[string]string{translator.GimbalAnnotationWeight: "10"},
+		},
+	}
+	err := updateService(client, &newService)
+	require.NoError(t, err)
+
+	// The override set in Gimbal is kept, and takes precedence
+	svc, err := client.CoreV1().Services("foo").Get(context.TODO(), "bar", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, existing.Annotations, svc.Annotations)
+}
+
 func TestDiscovererServiceMetrics(t *testing.T) {
 	backendName := "backend"
 	backendType := "backtype"
@@ -0,0 +1,192 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translator
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// LastAppliedConfigAnnotation is the annotation kubectl apply stores the
+	// last applied configuration of an object in. It is denied by default.
+	LastAppliedConfigAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+	rewriteTemplateBackend = "{{backend}}"
+
+	// labelValueMarker is added to the label values that do not begin or end
+	// with an alphanumeric character.
+	labelValueMarker = "x"
+)
+
+var invalidLabelValueChars = regexp.MustCompile(`[^a-zA-Z0-9\-._]`)
+
+// Policy filters and rewrites the annotations of the objects replicated to
+// Gimbal. An annotation is replicated if its key matches one of the allow
+// patterns (or there are none), and none of the deny patterns. The maps of
+// the remote objects may be shared with an informer cache, so they are never
+// modified, and copies are returned instead. A nil Policy replicates all the
+// annotations as they are.
+type Policy struct {
+	allow    []string
+	deny     []string
+	rewrites []rewrite
+}
+
+type rewrite struct {
+	from, to string
+}
+
+// NewPolicy returns a Policy built from lists of allow and deny patterns, and
+// key prefix rewrites. Patterns are shell globs matched against annotation
+// keys, e.g. "kubectl.kubernetes.io/*". Rewrites map key prefixes to their
+// replacement, where {{backend}} is replaced by the backend name, e.g.
+// "projectcontour.io/" to "remote.{{backend}}/". The longest matching prefix
+// is rewritten.
+func NewPolicy(allow, deny []string, rewrites map[string]string) (*Policy, error) {
+	p := &Policy{}
+	var err error
+	if p.allow, err = annotationPatterns(allow); err != nil {
+		return nil, fmt.Errorf("invalid annotation allow pattern: %v", err)
+	}
+	if p.deny, err = annotationPatterns(deny); err != nil {
+		return nil, fmt.Errorf("invalid annotation deny pattern: %v", err)
+	}
+	for from, to := range rewrites {
+		// Render the replacement with a placeholder backend name to make
+		// sure it can only produce valid annotation keys.
+		key := strings.Replace(to, rewriteTemplateBackend, "a", -1) + "a"
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid annotation rewrite %s=%s: %s", from, to, strings.Join(errs, ", "))
+		}
+		p.rewrites = append(p.rewrites, rewrite{from: from, to: to})
+	}
+	sort.Slice(p.rewrites, func(i, j int) bool {
+		return len(p.rewrites[i].from) > len(p.rewrites[j].from)
+	})
+	return p, nil
+}
+
+func annotationPatterns(patterns []string) ([]string, error) {
+	var valid []string
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("%q: %v", p, err)
+		}
+		valid = append(valid, p)
+	}
+	return valid, nil
+}
+
+// Annotations returns the annotations of the Gimbal object of a remote object
+// of the given backend. Annotations whose rewritten key is not valid are
+// dropped.
+func (p *Policy) Annotations(backendName string, annotations map[string]string) map[string]string {
+	if len(annotations) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		if !p.allowed(k) {
+			continue
+		}
+		k = p.rewrite(backendName, k)
+		if len(validation.IsQualifiedName(k)) > 0 {
+			continue
+		}
+		result[k] = v
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+func (p *Policy) allowed(key string) bool {
+	if p == nil {
+		return true
+	}
+	return (len(p.allow) == 0 || matchAny(p.allow, key)) && !matchAny(p.deny, key)
+}
+
+func (p *Policy) rewrite(backendName, key string) string {
+	if p == nil {
+		return key
+	}
+	for _, r := range p.rewrites {
+		if strings.HasPrefix(key, r.from) {
+			return strings.Replace(r.to, rewriteTemplateBackend, backendName, -1) + strings.TrimPrefix(key, r.from)
+		}
+	}
+	return key
+}
+
+func matchAny(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SanitizeLabels returns a copy of the labels, without the labels whose key is
+// not valid, and with their values sanitized by SanitizeLabelValue.
+func SanitizeLabels(labels map[string]string) map[string]string {
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if len(validation.IsQualifiedName(k)) > 0 {
+			continue
+		}
+		result[k] = SanitizeLabelValue(v, labelValueMarker)
+	}
+	return result
+}
+
+// SanitizeLabelValue returns a valid label value from the given string. The
+// kubernetes label value requirements are: "Valid label values must be 63
+// characters or less and must be empty or begin and end with an alphanumeric
+// character ([a-z0-9A-Z]) with dashes (-), underscores (_), dots (.), and
+// alphanumerics between." The marker is added to the values that do not begin
+// or end with an alphanumeric character.
+func SanitizeLabelValue(value, marker string) string {
+	if value == "" || len(validation.IsValidLabelValue(value)) == 0 {
+		return value
+	}
+	// 1. replace unallowed chars with a dash
+	value = invalidLabelValueChars.ReplaceAllString(value, "-")
+
+	// 2. prepend/append a special marker if first/last char is not an alphanum
+	if !isalphanum(value[0]) {
+		value = marker + value
+	}
+	if !isalphanum(value[len(value)-1]) {
+		value = value + marker
+	}
+	// 3. shorten if necessary
+	return ShortenKubernetesLabelValue(value)
+}
+
+func isalphanum(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,161 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyAnnotations(t *testing.T) {
+	annotations := map[string]string{
+		LastAppliedConfigAnnotation:               "{}",
+		"projectcontour.io/upstream-protocol.h2c": "80",
+		"projectcontour.io/max-connections":       "10",
+		"team.example.com/owner":                  "team1",
+		"prometheus.io/scrape":                    "true",
+		"gimbal.projectcontour.io/discover":       "true",
+		"projectcontour.io/a-really-long-annotation-name-that-is-exactly-63-characters-lng": "x",
+	}
+
+	tests := []struct {
+		name     string
+		allow    []string
+		deny     []string
+		rewrites map[string]string
+		expected map[string]string
+	}{
+		{
+			name:     "no policy",
+			expected: annotations,
+		},
+		{
+			name: "deny",
+			deny: []string{LastAppliedConfigAnnotation, "projectcontour.io/*"},
+			expected: map[string]string{
+				"team.example.com/owner":            "team1",
+				"prometheus.io/scrape":              "true",
+				"gimbal.projectcontour.io/discover": "true",
+			},
+		},
+		{
+			name:  "allow and deny",
+			allow: []string{"projectcontour.io/*", "*.example.com/*"},
+			deny:  []string{"projectcontour.io/max-*"},
+			expected: map[string]string{
+				"projectcontour.io/upstream-protocol.h2c": "80",
+				"team.example.com/owner":                  "team1",
+				"projectcontour.io/a-really-long-annotation-name-that-is-exactly-63-characters-lng": "x",
+			},
+		},
+		{
+			name:  "rewrite",
+			allow: []string{"projectcontour.io/*", "team.example.com/*"},
+			rewrites: map[string]string{
+				"projectcontour.io/":     "remote.{{backend}}/",
+				"projectcontour.io/max-": "remote.{{backend}}/limit-",
+			},
+			expected: map[string]string{
+				"remote.cluster1/upstream-protocol.h2c": "80",
+				"remote.cluster1/limit-connections":     "10",
+				"team.example.com/owner":                "team1",
+				"remote.cluster1/a-really-long-annotation-name-that-is-exactly-63-characters-lng": "x",
+			},
+		},
+		{
+			name:     "invalid rewritten key",
+			allow:    []string{"projectcontour.io/*"},
+			rewrites: map[string]string{"projectcontour.io/": "remote.{{backend}}/x-"},
+			expected: map[string]string{
+				"remote.cluster1/x-upstream-protocol.h2c": "80",
+				"remote.cluster1/x-max-connections":       "10",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewPolicy(tc.allow, tc.deny, tc.rewrites)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, p.Annotations("cluster1", annotations))
+		})
+	}
+}
+
+func TestPolicyAnnotationsCopiesAnnotations(t *testing.T) {
+	annotations := map[string]string{"key1": "value1"}
+	var p *Policy
+	got := p.Annotations("cluster1", annotations)
+	got["key2"] = "value2"
+	assert.Equal(t, map[string]string{"key1": "value1"}, annotations)
+	assert.Nil(t, p.Annotations("cluster1", nil))
+}
+
+func TestNewPolicyErrors(t *testing.T) {
+	_, err := NewPolicy([]string{"[a-"}, nil, nil)
+	assert.Error(t, err)
+	_, err = NewPolicy(nil, []string{"[a-"}, nil)
+	assert.Error(t, err)
+	_, err = NewPolicy(nil, nil, map[string]string{"projectcontour.io/": "remote_{{backend}}/"})
+	assert.Error(t, err)
+	_, err = NewPolicy(nil, nil, map[string]string{"projectcontour.io/": "remote/{{backend}}/"})
+	assert.Error(t, err)
+}
+
+func TestSanitizeLabels(t *testing.T) {
+	got := SanitizeLabels(map[string]string{
+		"app":              "kuard",
+		"invalid key":      "value",
+		"example.com/team": "-team1",
+		"empty":            "",
+	})
+	assert.Equal(t, map[string]string{
+		"app":              "kuard",
+		"example.com/team": "x-team1",
+		"empty":            "",
+	}, got)
+}
+
+func TestSanitizeLabelValue(t *testing.T) {
+	tests := map[string]string{
+		"":           "",
+		"foo":        "foo",
+		"foo bar":    "foo-bar",
+		"-foo":       "lb-foo",
+		"foo.":       "foo.lb",
+		"_foo_":      "lb_foo_lb",
+		"FOO-bar_01": "FOO-bar_01",
+		"a-really-long-load-balancer-name-that-is-longer-than-63-characters": "a-really-long-load-balancer-name-that-is-longer-than-63-cc7e8e8",
+	}
+	for value, expected := range tests {
+		assert.Equal(t, expected, SanitizeLabelValue(value, "lb"), value)
+	}
+}
+
+func TestIsAlphanum(t *testing.T) {
+	someAlphanums := []byte{'a', 'e', 'z', 'A', 'E', 'Z', '0', '5', '9'}
+	for _, a := range someAlphanums {
+		if !isalphanum(a) {
+			t.Errorf("got not alphanum for %c", a)
+		}
+	}
+
+	someNonAlphanums := []byte{'!', '@', '#', '$', '%', '^', '&', '*', '(', ')', '.', ',', ':', '-', '_', '+', '='}
+	for _, a := range someNonAlphanums {
+		if isalphanum(a) {
+			t.Errorf("got yes alphanum for %c", a)
+		}
+	}
+}
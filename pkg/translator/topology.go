@@ -0,0 +1,107 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translator
+
+import (
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// GimbalLabelZone is the key of the label that contains the zone of the
+	// endpoints of a service, when they all live in the same zone
+	GimbalLabelZone = "gimbal.projectcontour.io/zone"
+	// GimbalLabelRegion is the key of the label that contains the region of
+	// the endpoints of a service, when they all live in the same region
+	GimbalLabelRegion = "gimbal.projectcontour.io/region"
+	// GimbalAnnotationZones is the key of the annotation that contains the
+	// comma-separated, sorted list of the zones of the endpoints of a service
+	GimbalAnnotationZones = "gimbal.projectcontour.io/zones"
+)
+
+// Topology is the set of zones and regions the endpoints of a service live in.
+// The zero value is an empty topology.
+type Topology struct {
+	zones   map[string]bool
+	regions map[string]bool
+}
+
+// Add adds the zone and region of an endpoint. Empty values are unknown, and
+// are skipped.
+func (t *Topology) Add(zone, region string) {
+	if zone != "" {
+		if t.zones == nil {
+			t.zones = map[string]bool{}
+		}
+		t.zones[zone] = true
+	}
+	if region != "" {
+		if t.regions == nil {
+			t.regions = map[string]bool{}
+		}
+		t.regions[region] = true
+	}
+}
+
+// Zones returns the sorted zones of the topology
+func (t Topology) Zones() []string {
+	return sortedKeys(t.zones)
+}
+
+// Regions returns the sorted regions of the topology
+func (t Topology) Regions() []string {
+	return sortedKeys(t.regions)
+}
+
+// Equal returns true if both topologies have the same zones and regions
+func (t Topology) Equal(other Topology) bool {
+	return strings.Join(t.Zones(), ",") == strings.Join(other.Zones(), ",") &&
+		strings.Join(t.Regions(), ",") == strings.Join(other.Regions(), ",")
+}
+
+// AddTopology records the topology of the endpoints of a service in its
+// labels and annotations. The zone and region labels are only set when all
+// the endpoints live in the same zone or region, while the zones annotation
+// lists all of their zones.
+func AddTopology(meta *metav1.ObjectMeta, t Topology) {
+	zones, regions := t.Zones(), t.Regions()
+	if len(zones) == 1 || len(regions) == 1 {
+		if meta.Labels == nil {
+			meta.Labels = map[string]string{}
+		}
+		if len(zones) == 1 {
+			meta.Labels[GimbalLabelZone] = SanitizeLabelValue(zones[0], labelValueMarker)
+		}
+		if len(regions) == 1 {
+			meta.Labels[GimbalLabelRegion] = SanitizeLabelValue(regions[0], labelValueMarker)
+		}
+	}
+	if len(zones) > 0 {
+		if meta.Annotations == nil {
+			meta.Annotations = map[string]string{}
+		}
+		meta.Annotations[GimbalAnnotationZones] = strings.Join(zones, ",")
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,83 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAddTopology(t *testing.T) {
+	tests := []struct {
+		name        string
+		localities  [][2]string
+		labels      map[string]string
+		annotations map[string]string
+	}{
+		{
+			name: "unknown topology",
+		},
+		{
+			name:        "single zone",
+			localities:  [][2]string{{"us-east-1a", "us-east-1"}, {"us-east-1a", "us-east-1"}},
+			labels:      map[string]string{GimbalLabelZone: "us-east-1a", GimbalLabelRegion: "us-east-1"},
+			annotations: map[string]string{GimbalAnnotationZones: "us-east-1a"},
+		},
+		{
+			name:        "many zones",
+			localities:  [][2]string{{"us-east-1b", "us-east-1"}, {"us-east-1a", "us-east-1"}, {"", ""}},
+			labels:      map[string]string{GimbalLabelRegion: "us-east-1"},
+			annotations: map[string]string{GimbalAnnotationZones: "us-east-1a,us-east-1b"},
+		},
+		{
+			name:       "region only",
+			localities: [][2]string{{"", "RegionOne"}},
+			labels:     map[string]string{GimbalLabelRegion: "RegionOne"},
+		},
+		{
+			name:        "invalid zone",
+			localities:  [][2]string{{"nova zone", ""}},
+			labels:      map[string]string{GimbalLabelZone: "nova-zone"},
+			annotations: map[string]string{GimbalAnnotationZones: "nova zone"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var topology Topology
+			for _, l := range tc.localities {
+				topology.Add(l[0], l[1])
+			}
+			var meta metav1.ObjectMeta
+			AddTopology(&meta, topology)
+			assert.Equal(t, tc.labels, meta.Labels)
+			assert.Equal(t, tc.annotations, meta.Annotations)
+		})
+	}
+}
+
+func TestTopologyEqual(t *testing.T) {
+	var a, b Topology
+	assert.True(t, a.Equal(b))
+
+	a.Add("zone-a", "region")
+	b.Add("zone-b", "region")
+	assert.False(t, a.Equal(b))
+
+	a.Add("zone-b", "")
+	b.Add("zone-a", "")
+	assert.True(t, a.Equal(b))
+}
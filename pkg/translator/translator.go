@@ -22,26 +22,20 @@ import (
 
 const (
 	// GimbalLabelBackend is the key of the label that contains the cluster name
-	GimbalLabelBackend          = "gimbal.projectcontour.io/backend"
-	gimbalLabelService          = "gimbal.projectcontour.io/service"
+	GimbalLabelBackend = "gimbal.projectcontour.io/backend"
+	// GimbalLabelService is the key of the label that contains the name of
+	// the service in the backend
+	GimbalLabelService          = "gimbal.projectcontour.io/service"
 	maxKubernetesDNSLabelLength = 63
 )
 
 // AddGimbalLabels returns a new set of labels that includes the incoming set of
-// labels, plus gimbal-specific ones.
+// labels, plus gimbal-specific ones. The incoming set of labels is not modified.
 func AddGimbalLabels(backendname, name string, existingLabels map[string]string) map[string]string {
-	gimbalLabels := map[string]string{
-		GimbalLabelBackend: ShortenKubernetesLabelValue(backendname),
-		gimbalLabelService: ShortenKubernetesLabelValue(name),
-	}
-	if existingLabels == nil {
-		return gimbalLabels
-	}
-	// Set gimbal labels on the existing labels map
-	for k, v := range gimbalLabels {
-		existingLabels[k] = v
-	}
-	return existingLabels
+	labels := SanitizeLabels(existingLabels)
+	labels[GimbalLabelBackend] = ShortenKubernetesLabelValue(backendname)
+	labels[GimbalLabelService] = ShortenKubernetesLabelValue(name)
+	return labels
 }
 
 // BuildDiscoveredName returns the discovered name of the service in a given
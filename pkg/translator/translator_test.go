@@ -184,3 +184,9 @@ func TestAddLabels(t *testing.T) {
 		})
 	}
 }
+
+func TestAddGimbalLabelsCopiesLabels(t *testing.T) {
+	podLabels := map[string]string{"key1": "value1"}
+	AddGimbalLabels("cluster01", "service01", podLabels)
+	assert.Equal(t, map[string]string{"key1": "value1"}, podLabels)
+}
@@ -0,0 +1,96 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translator
+
+import (
+	"fmt"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// GimbalAnnotationWeight is the key of the annotation that contains the
+	// weight of the traffic routed to a service among the services of the
+	// same name in other backends. Remote services may set it as well.
+	GimbalAnnotationWeight = "gimbal.projectcontour.io/weight"
+	// GimbalAnnotationWeightOverride is the key of the annotation that Gimbal
+	// operators set on a replicated service to override its weight. It is
+	// never replicated from remote services.
+	GimbalAnnotationWeightOverride = "gimbal.projectcontour.io/weight-override"
+)
+
+// ParseWeight parses the weight of a service. Weights are non-negative
+// integers, like the weights of Contour routes.
+func ParseWeight(weight string) (uint32, error) {
+	w, err := strconv.ParseUint(weight, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid weight %q, must be a non-negative integer", weight)
+	}
+	return uint32(w), nil
+}
+
+// AddWeight records the weight of a service of a backend in its annotations.
+// The weight annotation of the remote service takes precedence over the
+// default weight of the backend. If the remote weight is not valid, the
+// default weight is recorded, and an error is returned. If neither is set,
+// the weight annotation is removed.
+func AddWeight(meta *metav1.ObjectMeta, defaultWeight string, remote map[string]string) error {
+	// The override only comes from the Gimbal service
+	delete(meta.Annotations, GimbalAnnotationWeightOverride)
+
+	var err error
+	weight := defaultWeight
+	if w, ok := remote[GimbalAnnotationWeight]; ok {
+		if _, err = ParseWeight(w); err == nil {
+			weight = w
+		} else {
+			err = fmt.Errorf("service %s/%s: %v", meta.GetNamespace(), meta.GetName(), err)
+		}
+	}
+	setWeight(meta, weight)
+	return err
+}
+
+// OverrideWeight applies the weight override of the current Gimbal service,
+// if any, to the desired one, so that the override is kept and takes
+// precedence over the replicated weight.
+func OverrideWeight(desired, current *metav1.ObjectMeta) {
+	override, ok := current.Annotations[GimbalAnnotationWeightOverride]
+	if !ok {
+		return
+	}
+	if _, err := ParseWeight(override); err != nil {
+		return
+	}
+	if desired.Annotations == nil {
+		desired.Annotations = map[string]string{}
+	}
+	desired.Annotations[GimbalAnnotationWeightOverride] = override
+	setWeight(desired, override)
+}
+
+// setWeight sets the weight annotation to the normalized weight, or removes
+// it if the weight is empty or not valid.
+func setWeight(meta *metav1.ObjectMeta, weight string) {
+	w, err := ParseWeight(weight)
+	if weight == "" || err != nil {
+		delete(meta.Annotations, GimbalAnnotationWeight)
+		return
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[GimbalAnnotationWeight] = strconv.FormatUint(uint64(w), 10)
+}
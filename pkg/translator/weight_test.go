@@ -0,0 +1,130 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseWeight(t *testing.T) {
+	for _, w := range []string{"0", "1", "100", "4294967295"} {
+		_, err := ParseWeight(w)
+		assert.NoError(t, err, w)
+	}
+	for _, w := range []string{"", "-1", "1.5", "ten", "4294967296"} {
+		_, err := ParseWeight(w)
+		assert.Error(t, err, w)
+	}
+}
+
+func TestAddWeight(t *testing.T) {
+	tests := []struct {
+		name          string
+		annotations   map[string]string
+		defaultWeight string
+		remote        map[string]string
+		expected      map[string]string
+		expectedErr   bool
+	}{
+		{
+			name: "no weight",
+		},
+		{
+			name:          "default weight",
+			defaultWeight: "10",
+			expected:      map[string]string{GimbalAnnotationWeight: "10"},
+		},
+		{
+			name:          "remote weight",
+			annotations:   map[string]string{GimbalAnnotationWeight: "050", "foo": "bar"},
+			defaultWeight: "10",
+			remote:        map[string]string{GimbalAnnotationWeight: "050"},
+			expected:      map[string]string{GimbalAnnotationWeight: "50", "foo": "bar"},
+		},
+		{
+			name:          "invalid remote weight",
+			annotations:   map[string]string{GimbalAnnotationWeight: "heavy"},
+			defaultWeight: "10",
+			remote:        map[string]string{GimbalAnnotationWeight: "heavy"},
+			expected:      map[string]string{GimbalAnnotationWeight: "10"},
+			expectedErr:   true,
+		},
+		{
+			name:        "invalid remote weight without default",
+			annotations: map[string]string{GimbalAnnotationWeight: "heavy"},
+			remote:      map[string]string{GimbalAnnotationWeight: "heavy"},
+			expected:    map[string]string{},
+			expectedErr: true,
+		},
+		{
+			name:        "remote override",
+			annotations: map[string]string{GimbalAnnotationWeightOverride: "0"},
+			remote:      map[string]string{GimbalAnnotationWeightOverride: "0"},
+			expected:    map[string]string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			meta := metav1.ObjectMeta{Annotations: tc.annotations}
+			err := AddWeight(&meta, tc.defaultWeight, tc.remote)
+			assert.Equal(t, tc.expectedErr, err != nil)
+			assert.Equal(t, tc.expected, meta.Annotations)
+		})
+	}
+}
+
+func TestOverrideWeight(t *testing.T) {
+	tests := []struct {
+		name     string
+		desired  map[string]string
+		current  map[string]string
+		expected map[string]string
+	}{
+		{
+			name:     "no override",
+			desired:  map[string]string{GimbalAnnotationWeight: "10"},
+			current:  map[string]string{GimbalAnnotationWeight: "20"},
+			expected: map[string]string{GimbalAnnotationWeight: "10"},
+		},
+		{
+			name:     "override",
+			desired:  map[string]string{GimbalAnnotationWeight: "10"},
+			current:  map[string]string{GimbalAnnotationWeight: "10", GimbalAnnotationWeightOverride: "0"},
+			expected: map[string]string{GimbalAnnotationWeight: "0", GimbalAnnotationWeightOverride: "0"},
+		},
+		{
+			name:     "override without replicated weight",
+			current:  map[string]string{GimbalAnnotationWeightOverride: "5"},
+			expected: map[string]string{GimbalAnnotationWeight: "5", GimbalAnnotationWeightOverride: "5"},
+		},
+		{
+			name:     "invalid override",
+			desired:  map[string]string{GimbalAnnotationWeight: "10"},
+			current:  map[string]string{GimbalAnnotationWeightOverride: "none"},
+			expected: map[string]string{GimbalAnnotationWeight: "10"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			desired := metav1.ObjectMeta{Annotations: tc.desired}
+			OverrideWeight(&desired, &metav1.ObjectMeta{Annotations: tc.current})
+			assert.Equal(t, tc.expected, desired.Annotations)
+		})
+	}
+}
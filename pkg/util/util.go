@@ -15,6 +15,9 @@ limitations under the License.
 package util
 
 import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
 	"regexp"
 
 	"github.com/sirupsen/logrus"
@@ -33,3 +36,21 @@ func GetFormatter() *logrus.TextFormatter {
 func IsInvalidBackendName(backendname string) bool {
 	return !backendNameRegex.MatchString(backendname)
 }
+
+// FilesChecksum returns a checksum of the contents of the given files, which
+// changes when any of them changes. Empty paths are skipped.
+func FilesChecksum(paths ...string) (string, error) {
+	h := sha256.New()
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s:%d:", path, len(data))
+		h.Write(data)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
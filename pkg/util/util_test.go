@@ -14,6 +14,9 @@
 package util
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -93,3 +96,40 @@ func TestTranslateService(t *testing.T) {
 		})
 	}
 }
+
+func TestFilesChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	username, password := filepath.Join(dir, "username"), filepath.Join(dir, "password")
+	write := func(path, content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(username, "admin")
+	write(password, "secret")
+
+	before, err := FilesChecksum(username, "", password)
+	assert.NoError(t, err)
+	same, err := FilesChecksum(username, password)
+	assert.NoError(t, err)
+	assert.Equal(t, before, same)
+
+	write(password, "rotated")
+	after, err := FilesChecksum(username, password)
+	assert.NoError(t, err)
+	assert.NotEqual(t, before, after)
+
+	// Moving content from one file to the other is a change
+	write(username, "adminrotated")
+	write(password, "")
+	moved, err := FilesChecksum(username, password)
+	assert.NoError(t, err)
+	assert.NotEqual(t, after, moved)
+
+	_, err = FilesChecksum(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}